@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+)
+
+// commands are maintenance tasks that can be run in place of the service,
+// e.g. `remote-standby verify-log outage.log`.
+var commands = map[string]func(args []string, out io.Writer) int{
+	"verify-log": verifyLogCommand,
+	"plan-at":    planAtCommand,
+	"plan-diff":  planDiffCommand,
+}
+
+func verifyLogCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("verify-log", flag.ContinueOnError)
+	flags.SetOutput(out)
+	keyFile := flags.String("hmac-key-file", "", "file containing the site key used to authenticate records")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(out, "usage: remote-standby verify-log [-hmac-key-file path] [-json] <outage log>")
+		return 2
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = os.ReadFile(*keyFile); err != nil {
+			fmt.Fprintf(out, "reading key file: %s\n", err)
+			return 2
+		}
+	}
+
+	result, err := outagelog.Verify(flags.Arg(0), key)
+	if err != nil {
+		fmt.Fprintf(out, "verifying outage log: %s\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(result)
+	} else {
+		fmt.Fprintf(out, "records %d (seq %d to %d), %d unchained\n", result.Records, result.FirstSeq, result.LastSeq, result.Unchained)
+		fmt.Fprintf(out, "last hash %s\n", result.LastHash)
+		for _, issue := range result.Issues {
+			fmt.Fprintln(out, issue)
+		}
+	}
+
+	if !result.Valid() {
+		return 1
+	}
+	return 0
+}
+
+func planAtCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("plan-at", flag.ContinueOnError)
+	flags.SetOutput(out)
+	asJSON := flags.Bool("json", false, "print the whole plan as JSON")
+	timezone := flags.String("timezone", "", "site time zone to show and read times in, e.g. Australia/Sydney")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintln(out, "usage: remote-standby plan-at [-json] [-timezone zone] <plan archive dir> <time>")
+		return 2
+	}
+
+	location, err := loadTimezone(*timezone)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	at, err := parseCommandTime(flags.Arg(1), location)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	archive, err := openPlanArchive(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	archived, err := archive.EffectiveAt(at)
+	if err != nil {
+		fmt.Fprintf(out, "looking up plan: %s\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(archived)
+		return 0
+	}
+
+	fmt.Fprintf(out, "plan optimised %s, received %s, %d intervals\n",
+		archived.Plan.OptimisationTimestamp.Format(location), archived.Received.In(location).Format(time.RFC3339), len(archived.Plan.OptimisationIntervals))
+
+	for _, intv := range archived.Plan.OptimisationIntervals {
+		if intv.IsCurrent(at) {
+			fmt.Fprintf(out, "interval %s to %s, meter power %g, battery power %g\n",
+				intv.Interval.StartTime.Format(location), intv.Interval.EndTime.Format(location),
+				intv.MeterPower.Value, intv.BatteryPower.Value)
+			return 0
+		}
+	}
+
+	fmt.Fprintln(out, "no interval covers that time")
+	return 0
+}
+
+func planDiffCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("plan-diff", flag.ContinueOnError)
+	flags.SetOutput(out)
+	asJSON := flags.Bool("json", false, "print the differences as JSON")
+	timezone := flags.String("timezone", "", "site time zone to show and read times in, e.g. Australia/Sydney")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		fmt.Fprintln(out, "usage: remote-standby plan-diff [-json] [-timezone zone] <plan archive dir> <from time> <to time>")
+		return 2
+	}
+
+	location, err := loadTimezone(*timezone)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	archive, err := openPlanArchive(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	var plans [2]plan.OptimisationPlan
+	for i, arg := range flags.Args()[1:] {
+		at, err := parseCommandTime(arg, location)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 2
+		}
+
+		archived, err := archive.EffectiveAt(at)
+		if err != nil {
+			fmt.Fprintf(out, "looking up plan: %s\n", err)
+			return 1
+		}
+		plans[i] = archived.Plan
+	}
+
+	diffs := plan.Diff(plans[0], plans[1])
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(diffs)
+		return 0
+	}
+
+	for _, diff := range diffs {
+		fmt.Fprintf(out, "%s to %s, meter power %+g, battery power %+g\n",
+			diff.Start.In(location).Format(time.RFC3339), diff.End.In(location).Format(time.RFC3339), diff.MeterPowerDelta, diff.BatteryPowerDelta)
+	}
+	fmt.Fprintf(out, "%d changed periods\n", len(diffs))
+
+	return 0
+}
+
+// openPlanArchive opens an existing plan archive, without pruning it.
+func openPlanArchive(dir string) (*plan.Archive, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("opening plan archive: %w", err)
+	}
+	return plan.OpenArchive(dir, 0)
+}
+
+// parseCommandTime parses a time given as RFC 3339, as a local time without
+// an offset, which is taken to be in the site time zone, or as Unix seconds.
+func parseCommandTime(s string, location *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", s, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time must be RFC 3339, local or Unix seconds: %q", s)
+	}
+	return t, nil
+}
+
+// loadTimezone loads the site time zone times are shown and read in, or
+// returns the local time zone if none is given.
+func loadTimezone(name string) (*time.Location, error) {
+	return config.Config{Timezone: name}.Location()
+}
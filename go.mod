@@ -6,6 +6,8 @@ require (
 	github.com/cristalhq/aconfig v0.19.0
 	github.com/cristalhq/aconfig/aconfigyaml v0.17.1
 	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/klauspost/compress v1.18.0
+	google.golang.org/protobuf v1.36.9
 )
 
 require (
@@ -19,5 +21,5 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.11.0
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -15,12 +15,16 @@ import (
 // File-based values are loaded in a two-step process, after env vars,
 // so they cannot be configured with required:true.
 type Config struct {
-	SiteName          string        `env:"SITE_NAME"`
-	SerialNumber      string        `env:"SERIAL_NUMBER"`
-	ConfigurationPath string        `env:"CONFIGURATION_PATH" default:"config.yaml"`
-	Logging           LoggingConfig `yaml:"logging"`
-	MQTT              MQTTConfig    `yaml:"mqtt"`
-	Standby           StandbyConfig `yaml:"standby"`
+	SiteName          string           `env:"SITE_NAME"`
+	SerialNumber      string           `env:"SERIAL_NUMBER"`
+	ConfigurationPath string           `env:"CONFIGURATION_PATH" default:"config.yaml"`
+	Timezone          string           `yaml:"timezone"`
+	Logging           LoggingConfig    `yaml:"logging"`
+	MQTT              MQTTConfig       `yaml:"mqtt"`
+	Standby           StandbyConfig    `yaml:"standby"`
+	Outputs           OutputsConfig    `yaml:"outputs"`
+	Controller        ControllerConfig `yaml:"controller"`
+	Envelope          EnvelopeConfig   `yaml:"envelope"`
 }
 
 type LoggingConfig struct {
@@ -28,19 +32,179 @@ type LoggingConfig struct {
 }
 
 type MQTTConfig struct {
-	BrokerURL         string `yaml:"broker_url" default:"tcp://localhost:1883/"`
-	WriteCommandTopic string `yaml:"write_command_topic" default:"cmd/${SITE_NAME}/handler/${SERIAL_NUMBER}/standby"`
-	ReadCommandTopic  string `yaml:"read_command_topic" default:"cmd/${SITE_NAME}/handler/${SERIAL_NUMBER}/cloud"`
-	StandbyTopic      string `yaml:"standby_topic" default:"cmd/${SITE_NAME}/standby/${SERIAL_NUMBER}/#"`
-	ErrorTopic        string `yaml:"error_topic" default:"dt/${SITE_NAME}/error/${SERIAL_NUMBER}"`
-	CommandAction     string `yaml:"command_action" default:"SETPOINT"`
+	BrokerURL           string        `yaml:"broker_url" default:"tcp://localhost:1883/"`
+	WriteCommandTopic   string        `yaml:"write_command_topic" default:"cmd/${SITE_NAME}/handler/${SERIAL_NUMBER}/standby"`
+	ReadCommandTopic    string        `yaml:"read_command_topic" default:"cmd/${SITE_NAME}/handler/${SERIAL_NUMBER}/cloud"`
+	StandbyTopic        string        `yaml:"standby_topic" default:"cmd/${SITE_NAME}/standby/${SERIAL_NUMBER}/#"`
+	ErrorTopic          string        `yaml:"error_topic" default:"dt/${SITE_NAME}/error/${SERIAL_NUMBER}"`
+	StatusTopic         string        `yaml:"status_topic" default:"dt/${SITE_NAME}/standby/${SERIAL_NUMBER}/status"`
+	ReportTopic         string        `yaml:"report_topic" default:"dt/${SITE_NAME}/standby/${SERIAL_NUMBER}/outage"`
+	ShadowTopic         string        `yaml:"shadow_topic" default:"dt/${SITE_NAME}/standby/${SERIAL_NUMBER}/shadow"`
+	CommandAction       string        `yaml:"command_action" default:"SETPOINT"`
+	QueueDir            string        `yaml:"queue_dir" default:"queue"`
+	QueueMaxBytes       int64         `yaml:"queue_max_bytes" default:"1048576"`
+	QueueMaxAge         time.Duration `yaml:"queue_max_age" default:"168h"`
+	ProtobufSuffix      string        `yaml:"protobuf_suffix" default:"/protobuf"`
+	TelemetryTopic      string        `yaml:"telemetry_topic" default:"dt/${SITE_NAME}/telemetry/${SERIAL_NUMBER}"`
+	EnvelopeTopic       string        `yaml:"envelope_topic" default:"cmd/${SITE_NAME}/envelope/${SERIAL_NUMBER}"`
+	DemandResponseTopic string        `yaml:"demand_response_topic" default:"cmd/${SITE_NAME}/demand-response/${SERIAL_NUMBER}"`
 }
 
 type StandbyConfig struct {
-	BackupFile      string        `yaml:"backup_file" default:"plan.json"`
-	OutageLogFile   string        `yaml:"outage_log_file" default:"outage.log"`
-	CheckInterval   time.Duration `yaml:"check_interval" default:"60s"`
-	OutageThreshold time.Duration `yaml:"outage_threshold" default:"180s"`
+	BackupFile              string        `yaml:"backup_file" default:"plan.json"`
+	OutageLogFile           string        `yaml:"outage_log_file" default:"outage.log"`
+	OutageLogMaxSize        int64         `yaml:"outage_log_max_size" default:"10485760"`
+	OutageLogMaxAge         time.Duration `yaml:"outage_log_max_age" default:"720h"`
+	OutageLogCompress       bool          `yaml:"outage_log_compress" default:"true"`
+	OutageLogMaxBackups     int           `yaml:"outage_log_max_backups" default:"5"`
+	OutageLogHMACKeyFile    string        `yaml:"outage_log_hmac_key_file"`
+	OutageLogRetryInterval  time.Duration `yaml:"outage_log_retry_interval" default:"60s"`
+	OutageLogBufferSize     int           `yaml:"outage_log_buffer_size" default:"1000"`
+	CheckInterval           time.Duration `yaml:"check_interval" default:"60s"`
+	OutageThreshold         time.Duration `yaml:"outage_threshold" default:"180s"`
+	CoverageMinPercent      float64       `yaml:"coverage_min_percent" default:"50"`
+	CoverageMinHorizon      time.Duration `yaml:"coverage_min_horizon" default:"6h"`
+	CoverageWarningInterval time.Duration `yaml:"coverage_warning_interval" default:"1h"`
+	// The cloud commands received in the drift window are compared with the
+	// plan, and an alert published if they differ by more than DriftThreshold
+	// kW on average, once there are at least DriftMinSamples of them.
+	DriftWindow        time.Duration `yaml:"drift_window" default:"1h"`
+	DriftMinSamples    int           `yaml:"drift_min_samples" default:"10"`
+	DriftThreshold     float64       `yaml:"drift_threshold" default:"1"`
+	DriftAlertInterval time.Duration `yaml:"drift_alert_interval" default:"1h"`
+	// Shadow makes the standby publish the commands it would issue to the
+	// shadow topic instead of sending them to the site.
+	Shadow bool `yaml:"shadow"`
+	// Plans larger than PlanMaxSize bytes, once decompressed, are rejected.
+	// PlanCompression is how the backup file is stored: none, gzip or zstd.
+	PlanMaxSize     int64  `yaml:"plan_max_size" default:"8388608"`
+	PlanCompression string `yaml:"plan_compression" default:"none"`
+	// PlanKeys are the public keys that plans and demand response events must
+	// be signed with, each as <id>:<base64 Ed25519 public key>. Without any,
+	// they are rejected unless AllowUnsignedPlans is set.
+	PlanKeys           []string `yaml:"plan_keys"`
+	AllowUnsignedPlans bool     `yaml:"allow_unsigned_plans"`
+	// Every accepted plan is kept in PlanArchiveDir, if set, for PlanArchiveRetention.
+	PlanArchiveDir       string        `yaml:"plan_archive_dir"`
+	PlanArchiveRetention time.Duration `yaml:"plan_archive_retention" default:"720h"`
+	// Interpolation is step, linear or ramp, with RampRate in kW per minute.
+	// During an outage commands are published every CommandInterval, if set,
+	// rather than on every check.
+	Interpolation   string        `yaml:"interpolation" default:"step"`
+	RampRate        float64       `yaml:"ramp_rate" default:"5"`
+	CommandInterval time.Duration `yaml:"command_interval"`
+	// During an outage the battery's state of charge, as a fraction, is
+	// estimated from telemetry for up to TelemetryMaxAge after the last
+	// reading, and extrapolated from the battery power meanwhile if
+	// BatteryCapacity (kWh) is set. The battery is held
+	// rather than taken beyond SoCMin or SoCMax, or further than
+	// SoCMaxDeviation from the plan's state of charge.
+	BatteryCapacity float64       `yaml:"battery_capacity"`
+	TelemetryMaxAge time.Duration `yaml:"telemetry_max_age" default:"15m"`
+	SoCMin          float64       `yaml:"soc_min" default:"0.1"`
+	SoCMax          float64       `yaml:"soc_max" default:"0.95"`
+	SoCMaxDeviation float64       `yaml:"soc_max_deviation" default:"0.2"`
+	// Fallback is what the standby does during an outage when the plan has
+	// no setpoint: none, self_consumption to run the controller, or tariff to
+	// follow a schedule generated from the time-of-use tariff in TariffFile.
+	Fallback   string `yaml:"fallback" default:"none"`
+	TariffFile string `yaml:"tariff_file" default:"tariff.yaml"`
+	// Demand response events that have not yet ended are kept in
+	// DemandResponseFile, alongside the plan's backup file.
+	DemandResponseFile string `yaml:"demand_response_file" default:"demand-response.json"`
+}
+
+const (
+	FallbackNone            = "none"
+	FallbackSelfConsumption = "self_consumption"
+	FallbackTariff          = "tariff"
+)
+
+// ControllerConfig configures the self-consumption controller, which trims
+// the meter setpoint to keep the measured meter power at Target kW, positive
+// when importing. Kp is in kW per kW of error and Ki in kW per kW of error
+// per second. Commands are kept between MinOutput and MaxOutput kW, change by
+// at most MaxStep kW at a time, and are sent at most every MinInterval. The
+// controller stops when the latest meter reading is older than MaxReadingAge.
+type ControllerConfig struct {
+	Target        float64       `yaml:"target"`
+	Kp            float64       `yaml:"kp" default:"0.5"`
+	Ki            float64       `yaml:"ki" default:"0.05"`
+	MinOutput     float64       `yaml:"min_output" default:"-10"`
+	MaxOutput     float64       `yaml:"max_output" default:"10"`
+	MaxStep       float64       `yaml:"max_step" default:"2"`
+	MinInterval   time.Duration `yaml:"min_interval" default:"10s"`
+	MaxReadingAge time.Duration `yaml:"max_reading_age" default:"1m"`
+}
+
+// EnvelopeConfig configures the limits on the site's import and export, in
+// kW, that every command is kept within. MaxImport and MaxExport always
+// apply, such as those of the site's connection agreement. Envelopes received
+// on the envelope topic tighten them while they are active, and once an
+// envelope has been received, DefaultImport and DefaultExport tighten them
+// whenever none is, unless the envelopes carry their own defaults.
+// Negative limits are no limit. The last envelope received is kept in File.
+type EnvelopeConfig struct {
+	File          string  `yaml:"file" default:"envelope.json"`
+	MaxImport     float64 `yaml:"max_import" default:"-1"`
+	MaxExport     float64 `yaml:"max_export" default:"-1"`
+	DefaultImport float64 `yaml:"default_import" default:"-1"`
+	DefaultExport float64 `yaml:"default_export" default:"-1"`
+}
+
+const (
+	OutputMQTT   = "mqtt"
+	OutputHTTP   = "http"
+	OutputModbus = "modbus"
+	OutputFile   = "file"
+)
+
+// The setpoints an output can write.
+const (
+	QuantityBatteryPower = "battery_power"
+	QuantityMeterPower   = "meter_power"
+)
+
+// OutputsConfig selects where commands are sent. Several outputs can be
+// enabled, so that the standby can still command the site directly when
+// the commands handler is the component that has failed.
+type OutputsConfig struct {
+	Enabled []string           `yaml:"enabled" default:"mqtt"`
+	HTTP    HTTPOutputConfig   `yaml:"http"`
+	Modbus  ModbusOutputConfig `yaml:"modbus"`
+	File    FileOutputConfig   `yaml:"file"`
+}
+
+// HTTPOutputConfig configures a webhook that commands are POSTed to as JSON.
+type HTTPOutputConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout" default:"5s"`
+}
+
+// ModbusOutputConfig configures a Modbus TCP device, such as an inverter or
+// battery controller, that an active power setpoint is written to. Quantity
+// selects the setpoint, either the battery's, for an inverter's active power
+// setpoint, or the meter's. The register holds the setpoint in kW multiplied
+// by Scale, so a register in watts has a scale of 1000. DataType is one of
+// int16, uint16, int32, uint32 and float32, and ByteOrder one of ABCD, CDAB,
+// BADC and DCBA. If Verify is set, the register is read back after each write
+// to check the device accepted it.
+type ModbusOutputConfig struct {
+	Address   string        `yaml:"address"`
+	UnitID    uint8         `yaml:"unit_id" default:"1"`
+	Register  uint16        `yaml:"register"`
+	Quantity  string        `yaml:"quantity" default:"battery_power"`
+	DataType  string        `yaml:"data_type" default:"int16"`
+	ByteOrder string        `yaml:"byte_order" default:"ABCD"`
+	Scale     float64       `yaml:"scale" default:"1"`
+	Verify    bool          `yaml:"verify" default:"true"`
+	Timeout   time.Duration `yaml:"timeout" default:"5s"`
+}
+
+// FileOutputConfig configures a file that commands are appended to as JSON
+// lines, for dry runs. A path of "-" writes to stdout.
+type FileOutputConfig struct {
+	Path string `yaml:"path" default:"-"`
 }
 
 func fromEnv() (Config, error) {
@@ -97,10 +261,30 @@ func (cfg Config) NewFromFile() (Config, error) {
 	return fileCfg, nil
 }
 
+// Location returns the site's time zone, or the local time zone if none is
+// configured.
+func (cfg Config) Location() (*time.Location, error) {
+	if cfg.Timezone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("loading time zone: %w", err)
+	}
+	return location, nil
+}
+
 func (cfg *Config) InterpolateEnvVars() {
 	replacer := strings.NewReplacer("${SITE_NAME}", cfg.SiteName, "${SERIAL_NUMBER}", cfg.SerialNumber)
 	cfg.MQTT.ReadCommandTopic = replacer.Replace(cfg.MQTT.ReadCommandTopic)
 	cfg.MQTT.WriteCommandTopic = replacer.Replace(cfg.MQTT.WriteCommandTopic)
 	cfg.MQTT.StandbyTopic = replacer.Replace(cfg.MQTT.StandbyTopic)
 	cfg.MQTT.ErrorTopic = replacer.Replace(cfg.MQTT.ErrorTopic)
+	cfg.MQTT.StatusTopic = replacer.Replace(cfg.MQTT.StatusTopic)
+	cfg.MQTT.ReportTopic = replacer.Replace(cfg.MQTT.ReportTopic)
+	cfg.MQTT.ShadowTopic = replacer.Replace(cfg.MQTT.ShadowTopic)
+	cfg.MQTT.TelemetryTopic = replacer.Replace(cfg.MQTT.TelemetryTopic)
+	cfg.MQTT.EnvelopeTopic = replacer.Replace(cfg.MQTT.EnvelopeTopic)
+	cfg.MQTT.DemandResponseTopic = replacer.Replace(cfg.MQTT.DemandResponseTopic)
 }
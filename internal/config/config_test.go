@@ -1,7 +1,10 @@
 package config_test
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
 	"github.com/stretchr/testify/assert"
@@ -72,3 +75,53 @@ func TestReadFromFile_WhenConfigFilePathIsAbsent_ReturnsError(t *testing.T) {
 	_, err := cfgNoPath.NewFromFile()
 	assert.Error(t, err)
 }
+
+func TestReadFromFile_ReadsOutputs(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(testPath, []byte(`
+outputs:
+  enabled: ["mqtt", "http", "modbus"]
+  http:
+    url: "http://localhost:8080/commands"
+  modbus:
+    address: "localhost:502"
+    unit_id: 3
+    register: 40100
+    data_type: "float32"
+    byte_order: "CDAB"
+    scale: 10
+`), 0o644))
+
+	cfg := config.Config{ConfigurationPath: testPath}
+
+	got, err := cfg.NewFromFile()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{config.OutputMQTT, config.OutputHTTP, config.OutputModbus}, got.Outputs.Enabled)
+	assert.Equal(t, "http://localhost:8080/commands", got.Outputs.HTTP.URL)
+	assert.Equal(t, 5*time.Second, got.Outputs.HTTP.Timeout)
+	assert.Equal(t, config.ModbusOutputConfig{
+		Address: "localhost:502", UnitID: 3, Register: 40100, Quantity: config.QuantityBatteryPower, DataType: "float32", ByteOrder: "CDAB", Scale: 10, Verify: true, Timeout: 5 * time.Second,
+	}, got.Outputs.Modbus)
+	assert.Equal(t, "-", got.Outputs.File.Path)
+}
+
+func TestReadFromFile_DefaultsToMQTTOutput(t *testing.T) {
+	got, err := config.Config{ConfigurationPath: "../../tests/integration/config.yaml"}.NewFromFile()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{config.OutputMQTT}, got.Outputs.Enabled)
+}
+
+func TestReadFromFile_ReadsPlanKeys(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(testPath, []byte(`
+standby:
+  plan_keys: ["2024:MCowBQYDK2VwAyEA", "2025:MCowBQYDK2VwAyEB"]
+`), 0o644))
+
+	got, err := config.Config{ConfigurationPath: testPath}.NewFromFile()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"2024:MCowBQYDK2VwAyEA", "2025:MCowBQYDK2VwAyEB"}, got.Standby.PlanKeys)
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	"github.com/EvergenEnergy/remote-standby/internal/storage"
+)
+
+// ErrNoReading is returned when there is no recent enough meter reading to control on.
+var ErrNoReading = errors.New("no recent meter reading")
+
+// Output is the result of a step of the controller.
+type Output struct {
+	// Command is the meter setpoint to send, in kW.
+	Command publisher.CommandPayload
+	// Measured is the meter reading the command was calculated from, and
+	// Error the target less that reading.
+	Measured float64
+	Error    float64
+	// Due is false when the last command was sent too recently for another
+	// to be sent yet.
+	Due bool
+}
+
+// LogFormat returns the output as fields for the outage log.
+func (o Output) LogFormat() map[string]string {
+	return map[string]string{
+		"value":         fmt.Sprintf("%.3f", o.Command.Value),
+		"measuredPower": fmt.Sprintf("%.3f", o.Measured),
+		"controlError":  fmt.Sprintf("%.3f", o.Error),
+	}
+}
+
+// SelfConsumption is a proportional-integral controller that keeps the power
+// measured at the site's meter near a target, typically zero, so that the
+// battery charges from solar surplus and discharges to cover load. Its output
+// is the meter setpoint, which it trims until the measured power follows.
+type SelfConsumption struct {
+	cfg        config.ControllerConfig
+	action     string
+	storageSvc *storage.Service
+	publisher  *publisher.Service
+
+	mu          sync.Mutex
+	integral    float64
+	output      float64
+	lastUpdate  time.Time
+	lastCommand time.Time
+}
+
+// NewSelfConsumption returns a controller reading the meter power from
+// storage, which publishes commands with the given action.
+func NewSelfConsumption(cfg config.ControllerConfig, action string, storageSvc *storage.Service, publisher *publisher.Service) *SelfConsumption {
+	return &SelfConsumption{cfg: cfg, action: action, storageSvc: storageSvc, publisher: publisher}
+}
+
+// Reset clears the controller's state, so that it starts afresh the next time
+// it is stepped.
+func (c *SelfConsumption) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.integral = 0
+	c.output = 0
+	c.lastUpdate = time.Time{}
+	c.lastCommand = time.Time{}
+}
+
+// Step runs the control loop on the latest meter reading. The output is
+// limited to the configured range, to changing by at most MaxStep kW from the
+// last command sent, and to the operating envelope.
+func (c *SelfConsumption) Step(now time.Time) (Output, error) {
+	return c.StepWithin(now, envelope.NoLimits)
+}
+
+// StepWithin runs the control loop like Step, also keeping the output within
+// the given limits, such as those keeping the battery within its state of
+// charge limits. The operating envelope still applies over them.
+func (c *SelfConsumption) StepWithin(now time.Time, limits envelope.Limits) (Output, error) {
+	reading, ok := c.storageSvc.GetReading(storage.ReadingMeterPower)
+	if !ok || (c.cfg.MaxReadingAge > 0 && now.Sub(reading.Received) > c.cfg.MaxReadingAge) {
+		return Output{}, ErrNoReading
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	controlError := c.cfg.Target - reading.Value
+
+	var elapsed float64
+	if !c.lastUpdate.IsZero() && now.After(c.lastUpdate) {
+		elapsed = now.Sub(c.lastUpdate).Seconds()
+	}
+	c.lastUpdate = now
+
+	integral := c.integral + c.cfg.Ki*controlError*elapsed
+	output := c.cfg.Target + c.cfg.Kp*controlError + integral
+
+	limited := math.Max(c.cfg.MinOutput, math.Min(c.cfg.MaxOutput, output))
+	if !c.lastCommand.IsZero() && c.cfg.MaxStep > 0 {
+		limited = math.Max(c.output-c.cfg.MaxStep, math.Min(c.output+c.cfg.MaxStep, limited))
+	}
+	limited = limits.Clamp(limited)
+	if c.publisher != nil {
+		limited = c.publisher.Limits(now).Clamp(limited)
+	}
+
+	// The integral only accumulates while the output is within its limits,
+	// so that it does not wind up while the battery cannot follow.
+	if limited == output {
+		c.integral = integral
+	}
+
+	due := c.lastCommand.IsZero() || now.Sub(c.lastCommand) >= c.cfg.MinInterval
+	if due {
+		c.output = limited
+		c.lastCommand = now
+	}
+
+	return Output{
+		Command:  publisher.CommandPayload{Action: c.action, Value: limited},
+		Measured: reading.Value,
+		Error:    controlError,
+		Due:      due,
+	}, nil
+}
+
+// Publish sends the output's command through the publisher.
+func (c *SelfConsumption) Publish(output Output) (publisher.Delivery, error) {
+	return c.publisher.PublishCommandPayload(output.Command)
+}
@@ -0,0 +1,128 @@
+package controller_test
+
+import (
+	"log/slog"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/controller"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/EvergenEnergy/remote-standby/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() config.ControllerConfig {
+	return config.ControllerConfig{
+		Kp:            0.5,
+		Ki:            0.05,
+		MinOutput:     -5,
+		MaxOutput:     5,
+		MaxStep:       2,
+		MinInterval:   10 * time.Second,
+		MaxReadingAge: time.Minute,
+	}
+}
+
+func TestSelfConsumption_RequiresRecentReading(t *testing.T) {
+	storageSvc := storage.NewService(slog.Default())
+	ctrl := controller.NewSelfConsumption(testConfig(), "SETPOINT", storageSvc, nil)
+	now := time.Now()
+
+	_, err := ctrl.Step(now)
+	assert.ErrorIs(t, err, controller.ErrNoReading)
+
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 1, Received: now.Add(-2 * time.Minute)})
+	_, err = ctrl.Step(now)
+	assert.ErrorIs(t, err, controller.ErrNoReading)
+}
+
+func TestSelfConsumption_LimitsOutput(t *testing.T) {
+	storageSvc := storage.NewService(slog.Default())
+	ctrl := controller.NewSelfConsumption(testConfig(), "SETPOINT", storageSvc, nil)
+	now := time.Now()
+
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 3, Received: now})
+	output, err := ctrl.Step(now)
+	require.NoError(t, err)
+	assert.True(t, output.Due)
+	assert.Equal(t, "SETPOINT", output.Command.Action)
+	assert.InDelta(t, -1.5, output.Command.Value, 1e-9)
+	assert.InDelta(t, -3, output.Error, 1e-9)
+
+	// Too soon after the last command for another.
+	output, err = ctrl.Step(now.Add(5 * time.Second))
+	require.NoError(t, err)
+	assert.False(t, output.Due)
+
+	// The output can only move by the maximum step from the last command.
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 20, Received: now.Add(10 * time.Second)})
+	output, err = ctrl.Step(now.Add(10 * time.Second))
+	require.NoError(t, err)
+	assert.True(t, output.Due)
+	assert.InDelta(t, -3.5, output.Command.Value, 1e-9)
+
+	// And stays within the output range.
+	output, err = ctrl.Step(now.Add(20 * time.Second))
+	require.NoError(t, err)
+	assert.InDelta(t, -5, output.Command.Value, 1e-9)
+
+	ctrl.Reset()
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 1, Received: now.Add(30 * time.Second)})
+	output, err = ctrl.Step(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.5, output.Command.Value, 1e-9)
+}
+
+func TestSelfConsumption_ConvergesOnTarget(t *testing.T) {
+	storageSvc := storage.NewService(slog.Default())
+	ctrl := controller.NewSelfConsumption(testConfig(), "SETPOINT", storageSvc, nil)
+	now := time.Now()
+
+	// The site settles 1.5 kW above the setpoint it is given, so following
+	// the setpoint alone would leave it importing.
+	const offset = 1.5
+	measured := 2.0
+
+	for i := 0; i < 100; i++ {
+		at := now.Add(time.Duration(i) * 10 * time.Second)
+		storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: measured, Received: at})
+
+		output, err := ctrl.Step(at)
+		require.NoError(t, err)
+		measured = output.Command.Value + offset
+	}
+
+	assert.Less(t, math.Abs(measured), 0.01)
+}
+
+func TestSelfConsumption_StepWithinLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxStep = 0
+	storageSvc := storage.NewService(slog.Default())
+	ctrl := controller.NewSelfConsumption(cfg, "SETPOINT", storageSvc, nil)
+	now := time.Now()
+
+	// Importing 3 kW would have the battery discharge, unless the meter
+	// setpoint is kept at or above 1 kW.
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 3, Received: now})
+	output, err := ctrl.StepWithin(now, envelope.Limits{MaxImport: math.Inf(1), MaxExport: -1})
+	require.NoError(t, err)
+	assert.InDelta(t, 1, output.Command.Value, 1e-9)
+
+	// The integral does not wind up while the output is held.
+	for i := 1; i <= 10; i++ {
+		at := now.Add(time.Duration(i) * 10 * time.Second)
+		storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 3, Received: at})
+		_, err := ctrl.StepWithin(at, envelope.Limits{MaxImport: math.Inf(1), MaxExport: -1})
+		require.NoError(t, err)
+	}
+
+	at := now.Add(110 * time.Second)
+	storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: 3, Received: at})
+	output, err = ctrl.StepWithin(at, envelope.NoLimits)
+	require.NoError(t, err)
+	assert.InDelta(t, -3, output.Command.Value, 1e-9)
+}
@@ -0,0 +1,219 @@
+package demandresponse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+)
+
+var (
+	ErrWrongSite = errors.New("demand response event is for another site")
+	ErrNotNewer  = errors.New("demand response event is not newer than the last event accepted")
+)
+
+// Event is a demand response event dispatched by the grid operator, loosely
+// following OpenADR. While it is active, the meter is held at TargetPower kW,
+// positive when importing, in place of the plan's setpoint. Duration is in
+// seconds. Where events overlap, the one with the highest priority applies,
+// then the one that started last. An event with Cancel set removes the event
+// with the same ID instead. SiteID and IssuedAt bind a signed event to the
+// site and to when the grid operator issued it, so that it can't be replayed.
+type Event struct {
+	EventID     string    `json:"event_id"`
+	SiteID      string    `json:"site_id,omitempty"`
+	IssuedAt    time.Time `json:"issued_at,omitempty"`
+	Start       time.Time `json:"start"`
+	Duration    int64     `json:"duration"`
+	TargetPower float64   `json:"target_power"`
+	Priority    int       `json:"priority"`
+	Cancel      bool      `json:"cancel,omitempty"`
+}
+
+// Parse reads an event.
+func Parse(data []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Event{}, fmt.Errorf("unmarshalling demand response event: %w", err)
+	}
+
+	if event.EventID == "" {
+		return Event{}, errors.New("demand response event has no ID")
+	}
+	if !event.Cancel && (event.Start.IsZero() || event.Duration <= 0) {
+		return Event{}, fmt.Errorf("demand response event %q has no start or duration", event.EventID)
+	}
+
+	return event, nil
+}
+
+// End returns when the event ends.
+func (e Event) End() time.Time {
+	return e.Start.Add(time.Duration(e.Duration) * time.Second)
+}
+
+// IsActive reports whether the event is in progress at a time.
+func (e Event) IsActive(at time.Time) bool {
+	return !at.Before(e.Start) && at.Before(e.End())
+}
+
+// Override returns the interval with its meter setpoint replaced by the
+// event's target. The battery setpoint is moved by as much as the meter's,
+// taking the site's load to be unchanged. Without an interval, the event's
+// own period is used, with the battery covering the whole target.
+func (e Event) Override(interval plan.OptimisationInterval) plan.OptimisationInterval {
+	if interval.IsEmpty() {
+		return plan.OptimisationInterval{
+			Interval: plan.OptimisationIntervalTimestamp{
+				StartTime: plan.NewTimestamp(e.Start),
+				EndTime:   plan.NewTimestamp(e.End()),
+			},
+			MeterPower:   plan.OptimisationValue{Value: float32(e.TargetPower), Unit: plan.UnitKilowatt},
+			BatteryPower: plan.OptimisationValue{Value: float32(e.TargetPower), Unit: plan.UnitKilowatt},
+		}
+	}
+
+	change := e.TargetPower - interval.MeterPower.Kilowatts()
+	interval.MeterPower = interval.MeterPower.WithKilowatts(e.TargetPower)
+	interval.BatteryPower = interval.BatteryPower.WithKilowatts(interval.BatteryPower.Kilowatts() + change)
+
+	return interval
+}
+
+// LogFormat returns the event as fields for the outage log, with its times in
+// the given time zone.
+func (e Event) LogFormat(location *time.Location) map[string]string {
+	return map[string]string{
+		"eventId":     e.EventID,
+		"eventStart":  e.Start.In(location).Format(time.RFC3339),
+		"eventEnd":    e.End().In(location).Format(time.RFC3339),
+		"targetPower": fmt.Sprintf("%.3f", e.TargetPower),
+		"priority":    strconv.Itoa(e.Priority),
+	}
+}
+
+// Store keeps the events that have not yet ended in a file, so that they
+// survive a restart, along with when the newest event accepted was issued.
+type Store struct {
+	mu         sync.Mutex
+	path       string
+	events     []Event
+	lastIssued time.Time
+}
+
+// storeFile is the contents of the store's file.
+type storeFile struct {
+	LastIssued time.Time `json:"last_issued"`
+	Events     []Event   `json:"events"`
+}
+
+// OpenStore opens the store in the file at path, which need not exist yet.
+// If the file cannot be read, the store starts empty, and the error is
+// returned with it, so that new events are still accepted.
+func OpenStore(path string) (*Store, error) {
+	store := &Store{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return store, fmt.Errorf("reading demand response events: %w", err)
+	}
+
+	var stored storeFile
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return store, fmt.Errorf("unmarshalling demand response events: %w", err)
+	}
+	store.events = stored.Events
+	store.lastIssued = stored.LastIssued
+
+	return store, nil
+}
+
+// CheckFresh rejects an event for another site, or one that was not issued
+// after the newest event accepted, including cancellations. A signature only
+// shows that the grid operator issued an event at some point, so without this
+// check a cancelled event could be replayed to reinstate it.
+func (s *Store) CheckFresh(event Event, siteID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.SiteID != siteID {
+		return fmt.Errorf("%w: %q, not %q", ErrWrongSite, event.SiteID, siteID)
+	}
+	if !event.IssuedAt.After(s.lastIssued) {
+		return fmt.Errorf("%w: issued at %s, last accepted event at %s", ErrNotNewer,
+			event.IssuedAt.Format(time.RFC3339Nano), s.lastIssued.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// Add stores an event, replacing any with the same ID, or removes that event
+// if it is a cancellation. Events that have ended by now are dropped.
+func (s *Store) Add(event Event, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]Event, 0, len(s.events)+1)
+	for _, existing := range s.events {
+		if existing.EventID != event.EventID && existing.End().After(now) {
+			events = append(events, existing)
+		}
+	}
+	if !event.Cancel && event.End().After(now) {
+		events = append(events, event)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+
+	lastIssued := s.lastIssued
+	if event.IssuedAt.After(lastIssued) {
+		lastIssued = event.IssuedAt
+	}
+
+	encoded, err := json.Marshal(storeFile{LastIssued: lastIssued, Events: events})
+	if err != nil {
+		return fmt.Errorf("marshalling demand response events: %w", err)
+	}
+	if err := os.WriteFile(s.path+".tmp", encoded, 0o644); err != nil {
+		return fmt.Errorf("storing demand response events: %w", err)
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		return fmt.Errorf("storing demand response events: %w", err)
+	}
+
+	s.events = events
+	s.lastIssued = lastIssued
+
+	return nil
+}
+
+// Active returns the event that applies at a time, if any.
+func (s *Store) Active(at time.Time) (Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		active Event
+		found  bool
+	)
+
+	for _, event := range s.events {
+		if !event.IsActive(at) {
+			continue
+		}
+		if !found || event.Priority > active.Priority || (event.Priority == active.Priority && !event.Start.Before(active.Start)) {
+			active, found = event, true
+		}
+	}
+
+	return active, found
+}
@@ -0,0 +1,143 @@
+package demandresponse_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/demandresponse"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	event, err := demandresponse.Parse([]byte(`{"event_id": "dr-1", "start": "2024-05-10T17:00:00+10:00", "duration": 3600, "target_power": -5, "priority": 2}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "dr-1", event.EventID)
+	assert.Equal(t, int64(1715324400), event.Start.Unix())
+	assert.Equal(t, int64(1715328000), event.End().Unix())
+	assert.InDelta(t, -5, event.TargetPower, 1e-9)
+	assert.Equal(t, 2, event.Priority)
+
+	_, err = demandresponse.Parse([]byte(`{"event_id": "dr-2", "start": "2024-05-10T17:00:00+10:00"}`))
+	assert.Error(t, err)
+
+	_, err = demandresponse.Parse([]byte(`{"start": "2024-05-10T17:00:00+10:00", "duration": 60}`))
+	assert.Error(t, err)
+
+	cancel, err := demandresponse.Parse([]byte(`{"event_id": "dr-1", "cancel": true}`))
+	require.NoError(t, err)
+	assert.True(t, cancel.Cancel)
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demand-response.json")
+	now := time.Unix(1715320000, 0)
+
+	store, err := demandresponse.OpenStore(path)
+	require.NoError(t, err)
+
+	low := demandresponse.Event{EventID: "low", Start: now, Duration: 3600, TargetPower: -2, Priority: 1}
+	high := demandresponse.Event{EventID: "high", Start: now.Add(10 * time.Minute), Duration: 600, TargetPower: -5, Priority: 2}
+	ended := demandresponse.Event{EventID: "ended", Start: now.Add(-time.Hour), Duration: 60, Priority: 3}
+
+	for _, event := range []demandresponse.Event{low, high, ended} {
+		require.NoError(t, store.Add(event, now))
+	}
+
+	active, ok := store.Active(now.Add(5 * time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, "low", active.EventID)
+
+	// The higher priority event applies while they overlap.
+	active, ok = store.Active(now.Add(15 * time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, "high", active.EventID)
+
+	_, ok = store.Active(now.Add(2 * time.Hour))
+	assert.False(t, ok)
+
+	// Events survive a restart, apart from those that had ended.
+	reopened, err := demandresponse.OpenStore(path)
+	require.NoError(t, err)
+	active, ok = reopened.Active(now.Add(15 * time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, "high", active.EventID)
+	_, ok = reopened.Active(ended.Start)
+	assert.False(t, ok)
+
+	require.NoError(t, reopened.Add(demandresponse.Event{EventID: "high", Cancel: true}, now))
+	active, ok = reopened.Active(now.Add(15 * time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, "low", active.EventID)
+}
+
+func TestStoreCheckFresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demand-response.json")
+	now := time.Unix(1715320000, 0)
+
+	store, err := demandresponse.OpenStore(path)
+	require.NoError(t, err)
+
+	event := demandresponse.Event{EventID: "dr-1", SiteID: "site-1", IssuedAt: now, Start: now, Duration: 600, TargetPower: -5}
+	require.NoError(t, store.CheckFresh(event, "site-1"))
+	assert.ErrorIs(t, store.CheckFresh(event, "site-2"), demandresponse.ErrWrongSite)
+	require.NoError(t, store.Add(event, now))
+
+	// A cancellation raises the bar too, and the bar survives a restart.
+	cancel := demandresponse.Event{EventID: "dr-1", SiteID: "site-1", IssuedAt: now.Add(time.Minute), Cancel: true}
+	require.NoError(t, store.CheckFresh(cancel, "site-1"))
+	require.NoError(t, store.Add(cancel, now))
+
+	reopened, err := demandresponse.OpenStore(path)
+	require.NoError(t, err)
+	assert.ErrorIs(t, reopened.CheckFresh(event, "site-1"), demandresponse.ErrNotNewer)
+	assert.ErrorIs(t, reopened.CheckFresh(cancel, "site-1"), demandresponse.ErrNotNewer)
+
+	event.IssuedAt = now.Add(2 * time.Minute)
+	assert.NoError(t, reopened.CheckFresh(event, "site-1"))
+}
+
+func TestOpenStore_WhenFileIsCorrupt_StartsEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demand-response.json")
+	require.NoError(t, os.WriteFile(path, []byte("[{"), 0o644))
+
+	store, err := demandresponse.OpenStore(path)
+	assert.Error(t, err)
+	require.NotNil(t, store)
+
+	// New events are still accepted, and replace the corrupt file.
+	now := time.Unix(1715319000, 0)
+	require.NoError(t, store.Add(demandresponse.Event{EventID: "dr-1", Start: now, Duration: 600, TargetPower: -5}, now))
+
+	reopened, err := demandresponse.OpenStore(path)
+	require.NoError(t, err)
+	_, ok := reopened.Active(now)
+	assert.True(t, ok)
+}
+
+func TestOverride(t *testing.T) {
+	event := demandresponse.Event{EventID: "dr-1", Start: time.Unix(1715319000, 0), Duration: 1800, TargetPower: -5}
+
+	interval := plan.OptimisationInterval{
+		Interval: plan.OptimisationIntervalTimestamp{
+			StartTime: plan.OptimisationTimestamp{Seconds: 1715319000},
+			EndTime:   plan.OptimisationTimestamp{Seconds: 1715319300},
+		},
+		MeterPower:   plan.OptimisationValue{Value: 1000, Unit: 1},
+		BatteryPower: plan.OptimisationValue{Value: 2000, Unit: 1},
+	}
+
+	overridden := event.Override(interval)
+	assert.InDelta(t, -5000, overridden.MeterPower.Value, 1e-3)
+	assert.InDelta(t, -4000, overridden.BatteryPower.Value, 1e-3)
+	assert.Equal(t, interval.Interval, overridden.Interval)
+
+	// Without a plan interval, the event's own period is used.
+	synthetic := event.Override(plan.OptimisationInterval{})
+	assert.InDelta(t, -5, synthetic.MeterPower.Kilowatts(), 1e-6)
+	assert.Equal(t, int64(1715320800), synthetic.Interval.EndTime.Seconds)
+}
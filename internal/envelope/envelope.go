@@ -0,0 +1,245 @@
+package envelope
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Where the active limits come from.
+const (
+	SourceStatic  = "static"
+	SourceControl = "control"
+	SourceDefault = "default"
+)
+
+// Limits are the most a site may import from and export to the grid, in kW.
+// An infinite limit is no limit.
+type Limits struct {
+	MaxImport float64
+	MaxExport float64
+}
+
+// NoLimits allows any setpoint.
+var NoLimits = Limits{MaxImport: math.Inf(1), MaxExport: math.Inf(1)}
+
+// NewLimits returns limits in kW, taking a negative limit as no limit.
+func NewLimits(maxImport, maxExport float64) Limits {
+	if maxImport < 0 {
+		maxImport = math.Inf(1)
+	}
+	if maxExport < 0 {
+		maxExport = math.Inf(1)
+	}
+	return Limits{MaxImport: maxImport, MaxExport: maxExport}
+}
+
+// Clamp limits a meter setpoint in kW, positive when importing.
+func (l Limits) Clamp(kw float64) float64 {
+	return math.Max(-l.MaxExport, math.Min(l.MaxImport, kw))
+}
+
+// Within returns the tighter of both sets of limits.
+func (l Limits) Within(other Limits) Limits {
+	return Limits{MaxImport: math.Min(l.MaxImport, other.MaxImport), MaxExport: math.Min(l.MaxExport, other.MaxExport)}
+}
+
+// LogFormat returns the limits as fields for the outage log.
+func (l Limits) LogFormat() map[string]string {
+	return map[string]string{
+		"maxImport": formatLimit(l.MaxImport),
+		"maxExport": formatLimit(l.MaxExport),
+	}
+}
+
+func formatLimit(kw float64) string {
+	if math.IsInf(kw, 1) {
+		return "none"
+	}
+	return fmt.Sprintf("%.3f", kw)
+}
+
+// ActivePower is a power in W times ten to the multiplier, as in IEEE 2030.5.
+type ActivePower struct {
+	Multiplier int   `json:"multiplier"`
+	Value      int64 `json:"value"`
+}
+
+// Kilowatts returns the power in kW.
+func (p ActivePower) Kilowatts() float64 {
+	return float64(p.Value) * math.Pow10(p.Multiplier) / 1000
+}
+
+// DERControlBase holds the import and export limits of a control. A limit
+// that is left out is no limit.
+type DERControlBase struct {
+	OpModImpLimW *ActivePower `json:"opModImpLimW,omitempty"`
+	OpModExpLimW *ActivePower `json:"opModExpLimW,omitempty"`
+}
+
+// Limits returns the control's limits.
+func (b DERControlBase) Limits() Limits {
+	limits := NoLimits
+	if b.OpModImpLimW != nil {
+		limits.MaxImport = b.OpModImpLimW.Kilowatts()
+	}
+	if b.OpModExpLimW != nil {
+		limits.MaxExport = b.OpModExpLimW.Kilowatts()
+	}
+	return limits
+}
+
+// DateTimeInterval is a period starting at a Unix time, lasting a number of seconds.
+type DateTimeInterval struct {
+	Start    int64 `json:"start"`
+	Duration int64 `json:"duration"`
+}
+
+// DERControl is an operating envelope for a validity window.
+type DERControl struct {
+	MRID           string           `json:"mRID"`
+	Interval       DateTimeInterval `json:"interval"`
+	DERControlBase DERControlBase   `json:"DERControlBase"`
+}
+
+func (c DERControl) isActive(at time.Time) bool {
+	start := time.Unix(c.Interval.Start, 0)
+	end := start.Add(time.Duration(c.Interval.Duration) * time.Second)
+	return !at.Before(start) && at.Before(end)
+}
+
+// Payload is an envelope update, modelled on a CSIP-AUS DERControlList with
+// its DefaultDERControl. Each update replaces the controls before it.
+type Payload struct {
+	DERControl        []DERControl    `json:"DERControl"`
+	DefaultDERControl *DERControlBase `json:"DefaultDERControl,omitempty"`
+}
+
+// Parse reads an envelope update.
+func Parse(data []byte) (Payload, error) {
+	var payload Payload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Payload{}, fmt.Errorf("unmarshalling envelope: %w", err)
+	}
+
+	var errs []error
+	for _, control := range payload.DERControl {
+		if control.Interval.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("control %q has no duration", control.MRID))
+		}
+		if limits := control.DERControlBase.Limits(); limits.MaxImport < 0 || limits.MaxExport < 0 {
+			errs = append(errs, fmt.Errorf("control %q has a negative limit", control.MRID))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Payload{}, err
+	}
+
+	return payload, nil
+}
+
+// Tracker keeps the envelope in force. The static limits always apply.
+// Received controls tighten them while they are active, and once envelopes
+// are being received, the default limits tighten them whenever no control is
+// active, such as after the last one expires.
+type Tracker struct {
+	mu       sync.Mutex
+	path     string
+	static   Limits
+	defaults Limits
+
+	received bool
+	payload  Payload
+}
+
+// NewTracker returns a tracker with the given static and default limits,
+// which keeps envelope updates in memory only.
+func NewTracker(static, defaults Limits) *Tracker {
+	return &Tracker{static: static, defaults: defaults}
+}
+
+// OpenTracker returns a tracker with the given static and default limits,
+// which keeps the last envelope update in the file at path, so that it
+// survives a restart. The file need not exist yet. If it cannot be read, the
+// tracker starts without an envelope's controls, but with the default limits
+// as an envelope had been received, and the error is returned with it.
+func OpenTracker(path string, static, defaults Limits) (*Tracker, error) {
+	tracker := &Tracker{path: path, static: static, defaults: defaults}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tracker, nil
+	}
+	tracker.received = true
+	if err != nil {
+		return tracker, fmt.Errorf("reading envelope: %w", err)
+	}
+
+	payload, err := Parse(data)
+	if err != nil {
+		return tracker, fmt.Errorf("reading envelope from %s: %w", path, err)
+	}
+	tracker.payload = payload
+
+	return tracker, nil
+}
+
+// Update replaces the controls with those of an envelope update, and stores
+// it. The update applies even if it cannot be stored.
+func (t *Tracker) Update(payload Payload) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.received = true
+	t.payload = payload
+
+	if t.path == "" {
+		return nil
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshalling envelope: %w", err)
+	}
+	if err := os.WriteFile(t.path+".tmp", encoded, 0o644); err != nil {
+		return fmt.Errorf("storing envelope: %w", err)
+	}
+	if err := os.Rename(t.path+".tmp", t.path); err != nil {
+		return fmt.Errorf("storing envelope: %w", err)
+	}
+
+	return nil
+}
+
+// Limits returns the limits in force at a time, and where they come from.
+// Where controls overlap, the tightest limits of each apply.
+func (t *Tracker) Limits(at time.Time) (Limits, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limits, active := NoLimits, false
+	for _, control := range t.payload.DERControl {
+		if control.isActive(at) {
+			limits = limits.Within(control.DERControlBase.Limits())
+			active = true
+		}
+	}
+	if active {
+		return t.static.Within(limits), SourceControl
+	}
+	if !t.received {
+		return t.static, SourceStatic
+	}
+
+	defaults := t.defaults
+	if t.payload.DefaultDERControl != nil {
+		defaults = t.payload.DefaultDERControl.Limits()
+	}
+
+	return t.static.Within(defaults), SourceDefault
+}
@@ -0,0 +1,110 @@
+package envelope_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEnvelope = `{
+	"DERControl": [
+		{"mRID": "a1", "interval": {"start": 1715319000, "duration": 1800},
+		 "DERControlBase": {"opModImpLimW": {"value": 10000, "multiplier": 0}, "opModExpLimW": {"value": 50, "multiplier": 2}}},
+		{"mRID": "a2", "interval": {"start": 1715319900, "duration": 1800},
+		 "DERControlBase": {"opModExpLimW": {"value": 0, "multiplier": 0}}}
+	],
+	"DefaultDERControl": {"opModExpLimW": {"value": 1500, "multiplier": 0}}
+}`
+
+func TestParse(t *testing.T) {
+	payload, err := envelope.Parse([]byte(testEnvelope))
+	require.NoError(t, err)
+
+	require.Len(t, payload.DERControl, 2)
+	assert.Equal(t, envelope.Limits{MaxImport: 10, MaxExport: 5}, payload.DERControl[0].DERControlBase.Limits())
+	assert.True(t, math.IsInf(payload.DERControl[1].DERControlBase.Limits().MaxImport, 1))
+
+	_, err = envelope.Parse([]byte(`{"DERControl": [{"mRID": "a3", "interval": {"start": 1715319000}}]}`))
+	assert.Error(t, err)
+
+	_, err = envelope.Parse([]byte(`{"DERControl": [{"mRID": "a4", "interval": {"start": 1715319000, "duration": 60},
+		"DERControlBase": {"opModImpLimW": {"value": -1, "multiplier": 0}}}]}`))
+	assert.Error(t, err)
+}
+
+func TestTracker(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+	tracker := envelope.NewTracker(envelope.NewLimits(8, -1), envelope.NewLimits(-1, 1))
+
+	// Only the static limits apply until an envelope is received.
+	limits, source := tracker.Limits(start)
+	assert.Equal(t, envelope.SourceStatic, source)
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: math.Inf(1)}, limits)
+
+	payload, err := envelope.Parse([]byte(testEnvelope))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Update(payload))
+
+	limits, source = tracker.Limits(start)
+	assert.Equal(t, envelope.SourceControl, source)
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 5}, limits)
+
+	// Overlapping controls give the tightest limits.
+	limits, _ = tracker.Limits(start.Add(20 * time.Minute))
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 0}, limits)
+
+	// Once the controls expire, the envelope's default applies.
+	limits, source = tracker.Limits(start.Add(time.Hour))
+	assert.Equal(t, envelope.SourceDefault, source)
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 1.5}, limits)
+
+	// Or the configured default if it has none.
+	payload.DefaultDERControl = nil
+	require.NoError(t, tracker.Update(payload))
+	limits, _ = tracker.Limits(start.Add(time.Hour))
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 1}, limits)
+}
+
+func TestOpenTracker_RestoresLastEnvelope(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+	path := filepath.Join(t.TempDir(), "envelope.json")
+	static, defaults := envelope.NewLimits(8, -1), envelope.NewLimits(-1, 1)
+
+	tracker, err := envelope.OpenTracker(path, static, defaults)
+	require.NoError(t, err)
+
+	payload, err := envelope.Parse([]byte(testEnvelope))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Update(payload))
+
+	// After a restart the control is still in force.
+	tracker, err = envelope.OpenTracker(path, static, defaults)
+	require.NoError(t, err)
+	limits, source := tracker.Limits(start)
+	assert.Equal(t, envelope.SourceControl, source)
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 5}, limits)
+
+	// A corrupt file leaves the defaults in force, rather than no limits.
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+	tracker, err = envelope.OpenTracker(path, static, defaults)
+	assert.Error(t, err)
+	require.NotNil(t, tracker)
+	limits, source = tracker.Limits(start)
+	assert.Equal(t, envelope.SourceDefault, source)
+	assert.Equal(t, envelope.Limits{MaxImport: 8, MaxExport: 1}, limits)
+}
+
+func TestLimitsClamp(t *testing.T) {
+	limits := envelope.NewLimits(5, 0)
+
+	assert.InDelta(t, 5, limits.Clamp(7), 1e-9)
+	assert.InDelta(t, 0, limits.Clamp(-3), 1e-9)
+	assert.InDelta(t, 2, limits.Clamp(2), 1e-9)
+	assert.InDelta(t, -100, envelope.NoLimits.Clamp(-100), 1e-9)
+}
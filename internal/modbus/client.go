@@ -0,0 +1,252 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	FuncReadHoldingRegisters   byte = 0x03
+	FuncWriteSingleRegister    byte = 0x06
+	FuncWriteMultipleRegisters byte = 0x10
+
+	mbapHeaderLength = 7
+	exceptionFlag    = 0x80
+	// maxReadRegisters and maxWriteRegisters are the most registers a single request may carry.
+	maxReadRegisters  = 125
+	maxWriteRegisters = 123
+)
+
+var (
+	ErrInvalidResponse    = errors.New("invalid modbus response")
+	ErrVerificationFailed = errors.New("value read back does not match the value written")
+)
+
+// ExceptionError is returned when the device answers a request with a Modbus exception.
+type ExceptionError struct {
+	Function byte
+	Code     byte
+}
+
+func (e ExceptionError) Error() string {
+	return fmt.Sprintf("modbus exception %d for function 0x%02x", e.Code, e.Function)
+}
+
+// Client is a Modbus TCP client. It connects on first use, and reconnects on
+// the next request after any failure, so that a device restart does not need
+// the client to be recreated.
+type Client struct {
+	mu            *sync.Mutex
+	address       string
+	timeout       time.Duration
+	conn          net.Conn
+	transactionID uint16
+}
+
+func NewClient(address string, timeout time.Duration) *Client {
+	return &Client{mu: new(sync.Mutex), address: address, timeout: timeout}
+}
+
+func (c *Client) Address() string {
+	return c.address
+}
+
+// WriteRegisters writes values to consecutive holding registers starting at address.
+func (c *Client) WriteRegisters(unitID uint8, address uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > maxWriteRegisters {
+		return fmt.Errorf("writing %d registers: must write between 1 and %d", len(values), maxWriteRegisters)
+	}
+
+	pdu := make([]byte, 6, 6+2*len(values))
+	pdu[0] = FuncWriteMultipleRegisters
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], uint16(len(values)))
+	pdu[5] = byte(2 * len(values))
+
+	for _, value := range values {
+		pdu = binary.BigEndian.AppendUint16(pdu, value)
+	}
+
+	resp, err := c.request(unitID, pdu)
+	if err != nil {
+		return fmt.Errorf("writing registers at %d: %w", address, err)
+	}
+	if len(resp) != 5 || binary.BigEndian.Uint16(resp[1:]) != address || binary.BigEndian.Uint16(resp[3:]) != uint16(len(values)) {
+		return fmt.Errorf("writing registers at %d: %w", address, ErrInvalidResponse)
+	}
+
+	return nil
+}
+
+// ReadHoldingRegisters reads quantity consecutive holding registers starting at address.
+func (c *Client) ReadHoldingRegisters(unitID uint8, address, quantity uint16) ([]uint16, error) {
+	if quantity == 0 || quantity > maxReadRegisters {
+		return nil, fmt.Errorf("reading %d registers: must read between 1 and %d", quantity, maxReadRegisters)
+	}
+
+	pdu := make([]byte, 5)
+	pdu[0] = FuncReadHoldingRegisters
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], quantity)
+
+	resp, err := c.request(unitID, pdu)
+	if err != nil {
+		return nil, fmt.Errorf("reading registers at %d: %w", address, err)
+	}
+	if len(resp) < 2 || int(resp[1]) != 2*int(quantity) || len(resp) != 2+int(resp[1]) {
+		return nil, fmt.Errorf("reading registers at %d: %w", address, ErrInvalidResponse)
+	}
+
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(resp[2+2*i:])
+	}
+
+	return values, nil
+}
+
+// WriteValue encodes value as described by register and writes it to the device.
+func (c *Client) WriteValue(register Register, value float64) error {
+	registers, err := register.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encoding value for register %d: %w", register.Address, err)
+	}
+
+	return c.WriteRegisters(register.UnitID, register.Address, registers)
+}
+
+// ReadValue reads and decodes the value held in register.
+func (c *Client) ReadValue(register Register) (float64, error) {
+	registers, err := c.ReadHoldingRegisters(register.UnitID, register.Address, register.Count())
+	if err != nil {
+		return 0, err
+	}
+
+	return register.Decode(registers)
+}
+
+// WriteVerified writes value to register and reads it back, returning an
+// error wrapping ErrVerificationFailed if the device holds something else,
+// for example because it clamped the value or rejected the write silently.
+func (c *Client) WriteVerified(register Register, value float64) error {
+	written, err := register.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encoding value for register %d: %w", register.Address, err)
+	}
+
+	if err := c.WriteRegisters(register.UnitID, register.Address, written); err != nil {
+		return err
+	}
+
+	read, err := c.ReadHoldingRegisters(register.UnitID, register.Address, register.Count())
+	if err != nil {
+		return fmt.Errorf("verifying register %d: %w", register.Address, err)
+	}
+
+	for i := range written {
+		if read[i] != written[i] {
+			readValue, _ := register.Decode(read)
+			return fmt.Errorf("%w: wrote %v to register %d, read %v", ErrVerificationFailed, value, register.Address, readValue)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.disconnect()
+}
+
+func (c *Client) disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+
+	return err
+}
+
+// request sends pdu to the unit and returns the PDU of its response.
+func (c *Client) request(unitID uint8, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, err := c.exchange(unitID, pdu)
+	if err != nil {
+		// the stream may be out of step, so start afresh next time
+		_ = c.disconnect()
+		return nil, err
+	}
+
+	if resp[0] == pdu[0]|exceptionFlag {
+		if len(resp) < 2 {
+			return nil, ErrInvalidResponse
+		}
+		return nil, ExceptionError{Function: pdu[0], Code: resp[1]}
+	}
+	if resp[0] != pdu[0] {
+		return nil, fmt.Errorf("%w: function 0x%02x in reply to 0x%02x", ErrInvalidResponse, resp[0], pdu[0])
+	}
+
+	return resp, nil
+}
+
+func (c *Client) exchange(unitID uint8, pdu []byte) ([]byte, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %s: %w", c.address, err)
+		}
+		c.conn = conn
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	c.transactionID++
+
+	frame := make([]byte, mbapHeaderLength, mbapHeaderLength+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], c.transactionID)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unitID
+	frame = append(frame, pdu...)
+
+	if _, err := c.conn.Write(frame); err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+
+	header := make([]byte, mbapHeaderLength)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, fmt.Errorf("reading response header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint16(header[4:])
+	switch {
+	case binary.BigEndian.Uint16(header[0:]) != c.transactionID:
+		return nil, fmt.Errorf("%w: transaction id mismatch", ErrInvalidResponse)
+	case binary.BigEndian.Uint16(header[2:]) != 0:
+		return nil, fmt.Errorf("%w: unknown protocol id", ErrInvalidResponse)
+	case length < 2 || length > 254:
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidResponse, length)
+	case header[6] != unitID:
+		return nil, fmt.Errorf("%w: reply from unit %d", ErrInvalidResponse, header[6])
+	}
+
+	resp := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	return resp, nil
+}
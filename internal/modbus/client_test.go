@@ -0,0 +1,93 @@
+package modbus_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/modbus"
+	"github.com/EvergenEnergy/remote-standby/internal/modbus/modbustest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startSimulator(t *testing.T) *modbustest.Server {
+	server, err := modbustest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+func TestWritesAndReadsRegisters(t *testing.T) {
+	server := startSimulator(t)
+	client := modbus.NewClient(server.Address(), time.Second)
+	defer client.Close()
+
+	require.NoError(t, client.WriteRegisters(2, 100, []uint16{1, 2, 3}))
+	assert.Equal(t, []uint16{1, 2, 3}, server.Registers(2, 100, 3))
+	assert.Equal(t, []uint16{0, 0, 0}, server.Registers(1, 100, 3))
+
+	values, err := client.ReadHoldingRegisters(2, 101, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{2, 3}, values)
+}
+
+func TestWritesValueWithRegisterMap(t *testing.T) {
+	server := startSimulator(t)
+	client := modbus.NewClient(server.Address(), time.Second)
+	defer client.Close()
+
+	register := modbus.Register{UnitID: 1, Address: 40100, DataType: modbus.Int32, ByteOrder: modbus.WordSwapped, Scale: 1000}
+
+	require.NoError(t, client.WriteVerified(register, -12.5))
+	assert.Equal(t, []uint16{0xcf2c, 0xffff}, server.Registers(1, 40100, 2))
+
+	value, err := client.ReadValue(register)
+	require.NoError(t, err)
+	assert.InDelta(t, -12.5, value, 0.001)
+}
+
+func TestWriteVerifiedDetectsClampedValue(t *testing.T) {
+	server := startSimulator(t)
+	server.SetClamp(func(_ uint8, _, value uint16) uint16 {
+		return min(value, 50)
+	})
+
+	client := modbus.NewClient(server.Address(), time.Second)
+	defer client.Close()
+
+	register := modbus.Register{UnitID: 1, Address: 10, DataType: modbus.Uint16, ByteOrder: modbus.BigEndian, Scale: 1}
+
+	assert.NoError(t, client.WriteVerified(register, 40))
+	assert.ErrorIs(t, client.WriteVerified(register, 80), modbus.ErrVerificationFailed)
+
+	// without verification the clamped write goes unnoticed
+	assert.NoError(t, client.WriteValue(register, 80))
+}
+
+func TestReconnectsAfterConnectionLost(t *testing.T) {
+	server := startSimulator(t)
+	client := modbus.NewClient(server.Address(), time.Second)
+	defer client.Close()
+
+	require.NoError(t, client.WriteRegisters(1, 0, []uint16{1}))
+	server.CloseConnections()
+
+	// the first request notices the dropped connection, the next one reconnects
+	_ = client.WriteRegisters(1, 0, []uint16{2})
+	require.NoError(t, client.WriteRegisters(1, 0, []uint16{3}))
+	assert.Equal(t, []uint16{3}, server.Registers(1, 0, 1))
+}
+
+func TestReturnsExceptions(t *testing.T) {
+	server := startSimulator(t)
+	client := modbus.NewClient(server.Address(), time.Second)
+	defer client.Close()
+
+	_, err := client.ReadHoldingRegisters(1, 0xffff, 2)
+
+	var exception modbus.ExceptionError
+	require.ErrorAs(t, err, &exception)
+	assert.Equal(t, modbus.FuncReadHoldingRegisters, exception.Function)
+	assert.EqualValues(t, 2, exception.Code)
+}
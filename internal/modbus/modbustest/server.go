@@ -0,0 +1,242 @@
+// Package modbustest provides a Modbus TCP device simulator for tests.
+package modbustest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/EvergenEnergy/remote-standby/internal/modbus"
+)
+
+const (
+	exceptionIllegalFunction    = 0x01
+	exceptionIllegalDataAddress = 0x02
+	exceptionIllegalDataValue   = 0x03
+)
+
+// Server simulates the holding registers of a Modbus TCP device, listening
+// on a local port. Each unit ID has its own registers, all starting at zero.
+type Server struct {
+	listener net.Listener
+	wg       *sync.WaitGroup
+
+	mu        *sync.Mutex
+	closed    bool
+	conns     map[net.Conn]struct{}
+	registers map[uint8]map[uint16]uint16
+	// clamp, if set, is applied to every value written, mimicking
+	// a device that limits setpoints without returning an error.
+	clamp func(unitID uint8, address, value uint16) uint16
+}
+
+// NewServer starts a simulator on a random local port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:  listener,
+		wg:        new(sync.WaitGroup),
+		mu:        new(sync.Mutex),
+		conns:     map[net.Conn]struct{}{},
+		registers: map[uint8]map[uint16]uint16{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Address returns the host:port the simulator is listening on.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Registers returns count registers of the unit, starting at address.
+func (s *Server) Registers(unitID uint8, address, count uint16) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([]uint16, count)
+	for i := range values {
+		values[i] = s.registers[unitID][address+uint16(i)]
+	}
+	return values
+}
+
+// SetClamp makes the simulator store clamp's result instead of each value written.
+func (s *Server) SetClamp(clamp func(unitID uint8, address, value uint16) uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clamp = clamp
+}
+
+// CloseConnections drops every open connection, as a device restart would.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the simulator and closes any open connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		length := binary.BigEndian.Uint16(header[4:])
+		if length < 2 {
+			return
+		}
+
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.process(header[6], pdu)
+
+		frame := append([]byte{}, header[:4]...)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(resp)+1))
+		frame = append(frame, header[6])
+		frame = append(frame, resp...)
+
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) process(unitID uint8, pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.registers[unitID] == nil {
+		s.registers[unitID] = map[uint16]uint16{}
+	}
+	registers := s.registers[unitID]
+
+	function := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{function | 0x80, code}
+	}
+
+	switch function {
+	case modbus.FuncReadHoldingRegisters:
+		if len(pdu) != 5 {
+			return exception(exceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(pdu[1:])
+		quantity := binary.BigEndian.Uint16(pdu[3:])
+		if quantity == 0 || quantity > 125 {
+			return exception(exceptionIllegalDataValue)
+		}
+		if int(address)+int(quantity) > 0x10000 {
+			return exception(exceptionIllegalDataAddress)
+		}
+
+		resp := []byte{function, byte(2 * quantity)}
+		for i := range quantity {
+			resp = binary.BigEndian.AppendUint16(resp, registers[address+i])
+		}
+		return resp
+
+	case modbus.FuncWriteSingleRegister:
+		if len(pdu) != 5 {
+			return exception(exceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(pdu[1:])
+		s.store(unitID, address, binary.BigEndian.Uint16(pdu[3:]))
+
+		return pdu
+
+	case modbus.FuncWriteMultipleRegisters:
+		if len(pdu) < 6 {
+			return exception(exceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(pdu[1:])
+		quantity := binary.BigEndian.Uint16(pdu[3:])
+		if quantity == 0 || quantity > 123 || int(pdu[5]) != 2*int(quantity) || len(pdu) != 6+int(pdu[5]) {
+			return exception(exceptionIllegalDataValue)
+		}
+		if int(address)+int(quantity) > 0x10000 {
+			return exception(exceptionIllegalDataAddress)
+		}
+
+		for i := range quantity {
+			s.store(unitID, address+i, binary.BigEndian.Uint16(pdu[6+2*i:]))
+		}
+		return pdu[:5]
+
+	default:
+		return exception(exceptionIllegalFunction)
+	}
+}
+
+// store sets a register, applying the clamp if there is one. s.mu must be held.
+func (s *Server) store(unitID uint8, address, value uint16) {
+	if s.clamp != nil {
+		value = s.clamp(unitID, address, value)
+	}
+	s.registers[unitID][address] = value
+}
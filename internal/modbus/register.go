@@ -0,0 +1,194 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DataType is how a value is represented in one or more 16 bit registers.
+type DataType string
+
+const (
+	Int16   DataType = "int16"
+	Uint16  DataType = "uint16"
+	Int32   DataType = "int32"
+	Uint32  DataType = "uint32"
+	Float32 DataType = "float32"
+)
+
+// ByteOrder is the order of the bytes of a value across its registers, with
+// ABCD being big endian, as the Modbus specification intends. Devices differ,
+// so CDAB (word swapped), BADC (byte swapped) and DCBA (little endian) are
+// supported too. For 16 bit types only the order within a register matters.
+type ByteOrder string
+
+const (
+	BigEndian    ByteOrder = "ABCD"
+	WordSwapped  ByteOrder = "CDAB"
+	ByteSwapped  ByteOrder = "BADC"
+	LittleEndian ByteOrder = "DCBA"
+)
+
+// Register describes where a value lives on a device and how it is encoded.
+// Values are multiplied by Scale when written and divided by it when read, so
+// a register holding tenths of a kW has a scale of 10. A negative scale
+// reverses the sign, for devices with the opposite sign convention.
+type Register struct {
+	UnitID    uint8
+	Address   uint16
+	DataType  DataType
+	ByteOrder ByteOrder
+	Scale     float64
+}
+
+// Validate checks that the data type and byte order are known and the scale is usable.
+func (r Register) Validate() error {
+	switch r.DataType {
+	case Int16, Uint16, Int32, Uint32, Float32:
+	default:
+		return fmt.Errorf("unknown data type %q", r.DataType)
+	}
+
+	switch ByteOrder(strings.ToUpper(string(r.ByteOrder))) {
+	case BigEndian, WordSwapped, ByteSwapped, LittleEndian:
+	default:
+		return fmt.Errorf("unknown byte order %q", r.ByteOrder)
+	}
+
+	if r.Scale == 0 || math.IsNaN(r.Scale) || math.IsInf(r.Scale, 0) {
+		return fmt.Errorf("invalid scale %v", r.Scale)
+	}
+	return nil
+}
+
+// Count returns the number of registers the value occupies.
+func (r Register) Count() uint16 {
+	switch r.DataType {
+	case Int32, Uint32, Float32:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Encode converts value to the registers to write, rounding it to the nearest
+// integer for integer types and failing if it does not fit.
+func (r Register) Encode(value float64) ([]uint16, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	raw := value * r.Scale
+	if r.DataType != Float32 {
+		raw = math.Round(raw)
+	}
+
+	var bits uint32
+
+	switch r.DataType {
+	case Int16:
+		if raw < math.MinInt16 || raw > math.MaxInt16 {
+			return nil, fmt.Errorf("value %v out of range for %s", raw, r.DataType)
+		}
+		bits = uint32(uint16(int16(raw)))
+	case Uint16:
+		if raw < 0 || raw > math.MaxUint16 {
+			return nil, fmt.Errorf("value %v out of range for %s", raw, r.DataType)
+		}
+		bits = uint32(raw)
+	case Int32:
+		if raw < math.MinInt32 || raw > math.MaxInt32 {
+			return nil, fmt.Errorf("value %v out of range for %s", raw, r.DataType)
+		}
+		bits = uint32(int32(raw))
+	case Uint32:
+		if raw < 0 || raw > math.MaxUint32 {
+			return nil, fmt.Errorf("value %v out of range for %s", raw, r.DataType)
+		}
+		bits = uint32(raw)
+	case Float32:
+		if math.Abs(raw) > math.MaxFloat32 {
+			return nil, fmt.Errorf("value %v out of range for %s", raw, r.DataType)
+		}
+		bits = math.Float32bits(float32(raw))
+	}
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, bits)
+	if r.Count() == 1 {
+		buf = buf[2:]
+	}
+
+	return r.toRegisters(buf), nil
+}
+
+// Decode converts registers read from the device back to a value.
+func (r Register) Decode(registers []uint16) (float64, error) {
+	if err := r.Validate(); err != nil {
+		return 0, err
+	}
+	if len(registers) != int(r.Count()) {
+		return 0, fmt.Errorf("decoding %s: got %d registers, want %d", r.DataType, len(registers), r.Count())
+	}
+
+	buf := r.fromRegisters(registers)
+
+	var raw float64
+
+	switch r.DataType {
+	case Int16:
+		raw = float64(int16(binary.BigEndian.Uint16(buf)))
+	case Uint16:
+		raw = float64(binary.BigEndian.Uint16(buf))
+	case Int32:
+		raw = float64(int32(binary.BigEndian.Uint32(buf)))
+	case Uint32:
+		raw = float64(binary.BigEndian.Uint32(buf))
+	case Float32:
+		raw = float64(math.Float32frombits(binary.BigEndian.Uint32(buf)))
+	}
+
+	return raw / r.Scale, nil
+}
+
+// toRegisters lays out big endian bytes in the register's byte order.
+func (r Register) toRegisters(buf []byte) []uint16 {
+	ordered := r.reorder(buf)
+
+	registers := make([]uint16, len(ordered)/2)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(ordered[2*i:])
+	}
+	return registers
+}
+
+// fromRegisters returns the big endian bytes of the value held in registers.
+func (r Register) fromRegisters(registers []uint16) []byte {
+	buf := make([]byte, 0, 2*len(registers))
+	for _, register := range registers {
+		buf = binary.BigEndian.AppendUint16(buf, register)
+	}
+
+	// each of the supported orders is its own inverse
+	return r.reorder(buf)
+}
+
+func (r Register) reorder(buf []byte) []byte {
+	out := append([]byte{}, buf...)
+
+	order := ByteOrder(strings.ToUpper(string(r.ByteOrder)))
+	if order == WordSwapped || order == LittleEndian {
+		for i, j := 0, len(out)-2; i < j; i, j = i+2, j-2 {
+			out[i], out[i+1], out[j], out[j+1] = out[j], out[j+1], out[i], out[i+1]
+		}
+	}
+	if order == ByteSwapped || order == LittleEndian {
+		for i := 0; i+1 < len(out); i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,53 @@
+package modbus_test
+
+import (
+	"testing"
+
+	"github.com/EvergenEnergy/remote-standby/internal/modbus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterEncoding(t *testing.T) {
+	type test struct {
+		register modbus.Register
+		value    float64
+		expected []uint16
+	}
+
+	tests := []test{
+		{register: modbus.Register{DataType: modbus.Int16, ByteOrder: modbus.BigEndian, Scale: 1}, value: -2, expected: []uint16{0xfffe}},
+		{register: modbus.Register{DataType: modbus.Int16, ByteOrder: modbus.LittleEndian, Scale: 1000}, value: 1.5, expected: []uint16{0xdc05}},
+		{register: modbus.Register{DataType: modbus.Uint16, ByteOrder: modbus.BigEndian, Scale: 10}, value: 12.34, expected: []uint16{123}},
+		{register: modbus.Register{DataType: modbus.Int32, ByteOrder: modbus.BigEndian, Scale: 1000}, value: -100, expected: []uint16{0xfffe, 0x7960}},
+		{register: modbus.Register{DataType: modbus.Uint32, ByteOrder: modbus.WordSwapped, Scale: 1}, value: 0x12345678, expected: []uint16{0x5678, 0x1234}},
+		{register: modbus.Register{DataType: modbus.Uint32, ByteOrder: modbus.ByteSwapped, Scale: 1}, value: 0x12345678, expected: []uint16{0x3412, 0x7856}},
+		{register: modbus.Register{DataType: modbus.Uint32, ByteOrder: modbus.LittleEndian, Scale: 1}, value: 0x12345678, expected: []uint16{0x7856, 0x3412}},
+		{register: modbus.Register{DataType: modbus.Float32, ByteOrder: modbus.BigEndian, Scale: 1}, value: 1.5, expected: []uint16{0x3fc0, 0x0000}},
+	}
+
+	for _, tc := range tests {
+		registers, err := tc.register.Encode(tc.value)
+		require.NoError(t, err, tc.register)
+		assert.Equal(t, tc.expected, registers, tc.register)
+
+		decoded, err := tc.register.Decode(registers)
+		require.NoError(t, err)
+		assert.InDelta(t, tc.value, decoded, tc.register.Scale, tc.register)
+	}
+}
+
+func TestRegisterEncodingOutOfRange(t *testing.T) {
+	_, err := modbus.Register{DataType: modbus.Int16, ByteOrder: modbus.BigEndian, Scale: 1000}.Encode(40)
+	assert.Error(t, err)
+
+	_, err = modbus.Register{DataType: modbus.Uint16, ByteOrder: modbus.BigEndian, Scale: 1}.Encode(-1)
+	assert.Error(t, err)
+}
+
+func TestRegisterValidate(t *testing.T) {
+	assert.NoError(t, modbus.Register{DataType: modbus.Float32, ByteOrder: "cdab", Scale: 1}.Validate())
+	assert.Error(t, modbus.Register{DataType: "int64", ByteOrder: modbus.BigEndian, Scale: 1}.Validate())
+	assert.Error(t, modbus.Register{DataType: modbus.Int16, ByteOrder: "AB", Scale: 1}.Validate())
+	assert.Error(t, modbus.Register{DataType: modbus.Int16, ByteOrder: modbus.BigEndian}.Validate())
+}
@@ -7,7 +7,7 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-var onConnect mqtt.OnConnectHandler = func(_ mqtt.Client) {
+var onConnected mqtt.OnConnectHandler = func(_ mqtt.Client) {
 	fmt.Println("Connected")
 }
 
@@ -15,7 +15,9 @@ var onConnectionLost mqtt.ConnectionLostHandler = func(_ mqtt.Client, err error)
 	fmt.Printf("Connect lost: %v", err)
 }
 
-func NewClient(cfg config.Config) mqtt.Client {
+// NewClient creates a client for the configured broker. Any onConnect handlers
+// are run, in order, after every successful connection or reconnection.
+func NewClient(cfg config.Config, onConnect ...mqtt.OnConnectHandler) mqtt.Client {
 	brokerURL := cfg.MQTT.BrokerURL
 
 	mqttOpts := mqtt.NewClientOptions()
@@ -24,7 +26,12 @@ func NewClient(cfg config.Config) mqtt.Client {
 	mqttOpts.SetCleanSession(true)
 	mqttOpts.SetAutoReconnect(true)
 	mqttOpts.SetOrderMatters(true)
-	mqttOpts.SetOnConnectHandler(onConnect)
+	mqttOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		onConnected(client)
+		for _, handler := range onConnect {
+			handler(client)
+		}
+	})
 	mqttOpts.SetConnectionLostHandler(onConnectionLost)
 
 	return mqtt.NewClient(mqttOpts)
@@ -0,0 +1,251 @@
+package outagelog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrChainState is wrapped by the error FileSink.Write returns when the record
+// was written but the chain state could not be stored alongside it.
+var ErrChainState = errors.New("storing outage log chain state")
+
+// chainState is kept in a file alongside the outage log, so that Verify can
+// check a log whose oldest segments have been pruned, and can tell when
+// records have been removed from its end. FirstSeq and FirstPrevHash are
+// those of the oldest record kept after pruning, and LastSeq and LastHash
+// those of the last record written.
+type chainState struct {
+	FirstSeq      uint64 `json:"first_seq,omitempty"`
+	FirstPrevHash string `json:"first_prev_hash,omitempty"`
+	LastSeq       uint64 `json:"last_seq"`
+	LastHash      string `json:"last_hash"`
+}
+
+// chainStatePath returns the path of the chain state of the log at path. It
+// is a hidden file, so that it is not taken for a rotated segment.
+func chainStatePath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".chain")
+}
+
+// readChainState reads the chain state of the log at path, which is empty if
+// none has been stored.
+func readChainState(path string) (chainState, error) {
+	state := chainState{}
+
+	content, err := os.ReadFile(chainStatePath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("reading outage log chain state: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &state); err != nil {
+		return chainState{}, fmt.Errorf("unmarshalling outage log chain state: %w", err)
+	}
+
+	return state, nil
+}
+
+// write stores the chain state of the log at path.
+func (c chainState) write(path string) error {
+	encState, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshalling outage log chain state: %w", err)
+	}
+
+	statePath := chainStatePath(path)
+	if err := os.WriteFile(statePath+".tmp", encState, 0o644); err != nil {
+		return fmt.Errorf("writing outage log chain state: %w", err)
+	}
+	if err := os.Rename(statePath+".tmp", statePath); err != nil {
+		return fmt.Errorf("storing outage log chain state: %w", err)
+	}
+
+	return nil
+}
+
+// canonical returns the encoding of the record that its hash and MAC cover.
+func (r Record) canonical() ([]byte, error) {
+	r.Hash = ""
+	r.MAC = ""
+
+	encRecord, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling record %d: %w", r.Seq, err)
+	}
+	return encRecord, nil
+}
+
+func (r Record) digests(key []byte) (string, string, error) {
+	content, err := r.canonical()
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	if len(key) == 0 {
+		return hash, "", nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+
+	return hash, hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// seal sets the record's hash and, if a key is given, its MAC.
+func (r *Record) seal(key []byte) error {
+	hash, mac, err := r.digests(key)
+	if err != nil {
+		return err
+	}
+
+	r.Hash = hash
+	r.MAC = mac
+
+	return nil
+}
+
+// Issue describes a problem found while verifying the outage log.
+type Issue struct {
+	File    string `json:"file"`
+	Seq     uint64 `json:"seq"`
+	Problem string `json:"problem"`
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: seq %d: %s", i.File, i.Seq, i.Problem)
+}
+
+// VerifyResult summarises the verification of an outage log and its rotated segments.
+// Unchained counts records written before hash chaining was introduced.
+type VerifyResult struct {
+	Records   int     `json:"records"`
+	FirstSeq  uint64  `json:"first_seq"`
+	LastSeq   uint64  `json:"last_seq"`
+	LastHash  string  `json:"last_hash"`
+	Unchained int     `json:"unchained"`
+	Issues    []Issue `json:"issues"`
+}
+
+func (v VerifyResult) Valid() bool {
+	return len(v.Issues) == 0
+}
+
+// Verify checks the hash chain of the outage log at path and its rotated
+// segments. It reports records that have been edited, removed or reordered,
+// lines that cannot be parsed, and, when key is given, records whose MAC
+// does not match. A log that starts part way through the chain is reported as
+// an issue too, unless it starts at the oldest record kept when segments were
+// last pruned, as is a log that ends before the last record written to it.
+func Verify(path string, key []byte) (VerifyResult, error) {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	state, err := readChainState(path)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	result := VerifyResult{Issues: []Issue{}}
+
+	var prev *Record
+
+	for _, segment := range append(segments, path) {
+		err := scanLines(segment, func(line string) error {
+			record, err := ParseLine(line)
+			if err != nil {
+				result.Issues = append(result.Issues, Issue{File: segment, Seq: result.LastSeq, Problem: "unparsable record after this sequence number"})
+				return nil
+			}
+			if record.Seq == 0 {
+				record.Seq = result.LastSeq + 1
+			}
+
+			for _, problem := range checkRecord(prev, record, state, key) {
+				result.Issues = append(result.Issues, Issue{File: segment, Seq: record.Seq, Problem: problem})
+			}
+
+			if result.Records == 0 {
+				result.FirstSeq = record.Seq
+			}
+			if record.Hash == "" {
+				result.Unchained++
+			}
+
+			result.Records++
+			result.LastSeq = record.Seq
+			result.LastHash = record.Hash
+			prev = &record
+
+			return nil
+		})
+		if err != nil && !(segment == path && errors.Is(err, fs.ErrNotExist)) {
+			return result, err
+		}
+	}
+
+	switch {
+	case state.LastSeq > result.LastSeq:
+		result.Issues = append(result.Issues, Issue{File: path, Seq: result.LastSeq,
+			Problem: fmt.Sprintf("log ends before seq %d, the last record written, later records are missing", state.LastSeq)})
+	case state.LastSeq == result.LastSeq && state.LastHash != result.LastHash:
+		result.Issues = append(result.Issues, Issue{File: path, Seq: result.LastSeq,
+			Problem: "hash does not match that of the last record written"})
+	}
+
+	return result, nil
+}
+
+func checkRecord(prev *Record, record Record, state chainState, key []byte) []string {
+	problems := []string{}
+
+	switch {
+	case prev == nil && record.Seq == state.FirstSeq && record.PrevHash == state.FirstPrevHash:
+		// the log starts at the oldest record kept when it was pruned
+	case prev == nil && record.PrevHash != "":
+		problems = append(problems, "log starts part way through the chain, earlier records are missing")
+	case prev == nil:
+	case record.Seq <= prev.Seq:
+		problems = append(problems, fmt.Sprintf("out of order, follows seq %d", prev.Seq))
+	case record.Seq != prev.Seq+1:
+		problems = append(problems, fmt.Sprintf("records %d to %d are missing", prev.Seq+1, record.Seq-1))
+	}
+
+	if prev != nil && prev.Hash != "" && record.PrevHash != prev.Hash {
+		problems = append(problems, "previous hash does not match the preceding record")
+	}
+
+	// records from before chaining carry no hash to check
+	if record.Hash == "" {
+		if prev != nil && prev.Hash != "" {
+			problems = append(problems, "record is not chained")
+		}
+		return problems
+	}
+
+	hash, mac, err := record.digests(key)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if hash != record.Hash {
+		problems = append(problems, "hash does not match the record's content")
+	}
+	if len(key) > 0 && !hmac.Equal([]byte(mac), []byte(record.MAC)) {
+		problems = append(problems, "HMAC does not match the site key")
+	}
+
+	return problems
+}
@@ -0,0 +1,182 @@
+package outagelog_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("site-key")
+
+func writeChainedLog(t *testing.T, key []byte) string {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{})
+	logHandler.EnableHMAC(key)
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventEnteredCommandMode, "command", nil)
+	logHandler.Append(outagelog.EventCommandPublished, "command", map[string]string{"meterPower": "400"})
+	logHandler.Append(outagelog.EventResumedStandbyMode, "standby", nil)
+	logHandler.Close()
+
+	return logPath
+}
+
+func rewriteLines(t *testing.T, logPath string, rewrite func([]string) []string) {
+	lines := rewrite(readLogFile(t, logPath))
+	require.NoError(t, os.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0o644))
+}
+
+func TestVerify_WhenLogIsIntact(t *testing.T) {
+	logPath := writeChainedLog(t, testKey)
+
+	result, err := outagelog.Verify(logPath, testKey)
+	require.NoError(t, err)
+
+	assert.True(t, result.Valid(), result.Issues)
+	assert.Equal(t, 4, result.Records)
+	assert.EqualValues(t, 1, result.FirstSeq)
+	assert.EqualValues(t, 4, result.LastSeq)
+	assert.Zero(t, result.Unchained)
+}
+
+func TestVerify_ContinuesChainAcrossRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{Compress: true})
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	require.NoError(t, logHandler.Rotate())
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+	logHandler.Close()
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+	assert.True(t, result.Valid(), result.Issues)
+	assert.Equal(t, 2, result.Records)
+}
+
+func TestVerify_DetectsEditedRecord(t *testing.T) {
+	logPath := writeChainedLog(t, nil)
+	rewriteLines(t, logPath, func(lines []string) []string {
+		lines[2] = strings.Replace(lines[2], `"meterPower":"400"`, `"meterPower":"900"`, 1)
+		return lines
+	})
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+
+	require.Len(t, result.Issues, 1)
+	assert.EqualValues(t, 3, result.Issues[0].Seq)
+	assert.Contains(t, result.Issues[0].Problem, "hash does not match")
+}
+
+func TestVerify_DetectsRemovedRecord(t *testing.T) {
+	logPath := writeChainedLog(t, nil)
+	rewriteLines(t, logPath, func(lines []string) []string {
+		return append(lines[:1], lines[2:]...)
+	})
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+
+	assert.False(t, result.Valid())
+	assert.Contains(t, result.Issues[0].Problem, "records 2 to 2 are missing")
+}
+
+func TestVerify_DetectsReorderedRecords(t *testing.T) {
+	logPath := writeChainedLog(t, nil)
+	rewriteLines(t, logPath, func(lines []string) []string {
+		lines[1], lines[2] = lines[2], lines[1]
+		return lines
+	})
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+	assert.False(t, result.Valid())
+}
+
+func TestVerify_DetectsTruncatedStart(t *testing.T) {
+	logPath := writeChainedLog(t, nil)
+	rewriteLines(t, logPath, func(lines []string) []string {
+		return lines[2:]
+	})
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+
+	require.NotEmpty(t, result.Issues)
+	assert.Contains(t, result.Issues[0].Problem, "part way through the chain")
+}
+
+func TestVerify_DetectsTruncatedEnd(t *testing.T) {
+	logPath := writeChainedLog(t, nil)
+	rewriteLines(t, logPath, func(lines []string) []string {
+		return lines[:3]
+	})
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+
+	require.Len(t, result.Issues, 1)
+	assert.Contains(t, result.Issues[0].Problem, "log ends before seq 4")
+}
+
+func TestVerify_AcceptsLogAfterPruning(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{MaxBackups: 2})
+
+	for range 4 {
+		logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+		require.NoError(t, logHandler.Rotate())
+		time.Sleep(2 * time.Millisecond)
+	}
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+	logHandler.Close()
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+	assert.True(t, result.Valid(), result.Issues)
+	assert.EqualValues(t, 3, result.FirstSeq)
+
+	// Removing a further segment is still detected.
+	segments := segmentsOf(t, logPath)
+	require.Len(t, segments, 2)
+	require.NoError(t, os.Remove(segments[0]))
+
+	result, err = outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Issues)
+	assert.Contains(t, result.Issues[0].Problem, "part way through the chain")
+}
+
+func TestVerify_DetectsForgedRecordWithWrongKey(t *testing.T) {
+	logPath := writeChainedLog(t, []byte("another-key"))
+
+	result, err := outagelog.Verify(logPath, testKey)
+	require.NoError(t, err)
+
+	assert.Len(t, result.Issues, 4)
+	assert.Contains(t, result.Issues[0].Problem, "HMAC")
+}
+
+func TestVerify_AcceptsMigratedLegacyRecords(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	require.NoError(t, os.WriteFile(logPath, []byte(legacyLog), 0o644))
+
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{})
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Close()
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+
+	assert.True(t, result.Valid(), result.Issues)
+	assert.Equal(t, 4, result.Unchained)
+	assert.EqualValues(t, 5, result.LastSeq)
+}
@@ -0,0 +1,9 @@
+package outagelog
+
+// Replay copies the records held by the fallback into sink, for tests.
+func (r *RecoveringSink) Replay(sink Sink) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.replay(sink)
+}
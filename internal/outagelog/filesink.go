@@ -0,0 +1,119 @@
+package outagelog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrRotation is wrapped by the error FileSink.Write returns when the record
+// was written but the log could not be rotated beforehand.
+var ErrRotation = errors.New("rotating outage log")
+
+// FileSink appends records to a file, which it can rotate.
+type FileSink struct {
+	mu           *sync.Mutex
+	path         string
+	fileHandle   *os.File
+	rotation     RotationConfig
+	segmentSize  int64
+	segmentStart time.Time
+	chain        chainState
+}
+
+// Open opens the outage log file at filePath for appending, creating it if needed.
+func Open(filePath string) (*FileSink, error) {
+	fileHandle, err := openFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileSink{mu: new(sync.Mutex), path: filePath, fileHandle: fileHandle, segmentStart: time.Now()}
+
+	if info, err := fileHandle.Stat(); err == nil {
+		f.segmentSize = info.Size()
+	}
+	if current, _ := ReadRecords(filePath, Filter{}); len(current) > 0 {
+		f.segmentStart = current[0].Timestamp
+	}
+	// An unreadable chain state is replaced as records are written, and
+	// Verify reports it.
+	if chain, err := readChainState(filePath); err == nil {
+		f.chain = chain
+	}
+
+	return f, nil
+}
+
+func openFile(filePath string) (*os.File, error) {
+	fileHandle, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("creating outage log file handle for path %s: %w", filePath, err)
+	}
+	return fileHandle, nil
+}
+
+// isNilFileSink reports whether sink is a FileSink that was never opened,
+// such as the result of a failed Open.
+func isNilFileSink(sink Sink) bool {
+	fileSink, ok := sink.(*FileSink)
+	return ok && fileSink == nil
+}
+
+func (f *FileSink) Path() string {
+	return f.path
+}
+
+func (f *FileSink) Write(record Record, line []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+	if f.needsRotation(record.Timestamp, len(line)) {
+		rotateErr = f.rotate(record.Timestamp)
+	}
+
+	if _, err := f.fileHandle.Write(line); err != nil {
+		return fmt.Errorf("appending to %s: %w", f.path, err)
+	}
+	f.segmentSize += int64(len(line))
+
+	var errs []error
+	if rotateErr != nil {
+		errs = append(errs, fmt.Errorf("record written, but %w: %w", ErrRotation, rotateErr))
+	}
+
+	f.chain.LastSeq = record.Seq
+	f.chain.LastHash = record.Hash
+	if err := f.chain.write(f.path); err != nil {
+		errs = append(errs, fmt.Errorf("record written, but %w: %w", ErrChainState, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// recordWritten reports whether a record was written despite the error
+// FileSink.Write returned.
+func recordWritten(err error) bool {
+	return err == nil || errors.Is(err, ErrRotation) || errors.Is(err, ErrChainState)
+}
+
+// Records reads the records in the file and its rotated segments.
+func (f *FileSink) Records(filter Filter) ([]Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return ReadLog(f.path, filter)
+}
+
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fileHandle.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", f.path, err)
+	}
+	return nil
+}
@@ -1,45 +1,200 @@
 package outagelog
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
+// EventType identifies the kind of event an outage log record describes.
+type EventType string
+
+const (
+	EventServiceStarted       EventType = "service_started"
+	EventServiceStopped       EventType = "service_stopped"
+	EventEnteredCommandMode   EventType = "entered_command_mode"
+	EventResumedStandbyMode   EventType = "resumed_standby_mode"
+	EventNoCommandAvailable   EventType = "no_command_available"
+	EventCommandPublishFailed EventType = "command_publish_failed"
+	EventCommandPublished     EventType = "command_published"
+	EventShadowCommand        EventType = "shadow_command"
+	EventDemandResponse       EventType = "demand_response_received"
+	EventDemandResponseStart  EventType = "demand_response_started"
+	EventDemandResponseEnd    EventType = "demand_response_ended"
+	// EventLegacy is assigned to legacy text records whose message is not recognised.
+	EventLegacy EventType = "legacy"
+)
+
+var eventMessages = map[EventType]string{
+	EventServiceStarted:       "Service started",
+	EventServiceStopped:       "Service stopped",
+	EventEnteredCommandMode:   "Entered command mode",
+	EventResumedStandbyMode:   "Resumed standby mode",
+	EventNoCommandAvailable:   "No command available",
+	EventCommandPublishFailed: "Error publishing command",
+	EventCommandPublished:     "Published command",
+	EventShadowCommand:        "Shadow command",
+	EventDemandResponse:       "Received demand response event",
+	EventDemandResponseStart:  "Demand response event started",
+	EventDemandResponseEnd:    "Demand response event ended",
+}
+
+// Message returns the human readable description of the event.
+func (e EventType) Message() string {
+	if msg, ok := eventMessages[e]; ok {
+		return msg
+	}
+	return string(e)
+}
+
+// Record is a single entry in the outage log, stored as one line of JSON.
+// Sequence numbers increase monotonically across restarts of the service,
+// and each record carries the hash of the one before it, so that edits,
+// removals and reordering can be detected by Verify.
+type Record struct {
+	Seq       uint64            `json:"seq"`
+	Timestamp time.Time         `json:"timestamp"`
+	Event     EventType         `json:"event"`
+	Mode      string            `json:"mode,omitempty"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	PrevHash  string            `json:"prev_hash,omitempty"`
+	Hash      string            `json:"hash,omitempty"`
+	MAC       string            `json:"hmac,omitempty"`
+}
+
 type Handler struct {
-	logger     *slog.Logger
-	fileHandle *os.File
+	logger *slog.Logger
+	sink   Sink
+
+	mu       *sync.Mutex
+	lastSeq  uint64
+	lastHash string
+	macKey   []byte
+	location *time.Location
 }
 
-func NewHandler(fileHandle *os.File, logger *slog.Logger) *Handler {
-	return &Handler{fileHandle: fileHandle, logger: logger}
+// NewHandler creates a handler writing to sink. If the sink can be read back,
+// the sequence numbers and hash chain of the records already in it are
+// continued from the last record that could be read. Without a sink, records
+// are discarded.
+func NewHandler(sink Sink, logger *slog.Logger) *Handler {
+	if sink == nil || isNilFileSink(sink) {
+		logger.Error("no outage log to write to, records will be discarded")
+		sink = NewWriterSink(io.Discard)
+	}
+
+	h := &Handler{sink: sink, logger: logger, mu: new(sync.Mutex), location: time.Local}
+
+	if reader, ok := sink.(RecordReader); ok {
+		records, err := reader.Records(Filter{})
+		switch {
+		case errors.Is(err, ErrSkippedLines):
+			logger.Warn("skipped unparsable lines in existing outage log", "error", err)
+		case err != nil:
+			logger.Error("reading existing outage log", "error", err)
+		}
+		if len(records) > 0 {
+			h.lastSeq = records[len(records)-1].Seq
+			h.lastHash = records[len(records)-1].Hash
+		}
+	}
+
+	return h
 }
 
-func (h *Handler) Append(message string, details map[string]string) {
-	errDetails := []string{}
-	for k, v := range details {
-		errDetails = append(errDetails, fmt.Sprintf("%s=%s", k, v))
+func (h *Handler) Append(event EventType, mode string, fields map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	record := Record{
+		Seq:       h.lastSeq + 1,
+		Timestamp: time.Now().In(h.location),
+		Event:     event,
+		Mode:      mode,
+		Message:   event.Message(),
+		Fields:    fields,
+		PrevHash:  h.lastHash,
+	}
+
+	if err := record.seal(h.macKey); err != nil {
+		h.logger.Error("sealing outage log record", "error", err)
+		return
 	}
 
-	errStr := fmt.Sprintf("%s: %s [%s]\n", time.Now().Format(time.RFC3339), message, strings.Join(errDetails, "+"))
+	line, err := record.encode()
+	if err != nil {
+		h.logger.Error("marshalling outage log record", "error", err)
+		return
+	}
+
+	// The sequence advances even if the write fails, so that a lost
+	// record shows up as a gap in the chain rather than going unnoticed.
+	h.lastSeq = record.Seq
+	h.lastHash = record.Hash
 
-	if _, err := h.fileHandle.Write([]byte(errStr)); err != nil {
+	if err := h.sink.Write(record, line); err != nil {
 		h.logger.Error("appending to outage log", "error", err)
 	}
 }
 
+// SetLocation sets the time zone that record timestamps are written in. It is
+// the local time zone by default.
+func (h *Handler) SetLocation(location *time.Location) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.location = location
+}
+
+// EnableHMAC makes the handler authenticate each record with an HMAC using the site key.
+func (h *Handler) EnableHMAC(key []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.macKey = key
+}
+
+// EnableRotation configures rotation of the log, if the sink supports it.
+func (h *Handler) EnableRotation(rotation RotationConfig) {
+	if rotator, ok := h.sink.(Rotator); ok {
+		rotator.EnableRotation(rotation)
+	}
+}
+
+// Rotate rotates the log, if the sink supports it.
+func (h *Handler) Rotate() error {
+	if rotator, ok := h.sink.(Rotator); ok {
+		return rotator.Rotate()
+	}
+	return nil
+}
+
+// Query returns the records in the log that match the filter, oldest first.
+func (h *Handler) Query(filter Filter) ([]Record, error) {
+	reader, ok := h.sink.(RecordReader)
+	if !ok {
+		return nil, ErrNotReadable
+	}
+
+	return reader.Records(filter)
+}
+
 func (h *Handler) Close() {
-	if err := h.fileHandle.Close(); err != nil {
+	if err := h.sink.Close(); err != nil {
 		h.logger.Error("closing outage log", "error", err)
 	}
 }
 
-func Open(filePath string) (*os.File, error) {
-	fileHandle, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+// encode returns the record as a line of the outage log.
+func (r Record) encode() ([]byte, error) {
+	encRecord, err := json.Marshal(r)
 	if err != nil {
-		return nil, fmt.Errorf("creating outage log file handle for path %s: %w", filePath, err)
+		return nil, fmt.Errorf("marshalling record %d: %w", r.Seq, err)
 	}
-	return fileHandle, nil
+	return append(encRecord, '\n'), nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,9 +37,10 @@ func getTestConfig() config.Config {
 			StandbyTopic:      "cmd/site/standby/serial/plan",
 		},
 		Standby: config.StandbyConfig{
-			CheckInterval:   time.Duration(1 * time.Second),
-			OutageThreshold: time.Duration(2 * time.Second),
-			OutageLogFile:   tmpLogPath,
+			CheckInterval:      time.Duration(1 * time.Second),
+			OutageThreshold:    time.Duration(2 * time.Second),
+			OutageLogFile:      tmpLogPath,
+			AllowUnsignedPlans: true,
 		},
 	}
 }
@@ -52,16 +54,169 @@ func TestWriteOutageLog(t *testing.T) {
 	require.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
 
-	logHandler.Append("test message", nil)
-	logHandler.Append("test message with details", map[string]string{"foo": "baa", "num": "23"})
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventCommandPublished, "command", map[string]string{"foo": "baa", "num": "23"})
 	logHandler.Close()
 
 	logLines := readLogFile(t, logPath)
 
 	assert.Len(t, logLines, 2)
-	assert.Contains(t, logLines[0], "test message")
-	assert.Contains(t, logLines[1], "foo=baa")
-	assert.Contains(t, logLines[1], "num=23")
+	assert.Contains(t, logLines[0], "Service started")
+	assert.Contains(t, logLines[1], `"fields":{"foo":"baa","num":"23"}`)
+
+	record, err := outagelog.ParseLine(logLines[1])
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, record.Seq)
+	assert.Equal(t, outagelog.EventCommandPublished, record.Event)
+	assert.Equal(t, "command", record.Mode)
+	assert.Equal(t, "23", record.Fields["num"])
+}
+
+func TestSequenceContinuesAfterReopening(t *testing.T) {
+	logPath := getTestConfig().Standby.OutageLogFile
+	defer os.Remove(logPath)
+
+	for range 2 {
+		logHandle, err := outagelog.Open(logPath)
+		require.NoError(t, err)
+		logHandler := outagelog.NewHandler(logHandle, testLogger)
+		logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+		logHandler.Close()
+	}
+
+	records, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.EqualValues(t, 1, records[0].Seq)
+	assert.EqualValues(t, 2, records[1].Seq)
+}
+
+func TestSequenceContinuesPastUnparsableLines(t *testing.T) {
+	logPath := getTestConfig().Standby.OutageLogFile
+	defer os.Remove(logPath)
+
+	logHandle, err := outagelog.Open(logPath)
+	require.NoError(t, err)
+	logHandler := outagelog.NewHandler(logHandle, testLogger)
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+	logHandler.Close()
+
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString("{\"seq\": 3, \"timest\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	records, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	assert.ErrorIs(t, err, outagelog.ErrSkippedLines)
+	require.Len(t, records, 2)
+
+	logHandle, err = outagelog.Open(logPath)
+	require.NoError(t, err)
+	logHandler = outagelog.NewHandler(logHandle, testLogger)
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Close()
+
+	records, err = outagelog.ReadLog(logPath, outagelog.Filter{})
+	assert.ErrorIs(t, err, outagelog.ErrSkippedLines)
+	require.Len(t, records, 3)
+	assert.EqualValues(t, 3, records[2].Seq)
+	assert.Equal(t, records[1].Hash, records[2].PrevHash)
+}
+
+func TestHandlerWithoutSinkDiscardsRecords(t *testing.T) {
+	logHandle, err := outagelog.Open(t.TempDir())
+	require.Error(t, err)
+
+	logHandler := outagelog.NewHandler(logHandle, testLogger)
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Close()
+}
+
+func TestQueryFiltersByTimeAndEvent(t *testing.T) {
+	logPath := getTestConfig().Standby.OutageLogFile
+	defer os.Remove(logPath)
+
+	logHandle, err := outagelog.Open(logPath)
+	require.NoError(t, err)
+	logHandler := outagelog.NewHandler(logHandle, testLogger)
+	defer logHandler.Close()
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	logHandler.Append(outagelog.EventEnteredCommandMode, "command", nil)
+	logHandler.Append(outagelog.EventCommandPublished, "command", map[string]string{"meterPower": "400"})
+
+	records, err := logHandler.Query(outagelog.Filter{From: since})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	records, err = logHandler.Query(outagelog.Filter{Events: []outagelog.EventType{outagelog.EventCommandPublished}})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "400", records[0].Fields["meterPower"])
+
+	records, err = logHandler.Query(outagelog.Filter{To: since})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, outagelog.EventServiceStarted, records[0].Event)
+}
+
+const legacyLog = `2024-05-10T05:30:00Z: Service started []
+2024-05-10T05:33:00Z: Entered command mode [timeSinceLastCmd=3m0s]
+2024-05-10T05:34:00Z: Published command [meterPower=400+intervalStart=1715319000]
+2024-05-10T05:35:00Z: Something unexpected []
+`
+
+func TestReadsLegacyRecords(t *testing.T) {
+	logPath := getTestConfig().Standby.OutageLogFile
+	defer os.Remove(logPath)
+	require.NoError(t, os.WriteFile(logPath, []byte(legacyLog), 0o644))
+
+	records, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	assert.Equal(t, outagelog.EventServiceStarted, records[0].Event)
+	assert.Nil(t, records[0].Fields)
+	assert.Equal(t, outagelog.EventCommandPublished, records[2].Event)
+	assert.Equal(t, "400", records[2].Fields["meterPower"])
+	assert.Equal(t, "1715319000", records[2].Fields["intervalStart"])
+	assert.EqualValues(t, 3, records[2].Seq)
+	assert.Equal(t, outagelog.EventLegacy, records[3].Event)
+	assert.Equal(t, "Something unexpected", records[3].Message)
+	assert.Equal(t, time.Date(2024, 5, 10, 5, 35, 0, 0, time.UTC), records[3].Timestamp)
+}
+
+func TestMigratesLegacyLog(t *testing.T) {
+	logPath := getTestConfig().Standby.OutageLogFile
+	defer os.Remove(logPath)
+	require.NoError(t, os.WriteFile(logPath, []byte(legacyLog), 0o644))
+
+	migrated, err := outagelog.Migrate(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, 4, migrated)
+
+	logHandle, err := outagelog.Open(logPath)
+	require.NoError(t, err)
+	logHandler := outagelog.NewHandler(logHandle, testLogger)
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+	logHandler.Close()
+
+	for _, line := range readLogFile(t, logPath) {
+		assert.True(t, strings.HasPrefix(line, "{"), line)
+	}
+
+	records, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	assert.EqualValues(t, 5, records[4].Seq)
+
+	migrated, err = outagelog.Migrate(logPath)
+	require.NoError(t, err)
+	assert.Zero(t, migrated)
 }
 
 func readLogFile(t *testing.T, logPath string) []string {
@@ -88,7 +243,7 @@ func TestWriteLogDuringOutage_Integration(t *testing.T) {
 
 	mqttClient := mqtt.NewClient(cfg)
 	storageSvc := storage.NewService(testLogger)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
 	logHandle, err := outagelog.Open(logPath)
 	require.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
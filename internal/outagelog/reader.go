@@ -0,0 +1,257 @@
+package outagelog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrSkippedLines is wrapped by the error ReadRecords and ReadLog return when
+// lines that could not be parsed were skipped. The records that could be read
+// are returned along with it.
+var ErrSkippedLines = errors.New("skipped unparsable outage log lines")
+
+// Filter selects records from the outage log. Zero values match everything.
+type Filter struct {
+	// From is the inclusive start of the time range.
+	From time.Time
+	// To is the exclusive end of the time range.
+	To     time.Time
+	Events []EventType
+}
+
+func (f Filter) Matches(record Record) bool {
+	if !f.From.IsZero() && record.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.Timestamp.Before(f.To) {
+		return false
+	}
+	if len(f.Events) > 0 && !slices.Contains(f.Events, record.Event) {
+		return false
+	}
+	return true
+}
+
+// ReadRecords reads the records in the outage log file at path that match the
+// filter. Gzip-compressed files are decompressed transparently. Lines written
+// in the legacy text format are converted to records, with sequence numbers
+// assigned in the order they appear. Lines that cannot be parsed are skipped
+// and reported in an error wrapping ErrSkippedLines.
+func ReadRecords(path string, filter Filter) ([]Record, error) {
+	records, _, skipped, err := readFile(path, filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	return records, skippedLinesError(skipped)
+}
+
+// ReadLog reads the records matching the filter from the outage log at path,
+// including any rotated segments, oldest first. Lines that cannot be parsed
+// are skipped, and the records after them are still read.
+func ReadLog(path string, filter Filter) ([]Record, error) {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	var (
+		lastSeq uint64
+		skipped []error
+	)
+
+	for _, segment := range append(segments, path) {
+		var (
+			segmentRecords []Record
+			segmentSkipped []error
+		)
+
+		segmentRecords, lastSeq, segmentSkipped, err = readFile(segment, filter, lastSeq)
+		if err != nil && !(segment == path && errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+		records = append(records, segmentRecords...)
+		skipped = append(skipped, segmentSkipped...)
+	}
+
+	return records, skippedLinesError(skipped)
+}
+
+func skippedLinesError(skipped []error) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrSkippedLines, errors.Join(skipped...))
+}
+
+// readFile reads the records in a single file, returning those matching the
+// filter, the last sequence number read and the lines that were skipped.
+func readFile(path string, filter Filter, lastSeq uint64) ([]Record, uint64, []error, error) {
+	records := []Record{}
+	var skipped []error
+
+	err := scanLines(path, func(line string) error {
+		record, err := ParseLine(line)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("parsing record after seq %d in %s: %w", lastSeq, path, err))
+			return nil
+		}
+		if record.Seq == 0 {
+			record.Seq = lastSeq + 1
+		}
+		lastSeq = record.Seq
+
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, lastSeq, skipped, err
+	}
+
+	return records, lastSeq, skipped, nil
+}
+
+// scanLines calls fn with each non-empty line of the file at path, decompressing it if needed.
+func scanLines(path string, fn func(line string) error) error {
+	fileHandle, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening outage log %s: %w", path, err)
+	}
+	defer fileHandle.Close()
+
+	var reader io.Reader = fileHandle
+	if strings.HasSuffix(path, compressedSuffix) {
+		gzReader, err := gzip.NewReader(fileHandle)
+		if err != nil {
+			return fmt.Errorf("decompressing outage log %s: %w", path, err)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading outage log %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ParseLine parses a single line of the outage log, in either the JSON or legacy text format.
+func ParseLine(line string) (Record, error) {
+	if strings.HasPrefix(line, "{") {
+		record := Record{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return Record{}, fmt.Errorf("unmarshalling record: %w", err)
+		}
+		return record, nil
+	}
+
+	return parseLegacyLine(line)
+}
+
+// parseLegacyLine parses lines of the form `timestamp: message [k=v+k=v]`.
+// Legacy records carry no sequence number or mode.
+func parseLegacyLine(line string) (Record, error) {
+	timestamp, rest, found := strings.Cut(line, ": ")
+	if !found {
+		return Record{}, fmt.Errorf("unrecognised outage log line %q", line)
+	}
+
+	parsedTime, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return Record{}, fmt.Errorf("parsing legacy timestamp: %w", err)
+	}
+
+	record := Record{Timestamp: parsedTime, Message: rest, Event: EventLegacy}
+
+	if idx := strings.LastIndex(rest, " ["); idx >= 0 && strings.HasSuffix(rest, "]") {
+		record.Message = rest[:idx]
+
+		for _, pair := range strings.Split(rest[idx+2:len(rest)-1], "+") {
+			key, value, found := strings.Cut(pair, "=")
+			if !found {
+				continue
+			}
+			if record.Fields == nil {
+				record.Fields = map[string]string{}
+			}
+			record.Fields[key] = value
+		}
+	}
+
+	for event, msg := range eventMessages {
+		if msg == record.Message {
+			record.Event = event
+		}
+	}
+
+	return record, nil
+}
+
+// Migrate rewrites the outage log at path so that every record is in the JSON
+// format, returning the number of legacy records converted. It replaces the
+// file, so it must run before the log is opened for appending.
+func Migrate(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("reading outage log %s: %w", path, err)
+	}
+
+	legacy := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" && !strings.HasPrefix(line, "{") {
+			legacy++
+		}
+	}
+	if legacy == 0 {
+		return 0, nil
+	}
+
+	// Lines that cannot be parsed would be lost by rewriting the file, so
+	// the log is left as it is if there are any.
+	records, err := ReadRecords(path, Filter{})
+	if err != nil {
+		return 0, err
+	}
+
+	var builder strings.Builder
+	for _, record := range records {
+		encRecord, err := json.Marshal(record)
+		if err != nil {
+			return 0, fmt.Errorf("marshalling record %d: %w", record.Seq, err)
+		}
+		builder.Write(encRecord)
+		builder.WriteByte('\n')
+	}
+
+	tmpPath := path + ".migrate"
+	if err := os.WriteFile(tmpPath, []byte(builder.String()), 0o644); err != nil {
+		return 0, fmt.Errorf("writing migrated outage log: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("replacing outage log with migrated copy: %w", err)
+	}
+
+	return legacy, nil
+}
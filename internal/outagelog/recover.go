@@ -0,0 +1,250 @@
+package outagelog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RecoveringSink writes to the outage log file while it is available and to a
+// fallback sink while it cannot be opened or written. The file is retried at
+// most once per retry interval, and on recovery the records held by the
+// fallback are copied into it so that the log stays complete.
+type RecoveringSink struct {
+	mu            *sync.Mutex
+	path          string
+	retryInterval time.Duration
+	fallback      Sink
+	rotation      RotationConfig
+	file          *FileSink
+	lastAttempt   time.Time
+	degraded      error
+	degradedSince time.Time
+	replayedSeq   uint64
+	onStateChange func(err error)
+}
+
+// OpenWithFallback opens the outage log at path, using fallback until the file becomes writable.
+func OpenWithFallback(path string, fallback Sink, retryInterval time.Duration) *RecoveringSink {
+	r := &RecoveringSink{
+		mu:            new(sync.Mutex),
+		path:          path,
+		retryInterval: retryInterval,
+		fallback:      fallback,
+	}
+
+	r.mu.Lock()
+	r.tryOpen(time.Now())
+	r.mu.Unlock()
+
+	return r
+}
+
+// Degraded returns the reason the file is unavailable, or nil if it is being written.
+func (r *RecoveringSink) Degraded() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.degraded
+}
+
+// OnStateChange registers fn to be called with the cause when the sink falls
+// back, and with nil once the file has recovered. If the sink is already
+// degraded, fn is called straight away.
+func (r *RecoveringSink) OnStateChange(fn func(err error)) {
+	r.mu.Lock()
+	r.onStateChange = fn
+	degraded := r.degraded
+	r.mu.Unlock()
+
+	if degraded != nil {
+		fn(degraded)
+	}
+}
+
+// Retry attempts to reopen the file straight away if the sink is degraded,
+// returning the reason it is still unavailable, if any.
+func (r *RecoveringSink) Retry() error {
+	r.mu.Lock()
+
+	changed := false
+	if r.file == nil {
+		changed = r.tryOpen(time.Now())
+	}
+
+	degraded, notify := r.degraded, r.onStateChange
+	r.mu.Unlock()
+
+	if changed && notify != nil {
+		notify(degraded)
+	}
+
+	return degraded
+}
+
+// degrade records that the file is unavailable, reporting whether it was available until now.
+func (r *RecoveringSink) degrade(err error, now time.Time) bool {
+	changed := r.degraded == nil
+	if changed {
+		r.degradedSince = now
+	}
+	r.degraded = err
+
+	return changed
+}
+
+// tryOpen attempts to open the file, replaying any records written to the
+// fallback meanwhile. It reports whether the sink's state changed.
+func (r *RecoveringSink) tryOpen(now time.Time) bool {
+	r.lastAttempt = now
+
+	file, err := Open(r.path)
+	if err != nil {
+		return r.degrade(err, now)
+	}
+
+	file.EnableRotation(r.rotation)
+	if err := r.replay(file); err != nil {
+		file.Close()
+		r.degraded = err
+		return false
+	}
+
+	r.file = file
+	changed := r.degraded != nil
+	r.degraded = nil
+
+	return changed
+}
+
+// replay copies the records written to the fallback while degraded into
+// file. Records copied by an earlier attempt that failed partway are already
+// in the file and are skipped.
+func (r *RecoveringSink) replay(file Sink) error {
+	reader, ok := r.fallback.(RecordReader)
+	if !ok {
+		return nil
+	}
+
+	buffered, err := reader.Records(Filter{From: r.degradedSince})
+	if err != nil {
+		return fmt.Errorf("reading buffered outage log records: %w", err)
+	}
+
+	for _, record := range buffered {
+		if record.Seq <= r.replayedSeq {
+			continue
+		}
+
+		line, err := record.encode()
+		if err != nil {
+			return err
+		}
+		if err := file.Write(record, line); !recordWritten(err) {
+			return fmt.Errorf("replaying buffered outage log records: %w", err)
+		}
+		r.replayedSeq = record.Seq
+	}
+
+	return nil
+}
+
+func (r *RecoveringSink) Write(record Record, line []byte) error {
+	r.mu.Lock()
+
+	changed := false
+	if r.file == nil && record.Timestamp.Sub(r.lastAttempt) >= r.retryInterval {
+		changed = r.tryOpen(record.Timestamp)
+	}
+
+	var err error
+	if r.file != nil {
+		err = r.file.Write(record, line)
+		if !recordWritten(err) {
+			r.file.Close()
+			r.file = nil
+			r.lastAttempt = record.Timestamp
+			changed = r.degrade(err, record.Timestamp)
+		}
+	}
+
+	if r.file == nil {
+		err = r.fallback.Write(record, line)
+	}
+
+	degraded, notify := r.degraded, r.onStateChange
+	r.mu.Unlock()
+
+	if changed && notify != nil {
+		notify(degraded)
+	}
+
+	return err
+}
+
+func (r *RecoveringSink) Records(filter Filter) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil {
+		return r.file.Records(filter)
+	}
+
+	// The file may still be readable even though it cannot be written.
+	records, readErr := ReadLog(r.path, filter)
+
+	// Skipped lines are reported along with the records that were read.
+	var skipped error
+	if errors.Is(readErr, ErrSkippedLines) {
+		skipped, readErr = readErr, nil
+	}
+
+	reader, ok := r.fallback.(RecordReader)
+	if !ok {
+		if readErr != nil {
+			return nil, ErrNotReadable
+		}
+		return records, skipped
+	}
+
+	buffered, err := reader.Records(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(records, buffered...), skipped
+}
+
+func (r *RecoveringSink) EnableRotation(rotation RotationConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rotation = rotation
+	if r.file != nil {
+		r.file.EnableRotation(rotation)
+	}
+}
+
+func (r *RecoveringSink) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Rotate()
+}
+
+func (r *RecoveringSink) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	if r.file != nil {
+		errs = append(errs, r.file.Close())
+	}
+	errs = append(errs, r.fallback.Close())
+
+	return errors.Join(errs...)
+}
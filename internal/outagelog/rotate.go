@@ -0,0 +1,182 @@
+package outagelog
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	rotatedTimeFormat = "20060102T150405.000Z"
+	compressedSuffix  = ".gz"
+)
+
+// RotationConfig controls when the outage log is rotated and how many rotated
+// segments are kept. Zero values disable the corresponding limit.
+type RotationConfig struct {
+	MaxSize    int64
+	MaxAge     time.Duration
+	Compress   bool
+	MaxBackups int
+}
+
+// EnableRotation makes the sink rotate the log before a write would take it
+// past the configured limits.
+func (f *FileSink) EnableRotation(rotation RotationConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotation = rotation
+}
+
+// Rotate moves the current log aside and starts a new one. If the file has
+// already been moved by external tooling, the log is simply reopened.
+func (f *FileSink) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rotate(time.Now())
+}
+
+func (f *FileSink) needsRotation(now time.Time, size int) bool {
+	if f.rotation.MaxSize > 0 && f.segmentSize > 0 && f.segmentSize+int64(size) > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.MaxAge > 0 && f.segmentSize > 0 && now.Sub(f.segmentStart) > f.rotation.MaxAge
+}
+
+func (f *FileSink) rotate(now time.Time) error {
+	movedExternally := false
+	if current, err := f.fileHandle.Stat(); err == nil {
+		onDisk, err := os.Stat(f.path)
+		movedExternally = err != nil || !os.SameFile(current, onDisk)
+	}
+
+	var errs []error
+
+	if err := f.fileHandle.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing outage log for rotation: %w", err))
+	}
+
+	if !movedExternally {
+		rotatedPath := fmt.Sprintf("%s.%s", f.path, now.UTC().Format(rotatedTimeFormat))
+		if err := os.Rename(f.path, rotatedPath); err != nil {
+			// keep appending to the current file rather than losing records
+			errs = append(errs, fmt.Errorf("renaming outage log for rotation: %w", err))
+		} else if f.rotation.Compress {
+			errs = append(errs, compressFile(rotatedPath))
+		}
+	}
+
+	fileHandle, err := openFile(f.path)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	f.fileHandle = fileHandle
+	f.segmentSize = 0
+	f.segmentStart = now
+
+	errs = append(errs, f.pruneSegments())
+
+	return errors.Join(errs...)
+}
+
+func (f *FileSink) pruneSegments() error {
+	if f.rotation.MaxBackups <= 0 {
+		return nil
+	}
+
+	segments, err := rotatedSegments(f.path)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) <= f.rotation.MaxBackups {
+		return nil
+	}
+	pruned := segments[:len(segments)-f.rotation.MaxBackups]
+	retained := segments[len(segments)-f.rotation.MaxBackups:]
+
+	// The chain state records where the retained records start before
+	// the older segments are removed, so that Verify can accept a log
+	// that starts there.
+	if first, _ := ReadRecords(retained[0], Filter{}); len(first) > 0 {
+		f.chain.FirstSeq = first[0].Seq
+		f.chain.FirstPrevHash = first[0].PrevHash
+		if err := f.chain.write(f.path); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, segment := range pruned {
+		if err := os.Remove(segment); err != nil {
+			errs = append(errs, fmt.Errorf("removing rotated outage log: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rotatedSegments returns the paths of the rotated segments of the log at path, oldest first.
+func rotatedSegments(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("listing rotated outage logs: %w", err)
+	}
+
+	segments := []string{}
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), compressedSuffix)
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			segments = append(segments, match)
+		}
+	}
+
+	// the timestamp format sorts lexically, regardless of compression
+	sort.Slice(segments, func(i, j int) bool {
+		return strings.TrimSuffix(segments[i], compressedSuffix) < strings.TrimSuffix(segments[j], compressedSuffix)
+	})
+
+	return segments, nil
+}
+
+// compressFile replaces the file at path with a gzip-compressed copy.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer src.Close()
+
+	dstPath := path + compressedSuffix
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", dstPath, err)
+	}
+
+	gzWriter := gzip.NewWriter(dst)
+	_, err = io.Copy(gzWriter, src)
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dstPath)
+		return fmt.Errorf("compressing %s: %w", path, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing uncompressed %s: %w", path, err)
+	}
+	return nil
+}
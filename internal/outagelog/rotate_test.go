@@ -0,0 +1,123 @@
+package outagelog_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestHandler(t *testing.T, logPath string, rotation outagelog.RotationConfig) *outagelog.Handler {
+	logHandle, err := outagelog.Open(logPath)
+	require.NoError(t, err)
+
+	logHandler := outagelog.NewHandler(logHandle, testLogger)
+	logHandler.EnableRotation(rotation)
+
+	return logHandler
+}
+
+func segmentsOf(t *testing.T, logPath string) []string {
+	matches, err := filepath.Glob(logPath + ".*")
+	require.NoError(t, err)
+	return matches
+}
+
+func TestRotatesWhenMaxSizeExceeded(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{MaxSize: 700})
+
+	for range 6 {
+		logHandler.Append(outagelog.EventCommandPublished, "command", map[string]string{"meterPower": "400"})
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	records, err := logHandler.Query(outagelog.Filter{})
+	require.NoError(t, err)
+	logHandler.Close()
+
+	assert.NotEmpty(t, segmentsOf(t, logPath))
+	require.Len(t, records, 6)
+	for i, record := range records {
+		assert.EqualValues(t, i+1, record.Seq)
+	}
+
+	info, err := os.Stat(logPath)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(700))
+}
+
+func TestRotatesWhenMaxAgeExceeded(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{MaxAge: 50 * time.Millisecond})
+	defer logHandler.Close()
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventEnteredCommandMode, "command", nil)
+	assert.Empty(t, segmentsOf(t, logPath))
+
+	time.Sleep(60 * time.Millisecond)
+	logHandler.Append(outagelog.EventResumedStandbyMode, "standby", nil)
+	assert.Len(t, segmentsOf(t, logPath), 1)
+}
+
+func TestCompressesAndPrunesRotatedSegments(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{Compress: true, MaxBackups: 2})
+
+	for range 4 {
+		logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+		require.NoError(t, logHandler.Rotate())
+		time.Sleep(2 * time.Millisecond)
+	}
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+
+	segments := segmentsOf(t, logPath)
+	require.Len(t, segments, 2)
+	for _, segment := range segments {
+		assert.True(t, strings.HasSuffix(segment, ".gz"), segment)
+	}
+
+	records, err := outagelog.ReadLog(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.EqualValues(t, 5, records[2].Seq)
+	logHandler.Close()
+
+	// sequence numbers continue from the rotated segments after a restart
+	reopened := openTestHandler(t, logPath, outagelog.RotationConfig{})
+	require.NoError(t, reopened.Rotate())
+	reopened.Append(outagelog.EventServiceStarted, "standby", nil)
+	reopened.Close()
+
+	records, err = outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.EqualValues(t, 6, records[0].Seq)
+}
+
+func TestReopensWhenMovedExternally(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "outage.log")
+	logHandler := openTestHandler(t, logPath, outagelog.RotationConfig{})
+	defer logHandler.Close()
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	require.NoError(t, os.Rename(logPath, logPath+".1"))
+
+	require.NoError(t, logHandler.Rotate())
+	logHandler.Append(outagelog.EventServiceStopped, "standby", nil)
+
+	moved, err := outagelog.ReadRecords(logPath+".1", outagelog.Filter{})
+	require.NoError(t, err)
+	assert.Len(t, moved, 1)
+
+	current, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.Equal(t, outagelog.EventServiceStopped, current[0].Event)
+}
@@ -0,0 +1,159 @@
+package outagelog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var ErrNotReadable = errors.New("outage log sink cannot be read back")
+
+// Sink is a destination for outage log records. Write receives both the
+// record and its encoded line, so sinks can store whichever suits them.
+type Sink interface {
+	Write(record Record, line []byte) error
+	Close() error
+}
+
+// RecordReader is implemented by sinks that can return the records written to them.
+type RecordReader interface {
+	Records(filter Filter) ([]Record, error)
+}
+
+// Rotator is implemented by sinks that support rotation.
+type Rotator interface {
+	EnableRotation(rotation RotationConfig)
+	Rotate() error
+}
+
+// WriterSink writes encoded records to an io.Writer, such as os.Stderr.
+type WriterSink struct {
+	mu     *sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{mu: new(sync.Mutex), writer: writer}
+}
+
+func (w *WriterSink) Write(_ Record, line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.writer.Write(line); err != nil {
+		return fmt.Errorf("writing outage log record: %w", err)
+	}
+	return nil
+}
+
+func (w *WriterSink) Close() error {
+	return nil
+}
+
+// RingSink keeps the most recent records in memory, up to its capacity.
+type RingSink struct {
+	mu       *sync.Mutex
+	records  []Record
+	next     int
+	full     bool
+	capacity int
+}
+
+func NewRingSink(capacity int) *RingSink {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RingSink{mu: new(sync.Mutex), records: make([]Record, capacity), capacity: capacity}
+}
+
+func (r *RingSink) Write(record Record, _ []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[r.next] = record
+	r.next = (r.next + 1) % r.capacity
+	if r.next == 0 {
+		r.full = true
+	}
+
+	return nil
+}
+
+func (r *RingSink) Records(filter Filter) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ordered := r.records[:r.next]
+	if r.full {
+		ordered = append(append([]Record{}, r.records[r.next:]...), r.records[:r.next]...)
+	}
+
+	records := []Record{}
+	for _, record := range ordered {
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (r *RingSink) Close() error {
+	return nil
+}
+
+// MultiSink writes each record to all of its sinks. Reads and rotation are
+// delegated to the first sink that supports them.
+type MultiSink struct {
+	sinks []Sink
+}
+
+func NewMultiSink(sinks ...Sink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (m *MultiSink) Write(record Record, line []byte) error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if err := sink.Write(record, line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiSink) Records(filter Filter) ([]Record, error) {
+	for _, sink := range m.sinks {
+		if reader, ok := sink.(RecordReader); ok {
+			return reader.Records(filter)
+		}
+	}
+	return nil, ErrNotReadable
+}
+
+func (m *MultiSink) EnableRotation(rotation RotationConfig) {
+	for _, sink := range m.sinks {
+		if rotator, ok := sink.(Rotator); ok {
+			rotator.EnableRotation(rotation)
+		}
+	}
+}
+
+func (m *MultiSink) Rotate() error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if rotator, ok := sink.(Rotator); ok {
+			errs = append(errs, rotator.Rotate())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
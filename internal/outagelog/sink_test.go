@@ -0,0 +1,151 @@
+package outagelog_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingSinkKeepsMostRecentRecords(t *testing.T) {
+	ring := outagelog.NewRingSink(3)
+	logHandler := outagelog.NewHandler(ring, testLogger)
+
+	for range 5 {
+		logHandler.Append(outagelog.EventCommandPublished, "command", nil)
+	}
+
+	records, err := logHandler.Query(outagelog.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, record := range records {
+		assert.EqualValues(t, i+3, record.Seq)
+	}
+}
+
+func TestMultiSinkWritesToAllSinks(t *testing.T) {
+	var buf bytes.Buffer
+
+	ring := outagelog.NewRingSink(10)
+	logHandler := outagelog.NewHandler(outagelog.NewMultiSink(outagelog.NewWriterSink(&buf), ring), testLogger)
+
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventEnteredCommandMode, "command", nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	record, err := outagelog.ParseLine(lines[1])
+	require.NoError(t, err)
+	assert.Equal(t, outagelog.EventEnteredCommandMode, record.Event)
+
+	records, err := logHandler.Query(outagelog.Filter{})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestWriterSinkCannotBeQueried(t *testing.T) {
+	logHandler := outagelog.NewHandler(outagelog.NewWriterSink(&bytes.Buffer{}), testLogger)
+
+	_, err := logHandler.Query(outagelog.Filter{})
+	assert.ErrorIs(t, err, outagelog.ErrNotReadable)
+}
+
+func TestRecoveringSinkFallsBackAndReplays(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "missing")
+	logPath := filepath.Join(logDir, "outage.log")
+
+	sink := outagelog.OpenWithFallback(logPath, outagelog.NewRingSink(10), 0)
+	require.Error(t, sink.Degraded())
+
+	var states []error
+	sink.OnStateChange(func(err error) { states = append(states, err) })
+	require.Len(t, states, 1)
+	assert.Error(t, states[0])
+
+	logHandler := outagelog.NewHandler(sink, testLogger)
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	logHandler.Append(outagelog.EventEnteredCommandMode, "command", nil)
+
+	records, err := logHandler.Query(outagelog.Filter{})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	require.NoError(t, os.Mkdir(logDir, 0o755))
+	logHandler.Append(outagelog.EventResumedStandbyMode, "standby", nil)
+	logHandler.Close()
+
+	require.NoError(t, sink.Degraded())
+	require.Len(t, states, 2)
+	assert.NoError(t, states[1])
+
+	result, err := outagelog.Verify(logPath, nil)
+	require.NoError(t, err)
+	assert.True(t, result.Valid(), result.Issues)
+	assert.Equal(t, 3, result.Records)
+}
+
+// failingSink records the sequence numbers written to it, failing once it
+// holds limit records.
+type failingSink struct {
+	limit int
+	seqs  []uint64
+}
+
+func (f *failingSink) Write(record outagelog.Record, _ []byte) error {
+	if f.limit > 0 && len(f.seqs) >= f.limit {
+		return errors.New("disk full")
+	}
+	f.seqs = append(f.seqs, record.Seq)
+	return nil
+}
+
+func (f *failingSink) Close() error {
+	return nil
+}
+
+func TestRecoveringSinkRetriesPartialReplayWithoutDuplicates(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "missing", "outage.log")
+
+	sink := outagelog.OpenWithFallback(logPath, outagelog.NewRingSink(10), time.Hour)
+	logHandler := outagelog.NewHandler(sink, testLogger)
+	defer logHandler.Close()
+
+	for range 3 {
+		logHandler.Append(outagelog.EventCommandPublished, "command", nil)
+	}
+
+	partial := &failingSink{limit: 2}
+	require.Error(t, sink.Replay(partial))
+	assert.Equal(t, []uint64{1, 2}, partial.seqs)
+
+	retried := &failingSink{}
+	require.NoError(t, sink.Replay(retried))
+	assert.Equal(t, []uint64{3}, retried.seqs)
+}
+
+func TestRecoveringSinkWaitsForRetryInterval(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "missing")
+	logPath := filepath.Join(logDir, "outage.log")
+
+	sink := outagelog.OpenWithFallback(logPath, outagelog.NewRingSink(10), time.Hour)
+	logHandler := outagelog.NewHandler(sink, testLogger)
+	defer logHandler.Close()
+
+	require.NoError(t, os.Mkdir(logDir, 0o755))
+	logHandler.Append(outagelog.EventServiceStarted, "standby", nil)
+	assert.Error(t, sink.Degraded())
+	assert.NoFileExists(t, logPath)
+
+	require.NoError(t, sink.Retry())
+	records, err := outagelog.ReadRecords(logPath, outagelog.Filter{})
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+}
@@ -0,0 +1,238 @@
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoArchivedPlan = errors.New("no archived plan")
+
+const archiveExt = ".json"
+
+// ArchivedPlan is a plan as it was stored after being accepted, and when.
+type ArchivedPlan struct {
+	Received time.Time        `json:"received"`
+	Plan     OptimisationPlan `json:"plan"`
+}
+
+// Archive keeps every accepted plan in a directory, one file per plan received,
+// named after when it was received, so that the plan the standby was following
+// at any time can be looked up later. Archived plans are never overwritten.
+// Plans received before the retention period are removed as new ones are
+// added.
+type Archive struct {
+	mu        sync.Mutex
+	dir       string
+	retention time.Duration
+}
+
+// OpenArchive opens the archive in dir, creating it if needed. A retention of
+// zero keeps plans forever.
+func OpenArchive(dir string, retention time.Duration) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating plan archive: %w", err)
+	}
+
+	return &Archive{dir: dir, retention: retention}, nil
+}
+
+// Add archives a plan received at the given time, and prunes expired plans.
+// Plans received at the same time are archived under separate names.
+func (a *Archive) Add(optPlan OptimisationPlan, received time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	encoded, err := json.Marshal(ArchivedPlan{Received: received, Plan: optPlan})
+	if err != nil {
+		return fmt.Errorf("marshalling archived plan: %w", err)
+	}
+
+	tmpPath := filepath.Join(a.dir, archiveName(received, 0)+".tmp")
+	if err := os.WriteFile(tmpPath, encoded, 0o644); err != nil {
+		return fmt.Errorf("archiving plan: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	// Link rather than rename, so that an archived plan is never replaced.
+	for seq := 0; ; seq++ {
+		err := os.Link(tmpPath, filepath.Join(a.dir, archiveName(received, seq)))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("archiving plan: %w", err)
+		}
+	}
+
+	return a.prune(received)
+}
+
+// EffectiveAt returns the plan the standby was following at the given time,
+// which is the last plan received by then.
+func (a *Archive) EffectiveAt(at time.Time) (ArchivedPlan, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys, err := a.keys()
+	if err != nil {
+		return ArchivedPlan{}, err
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !keys[i].received.After(at) {
+			return a.read(keys[i])
+		}
+	}
+
+	return ArchivedPlan{}, fmt.Errorf("%w at %s", ErrNoArchivedPlan, at.Format(time.RFC3339))
+}
+
+// List returns the archived plans received between from and to, oldest first.
+func (a *Archive) List(from, to time.Time) ([]ArchivedPlan, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys, err := a.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []ArchivedPlan
+	for _, key := range keys {
+		if key.received.Before(from) || key.received.After(to) {
+			continue
+		}
+
+		archived, err := a.read(key)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, archived)
+	}
+
+	return plans, nil
+}
+
+func (a *Archive) prune(now time.Time) error {
+	if a.retention <= 0 {
+		return nil
+	}
+
+	keys, err := a.keys()
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-a.retention)
+	for _, key := range keys {
+		if !key.received.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(filepath.Join(a.dir, key.name)); err != nil {
+			return fmt.Errorf("pruning plan archive: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type archiveKey struct {
+	name     string
+	received time.Time
+	seq      int
+}
+
+// keys lists the archived plans, in the order they were received.
+func (a *Archive) keys() ([]archiveKey, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading plan archive: %w", err)
+	}
+
+	var keys []archiveKey
+	for _, entry := range entries {
+		received, seq, ok := parseArchiveName(entry.Name())
+		if !ok {
+			continue
+		}
+		keys = append(keys, archiveKey{name: entry.Name(), received: received, seq: seq})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].received.Equal(keys[j].received) {
+			return keys[i].received.Before(keys[j].received)
+		}
+		return keys[i].seq < keys[j].seq
+	})
+
+	return keys, nil
+}
+
+func (a *Archive) read(key archiveKey) (ArchivedPlan, error) {
+	content, err := os.ReadFile(filepath.Join(a.dir, key.name))
+	if err != nil {
+		return ArchivedPlan{}, fmt.Errorf("reading archived plan: %w", err)
+	}
+
+	var archived ArchivedPlan
+	if err := json.Unmarshal(content, &archived); err != nil {
+		return ArchivedPlan{}, fmt.Errorf("unmarshalling archived plan %s: %w", key.name, err)
+	}
+
+	return archived, nil
+}
+
+// archiveName names the archive file of a plan received at the given time,
+// with seq telling apart plans received at the same time.
+func archiveName(received time.Time, seq int) string {
+	name := fmt.Sprintf("plan-%d.%09d", received.Unix(), received.Nanosecond())
+	if seq > 0 {
+		name += "-" + strconv.Itoa(seq)
+	}
+	return name + archiveExt
+}
+
+func parseArchiveName(name string) (time.Time, int, bool) {
+	stamp, found := strings.CutPrefix(name, "plan-")
+	if !found {
+		return time.Time{}, 0, false
+	}
+	stamp, found = strings.CutSuffix(stamp, archiveExt)
+	if !found {
+		return time.Time{}, 0, false
+	}
+
+	seq := 0
+	stamp, seqPart, found := strings.Cut(stamp, "-")
+	if found {
+		var err error
+		if seq, err = strconv.Atoi(seqPart); err != nil {
+			return time.Time{}, 0, false
+		}
+	}
+
+	secondsPart, nanosPart, found := strings.Cut(stamp, ".")
+	if !found {
+		return time.Time{}, 0, false
+	}
+
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	nanos, err := strconv.ParseInt(nanosPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return time.Unix(seconds, nanos), seq, true
+}
@@ -0,0 +1,137 @@
+package plan
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// planCache is the stored plan as last read or written, normalised by
+// normalisedPlan, and the size and modification time the file had
+// then. The plan is never modified once cached, only replaced.
+type planCache struct {
+	loaded  bool
+	plan    OptimisationPlan
+	size    int64
+	modTime time.Time
+}
+
+func (c *planCache) matches(info os.FileInfo) bool {
+	return c.loaded && info.Size() == c.size && info.ModTime().Equal(c.modTime)
+}
+
+func (c *planCache) store(optPlan OptimisationPlan, info os.FileInfo) {
+	c.loaded = true
+	c.plan = normalisedPlan(optPlan)
+	c.size = info.Size()
+	c.modTime = info.ModTime()
+}
+
+// cachedPlan returns the cached plan, reading the file again only if it has
+// changed since the plan was cached. If the file can no longer be read, the
+// cached plan continues to be used.
+func (p Handler) cachedPlan() (OptimisationPlan, error) {
+	info, statErr := os.Stat(p.path)
+
+	p.mu.RLock()
+	if p.cache.loaded && (statErr != nil || p.cache.matches(info)) {
+		defer p.mu.RUnlock()
+		return p.cache.plan, nil
+	}
+	p.mu.RUnlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.loadPlan()
+}
+
+// loadPlan refreshes the cache from the file if it has changed. The caller
+// must hold the write lock.
+func (p Handler) loadPlan() (OptimisationPlan, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		if p.cache.loaded {
+			return p.cache.plan, nil
+		}
+		return OptimisationPlan{}, fmt.Errorf("reading plan from file: %w", err)
+	}
+	if p.cache.matches(info) {
+		return p.cache.plan, nil
+	}
+
+	optPlan, err := p.readPlan()
+	if err != nil {
+		if !p.cache.loaded {
+			return OptimisationPlan{}, err
+		}
+
+		// Keep the last good plan, and don't try the file again until it
+		// changes once more.
+		p.logger.Warn("Could not reload changed plan, continuing with the cached plan", "path", p.path, "error", err)
+		p.cache.size, p.cache.modTime = info.Size(), info.ModTime()
+		return p.cache.plan, nil
+	}
+
+	p.cache.store(optPlan, info)
+
+	return p.cache.plan, nil
+}
+
+// normalisedPlan returns a copy of the plan with its intervals sorted by start
+// time and no longer overlapping. Where intervals overlap, the one starting
+// first is kept, as it was when the current interval was found by scanning the
+// plan, and the later one is trimmed to start where it ends, or dropped if it
+// ends by then.
+func normalisedPlan(optPlan OptimisationPlan) OptimisationPlan {
+	intervals := make([]OptimisationInterval, len(optPlan.OptimisationIntervals))
+	copy(intervals, optPlan.OptimisationIntervals)
+	sort.SliceStable(intervals, func(i, j int) bool {
+		return intervals[i].Interval.StartTime.before(intervals[j].Interval.StartTime)
+	})
+
+	kept := intervals[:0]
+	for _, interval := range intervals {
+		if n := len(kept); n > 0 {
+			prevEnd := kept[n-1].Interval.EndTime
+			if !interval.Interval.EndTime.after(prevEnd) {
+				continue
+			}
+			if interval.Interval.StartTime.before(prevEnd) {
+				interval.Interval.StartTime = prevEnd
+			}
+		}
+		kept = append(kept, interval)
+	}
+
+	optPlan.OptimisationIntervals = kept
+	return optPlan
+}
+
+// isNormalised reports whether the intervals are sorted by start time and
+// don't overlap.
+func isNormalised(intervals []OptimisationInterval) bool {
+	for i := 1; i < len(intervals); i++ {
+		if intervals[i].Interval.StartTime.before(intervals[i-1].Interval.EndTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// currentIndex finds the interval current at the target time in normalised
+// intervals, or returns -1 if there isn't one.
+func currentIndex(intervals []OptimisationInterval, targetTime time.Time) int {
+	i := sort.Search(len(intervals), func(i int) bool {
+		return intervals[i].Interval.StartTime.Time().After(targetTime)
+	})
+
+	// Intervals starting later can't be current, and as the intervals don't
+	// overlap, the last interval starting by then is the only candidate.
+	if i > 0 && intervals[i-1].IsCurrent(targetTime) {
+		return i - 1
+	}
+
+	return -1
+}
@@ -0,0 +1,129 @@
+package plan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how a plan is compressed, whether in a payload or on disk.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var ErrTooLarge = errors.New("plan exceeds the size limit")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression identifies gzip and zstd data by their magic bytes.
+func DetectCompression(data []byte) Compression {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// Decompress returns data decompressed, if it is gzip or zstd, and otherwise
+// unchanged. It fails with ErrTooLarge if the result would exceed maxSize
+// bytes, without decompressing any further, to guard against decompression
+// bombs. A maxSize of zero or less means no limit.
+func Decompress(data []byte, maxSize int64) ([]byte, error) {
+	var reader io.Reader
+
+	switch DetectCompression(data) {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip header: %w", err)
+		}
+		defer gzipReader.Close()
+
+		reader = gzipReader
+	case CompressionZstd:
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+
+		zstdReader, err := zstd.NewReader(bytes.NewReader(data), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("reading zstd header: %w", err)
+		}
+		defer zstdReader.Close()
+
+		reader = zstdReader
+	default:
+		if maxSize > 0 && int64(len(data)) > maxSize {
+			return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, len(data), maxSize)
+		}
+		return data, nil
+	}
+
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || (maxSize > 0 && int64(len(decompressed)) > maxSize) {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", ErrTooLarge, maxSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing plan: %w", err)
+	}
+
+	return decompressed, nil
+}
+
+// Validate checks the compression is known.
+func (c Compression) Validate() error {
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionZstd, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+// Compress compresses data with the given compression.
+func Compress(data []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+
+		gzipWriter := gzip.NewWriter(&buf)
+		if _, err := gzipWriter.Write(data); err != nil {
+			return nil, fmt.Errorf("compressing plan: %w", err)
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return nil, fmt.Errorf("compressing plan: %w", err)
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("compressing plan: %w", err)
+		}
+		defer encoder.Close()
+
+		return encoder.EncodeAll(data, nil), nil
+	case CompressionNone, "":
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
@@ -0,0 +1,83 @@
+package plan
+
+import (
+	"sort"
+	"time"
+)
+
+// IntervalDiff is a period over which two plans differ. Old is nil where only
+// the new plan has an interval, and New is nil where only the old one does.
+// The deltas are the new setpoints less the old ones, taking a missing
+// interval as zero.
+type IntervalDiff struct {
+	Start             time.Time             `json:"start"`
+	End               time.Time             `json:"end"`
+	Old               *OptimisationInterval `json:"old,omitempty"`
+	New               *OptimisationInterval `json:"new,omitempty"`
+	MeterPowerDelta   float32               `json:"meter_power_delta"`
+	BatteryPowerDelta float32               `json:"battery_power_delta"`
+}
+
+// Diff reports the periods over which the setpoints of two plans differ, in
+// time order. Intervals are compared over time rather than one to one, so
+// that plans with differently aligned intervals can be compared.
+func Diff(oldPlan, newPlan OptimisationPlan) []IntervalDiff {
+	var boundaries []time.Time
+	for _, intervals := range [][]OptimisationInterval{oldPlan.OptimisationIntervals, newPlan.OptimisationIntervals} {
+		for _, intv := range intervals {
+			boundaries = append(boundaries, intv.Interval.StartTime.Time(), intv.Interval.EndTime.Time())
+		}
+	}
+
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	var diffs []IntervalDiff
+
+	for i := 1; i < len(boundaries); i++ {
+		start, end := boundaries[i-1], boundaries[i]
+		if start.Equal(end) {
+			continue
+		}
+
+		oldIntv := intervalAt(oldPlan.OptimisationIntervals, start)
+		newIntv := intervalAt(newPlan.OptimisationIntervals, start)
+		if sameSetpoints(oldIntv, newIntv) {
+			continue
+		}
+
+		// Extend the previous difference if it is the same one continuing.
+		if n := len(diffs); n > 0 && diffs[n-1].End.Equal(start) && diffs[n-1].Old == oldIntv && diffs[n-1].New == newIntv {
+			diffs[n-1].End = end
+			continue
+		}
+
+		diff := IntervalDiff{Start: start, End: end, Old: oldIntv, New: newIntv}
+		if oldIntv != nil {
+			diff.MeterPowerDelta -= oldIntv.MeterPower.Value
+			diff.BatteryPowerDelta -= oldIntv.BatteryPower.Value
+		}
+		if newIntv != nil {
+			diff.MeterPowerDelta += newIntv.MeterPower.Value
+			diff.BatteryPowerDelta += newIntv.BatteryPower.Value
+		}
+		diffs = append(diffs, diff)
+	}
+
+	return diffs
+}
+
+func intervalAt(intervals []OptimisationInterval, at time.Time) *OptimisationInterval {
+	for i := range intervals {
+		if intervals[i].IsCurrent(at) {
+			return &intervals[i]
+		}
+	}
+	return nil
+}
+
+func sameSetpoints(a, b *OptimisationInterval) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.MeterPower == b.MeterPower && a.BatteryPower == b.BatteryPower && a.StateOfCharge == b.StateOfCharge
+}
@@ -0,0 +1,179 @@
+package plan
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Interpolation is how the setpoint at a moment is calculated from the plan.
+type Interpolation string
+
+const (
+	// InterpolationStep holds each interval's setpoint for the whole interval.
+	InterpolationStep Interpolation = "step"
+	// InterpolationLinear takes each interval's setpoint as applying at its
+	// midpoint, and interpolates linearly between neighbouring midpoints.
+	InterpolationLinear Interpolation = "linear"
+	// InterpolationRamp moves towards each interval's setpoint from the start
+	// of the interval, no faster than the ramp rate.
+	InterpolationRamp Interpolation = "ramp"
+)
+
+// rampLookback is how many intervals before the current one are followed to
+// find where a ramp started. Ramps rarely span more than a few intervals.
+const rampLookback = 12
+
+// Interpolator calculates instantaneous setpoints. RampRate is in kW per
+// minute, and only used by InterpolationRamp.
+type Interpolator struct {
+	Mode     Interpolation
+	RampRate float64
+}
+
+// Validate checks the interpolation mode is known and has what it needs.
+func (in Interpolator) Validate() error {
+	switch in.Mode {
+	case InterpolationStep, InterpolationLinear, "":
+		return nil
+	case InterpolationRamp:
+		if in.RampRate <= 0 {
+			return fmt.Errorf("ramp interpolation needs a positive ramp rate, not %g", in.RampRate)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown interpolation %q", in.Mode)
+	}
+}
+
+// GetSetpoint returns the current interval of the stored plan, with its meter
+// and battery power interpolated for the target time.
+func (p Handler) GetSetpoint(targetTime time.Time, interpolator Interpolator) (OptimisationInterval, error) {
+	plan, err := p.cachedPlan()
+	if err != nil {
+		return OptimisationInterval{}, fmt.Errorf("reading current plan: %w", err)
+	}
+
+	return plan.SetpointAt(targetTime, interpolator)
+}
+
+// SetpointAt returns the interval current at the target time, with its meter
+// and battery power interpolated for that time from neighbouring intervals.
+// Intervals are only interpolated across when they are contiguous.
+func (o OptimisationPlan) SetpointAt(targetTime time.Time, interpolator Interpolator) (OptimisationInterval, error) {
+	intervals := o.OptimisationIntervals
+	if !isNormalised(intervals) {
+		intervals = normalisedPlan(o).OptimisationIntervals
+	}
+
+	current := currentIndex(intervals, targetTime)
+	if current < 0 {
+		return OptimisationInterval{}, ErrNoCurrentInterval
+	}
+
+	setpoint := intervals[current]
+
+	switch interpolator.Mode {
+	case InterpolationLinear:
+		setpoint.MeterPower.Value = linearValue(intervals, current, targetTime, meterPower)
+		setpoint.BatteryPower.Value = linearValue(intervals, current, targetTime, batteryPower)
+	case InterpolationRamp:
+		setpoint.MeterPower.Value = rampValue(intervals, current, targetTime, interpolator.RampRate, meterPower)
+		setpoint.BatteryPower.Value = rampValue(intervals, current, targetTime, interpolator.RampRate, batteryPower)
+	}
+
+	return setpoint, nil
+}
+
+func meterPower(intv OptimisationInterval) OptimisationValue   { return intv.MeterPower }
+func batteryPower(intv OptimisationInterval) OptimisationValue { return intv.BatteryPower }
+
+func linearValue(intervals []OptimisationInterval, current int, at time.Time, field func(OptimisationInterval) OptimisationValue) float32 {
+	intv := intervals[current]
+	unit := field(intv).Unit
+	mid := intv.midpoint()
+
+	var from, to OptimisationInterval
+
+	switch {
+	case at.Before(mid) && current > 0 && contiguous(intervals[current-1], intv):
+		from, to = intervals[current-1], intv
+	case !at.Before(mid) && current < len(intervals)-1 && contiguous(intv, intervals[current+1]):
+		from, to = intv, intervals[current+1]
+	default:
+		return field(intv).Value
+	}
+
+	fromValue, toValue := field(from).in(unit), field(to).in(unit)
+	span := to.midpoint().Sub(from.midpoint())
+	fraction := float64(at.Sub(from.midpoint())) / float64(span)
+
+	return float32(fromValue + (toValue-fromValue)*fraction)
+}
+
+func rampValue(intervals []OptimisationInterval, current int, at time.Time, rate float64, field func(OptimisationInterval) OptimisationValue) float32 {
+	unit := field(intervals[current]).Unit
+	perSecond := rate * unitsPerKilowatt(unit) / 60
+
+	start := current
+	for start > 0 && current-start < rampLookback && contiguous(intervals[start-1], intervals[start]) {
+		start--
+	}
+
+	// Follow the ramp from the start of the run of intervals, taking the
+	// setpoint to have been reached there, to where it is at the target time.
+	value := field(intervals[start]).in(unit)
+	for i := start; i < current; i++ {
+		value = approach(value, field(intervals[i]).in(unit), perSecond*intervals[i].duration().Seconds())
+	}
+
+	elapsed := at.Sub(intervals[current].Interval.StartTime.Time())
+
+	return float32(approach(value, field(intervals[current]).in(unit), perSecond*elapsed.Seconds()))
+}
+
+// approach moves value towards target by no more than maxStep.
+func approach(value, target, maxStep float64) float64 {
+	return value + math.Max(-maxStep, math.Min(maxStep, target-value))
+}
+
+func contiguous(before, after OptimisationInterval) bool {
+	return before.Interval.EndTime.Time().Equal(after.Interval.StartTime.Time())
+}
+
+func (i OptimisationInterval) duration() time.Duration {
+	return i.Interval.EndTime.Time().Sub(i.Interval.StartTime.Time())
+}
+
+func (i OptimisationInterval) midpoint() time.Time {
+	return i.Interval.StartTime.Time().Add(i.duration() / 2)
+}
+
+// Kilowatts returns the value in kW.
+func (v OptimisationValue) Kilowatts() float64 {
+	return float64(v.Value) / unitsPerKilowatt(v.Unit)
+}
+
+// WithKilowatts returns the value set to a number of kW, in its own unit.
+func (v OptimisationValue) WithKilowatts(kw float64) OptimisationValue {
+	v.Value = float32(kw * unitsPerKilowatt(v.Unit))
+	return v
+}
+
+// in returns the value converted to the given unit.
+func (v OptimisationValue) in(unit int) float64 {
+	return float64(v.Value) / unitsPerKilowatt(v.Unit) * unitsPerKilowatt(unit)
+}
+
+// unitsPerKilowatt converts kW to a Unit of plan.proto. Unknown units are
+// taken to be kW.
+func unitsPerKilowatt(unit int) float64 {
+	switch unit {
+	case UnitWatt:
+		return 1000
+	case UnitMegawatt:
+		return 0.001
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,123 @@
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// Provenance records which plan an interval was taken from, and when that
+// plan was received.
+type Provenance struct {
+	OptimisationTimestamp OptimisationTimestamp `json:"optimisation_timestamp"`
+	Received              OptimisationTimestamp `json:"received"`
+}
+
+// Merge merges an incoming plan into a stored one. Where intervals overlap,
+// those from the plan with the later optimisation timestamp win, and the
+// overlapped intervals are trimmed, or dropped if nothing is left of them.
+// Intervals that have ended by now are pruned. If the incoming plan has its
+// replace flag set, the stored plan is discarded instead.
+func Merge(stored, incoming OptimisationPlan, now time.Time) OptimisationPlan {
+	received := NewTimestamp(now)
+
+	candidates := make([]OptimisationInterval, 0, len(stored.OptimisationIntervals)+len(incoming.OptimisationIntervals))
+
+	for _, intv := range incoming.OptimisationIntervals {
+		intv.Provenance = &Provenance{OptimisationTimestamp: incoming.OptimisationTimestamp, Received: received}
+		candidates = append(candidates, intv)
+	}
+
+	if !incoming.Replace {
+		for _, intv := range stored.OptimisationIntervals {
+			if intv.Provenance == nil {
+				intv.Provenance = &Provenance{OptimisationTimestamp: stored.OptimisationTimestamp}
+			}
+			candidates = append(candidates, intv)
+		}
+	}
+
+	// Intervals claim their period in order of precedence, newest plan first.
+	// The sort is stable, so incoming intervals win ties with stored ones.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Provenance.OptimisationTimestamp.after(candidates[j].Provenance.OptimisationTimestamp)
+	})
+
+	var merged []OptimisationInterval
+
+	for _, intv := range candidates {
+		if !intv.Interval.EndTime.Time().After(now) {
+			continue
+		}
+		merged = append(merged, subtract(intv, merged)...)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Interval.StartTime.before(merged[j].Interval.StartTime)
+	})
+
+	result := incoming
+	result.Replace = false
+	result.OptimisationIntervals = merged
+	if result.OptimisationTimestamp.after(stored.OptimisationTimestamp) || incoming.Replace {
+		return result
+	}
+
+	result.OptimisationTimestamp = stored.OptimisationTimestamp
+	return result
+}
+
+// MergePlan merges an incoming plan into the stored plan, as Merge does, and
+// stores the result. An unreadable stored plan is replaced.
+func (p Handler) MergePlan(incoming OptimisationPlan, now time.Time) (OptimisationPlan, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stored, err := p.loadPlan()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		p.logger.Warn("Could not read stored plan, replacing it", "path", p.path, "error", err)
+	}
+
+	merged := Merge(stored, incoming, now)
+
+	if err := p.writePlan(merged); err != nil {
+		return OptimisationPlan{}, fmt.Errorf("storing merged plan: %w", err)
+	}
+
+	return merged, nil
+}
+
+// subtract returns what is left of intv once the periods of the claimed
+// intervals are taken out of it.
+func subtract(intv OptimisationInterval, claimed []OptimisationInterval) []OptimisationInterval {
+	pieces := []OptimisationInterval{intv}
+
+	for _, claim := range claimed {
+		claimStart, claimEnd := claim.Interval.StartTime, claim.Interval.EndTime
+
+		var remaining []OptimisationInterval
+		for _, piece := range pieces {
+			start, end := piece.Interval.StartTime, piece.Interval.EndTime
+			if !claimEnd.after(start) || !claimStart.before(end) {
+				remaining = append(remaining, piece)
+				continue
+			}
+
+			if claimStart.after(start) {
+				before := piece
+				before.Interval.EndTime = claim.Interval.StartTime
+				remaining = append(remaining, before)
+			}
+			if claimEnd.before(end) {
+				after := piece
+				after.Interval.StartTime = claim.Interval.EndTime
+				remaining = append(remaining, after)
+			}
+		}
+		pieces = remaining
+	}
+
+	return pieces
+}
@@ -2,24 +2,34 @@ package plan
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
+var ErrNoCurrentInterval = errors.New("no current interval found in plan")
+
 type Handler struct {
-	logger *slog.Logger
-	mu     *sync.RWMutex
-	path   string
+	logger      *slog.Logger
+	mu          *sync.RWMutex
+	path        string
+	compression Compression
+	maxSize     int64
+	cache       *planCache
 }
 
+// OptimisationPlan is a plan as published by the optimiser. Replace asks for
+// the stored plan to be discarded, rather than the plan merged into it.
 type OptimisationPlan struct {
 	SiteID                string                 `json:"site_id"`
 	OptimisationTimestamp OptimisationTimestamp  `json:"optimisation_timestamp"`
 	OptimisationIntervals []OptimisationInterval `json:"optimisation_intervals"`
 	SetpointType          int                    `json:"setpoint_type"`
+	Replace               bool                   `json:"replace,omitempty"`
 }
 
 type OptimisationTimestamp struct {
@@ -27,11 +37,14 @@ type OptimisationTimestamp struct {
 	Nanos   int64 `json:"nanos"`
 }
 
+// OptimisationInterval is a setpoint for a period of the plan. Provenance is
+// only set on stored intervals.
 type OptimisationInterval struct {
 	Interval      OptimisationIntervalTimestamp `json:"optimisation_interval"`
 	BatteryPower  OptimisationValue             `json:"battery_power"`
 	StateOfCharge float32                       `json:"state_of_charge"`
 	MeterPower    OptimisationValue             `json:"meter_power"`
+	Provenance    *Provenance                   `json:"provenance,omitempty"`
 }
 
 type OptimisationIntervalTimestamp struct {
@@ -44,6 +57,13 @@ type OptimisationValue struct {
 	Unit  int     `json:"unit"`
 }
 
+// Units of an OptimisationValue, as in plan.proto.
+const (
+	UnitWatt     = 1
+	UnitKilowatt = 2
+	UnitMegawatt = 3
+)
+
 func (o OptimisationPlan) IsEmpty() bool {
 	return o.SiteID == "" && len(o.OptimisationIntervals) == 0 && o.OptimisationTimestamp.Seconds == 0
 }
@@ -53,34 +73,62 @@ func (i OptimisationInterval) IsEmpty() bool {
 }
 
 func (i OptimisationInterval) IsCurrent(targetTime time.Time) bool {
-	intStart := time.Unix(i.Interval.StartTime.Seconds, 0)
-	intEnd := time.Unix(i.Interval.EndTime.Seconds, 0)
+	intStart := i.Interval.StartTime.Time()
+	intEnd := i.Interval.EndTime.Time()
 
 	isAfterStart := targetTime.Equal(intStart) || targetTime.After(intStart)
 	isBeforeEnd := targetTime.Before(intEnd)
 	return isAfterStart && isBeforeEnd
 }
 
-func (i OptimisationInterval) LogFormat() map[string]string {
+// LogFormat returns the interval as fields for logs, with its start in the
+// given time zone.
+func (i OptimisationInterval) LogFormat(location *time.Location) map[string]string {
 	return map[string]string{
-		"intervalStart": fmt.Sprintf("%d", i.Interval.StartTime.Seconds),
+		"intervalStart": i.Interval.StartTime.Format(location),
 		"meterPower":    fmt.Sprintf("%.0f", i.MeterPower.Value),
 	}
 }
 
 func NewHandler(logger *slog.Logger, path string) Handler {
-	return Handler{logger: logger, mu: new(sync.RWMutex), path: path}
+	return Handler{logger: logger, mu: new(sync.RWMutex), path: path, cache: new(planCache)}
+}
+
+// WithCompression returns a copy of the handler that stores plans compressed,
+// and refuses to read plans that decompress to more than maxSize bytes.
+// Plans stored uncompressed, or compressed differently, can still be read.
+func (p Handler) WithCompression(compression Compression, maxSize int64) Handler {
+	p.compression = compression
+	p.maxSize = maxSize
+
+	return p
 }
 
+// ReadPlan returns the stored plan, with its intervals sorted by start time
+// and trimmed so that they don't overlap.
+// The plan is kept in memory, and only read from the file again if the file
+// changes.
 func (p Handler) ReadPlan() (OptimisationPlan, error) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	optPlan, err := p.cachedPlan()
+	if err != nil {
+		return OptimisationPlan{}, err
+	}
 
+	// Copy the intervals, so that the cached plan can't be modified.
+	return normalisedPlan(optPlan), nil
+}
+
+func (p Handler) readPlan() (OptimisationPlan, error) {
 	content, err := os.ReadFile(p.path)
 	if err != nil {
 		return OptimisationPlan{}, fmt.Errorf("reading plan from file: %w", err)
 	}
 
+	content, err = Decompress(content, p.maxSize)
+	if err != nil {
+		return OptimisationPlan{}, fmt.Errorf("reading plan from file: %w", err)
+	}
+
 	optPlan := OptimisationPlan{}
 
 	err = json.Unmarshal(content, &optPlan)
@@ -95,6 +143,10 @@ func (p Handler) WritePlan(optPlan OptimisationPlan) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	return p.writePlan(optPlan)
+}
+
+func (p Handler) writePlan(optPlan OptimisationPlan) error {
 	f, err := os.Create(p.path)
 	if err != nil {
 		return fmt.Errorf("creating plan backup file at %s: %w", p.path, err)
@@ -106,24 +158,125 @@ func (p Handler) WritePlan(optPlan OptimisationPlan) error {
 		return fmt.Errorf("marshalling optimisation plan: %w", err)
 	}
 
+	encodedPlan, err = Compress(encodedPlan, p.compression)
+	if err != nil {
+		return err
+	}
+
 	_, err = f.Write(encodedPlan)
 	if err != nil {
 		return fmt.Errorf("writing plan to file at %s: %w", p.path, err)
 	}
 
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("writing plan to file at %s: %w", p.path, err)
+	}
+	p.cache.store(optPlan, info)
+
 	return nil
 }
 
 func (p Handler) GetCurrentInterval(targetTime time.Time) (OptimisationInterval, error) {
-	plan, err := p.ReadPlan()
+	plan, err := p.cachedPlan()
 	if err != nil {
 		return OptimisationInterval{}, fmt.Errorf("reading current plan: %w", err)
 	}
 
-	for _, intv := range plan.OptimisationIntervals {
-		if intv.IsCurrent(targetTime) {
-			return intv, nil
+	if i := currentIndex(plan.OptimisationIntervals, targetTime); i >= 0 {
+		return plan.OptimisationIntervals[i], nil
+	}
+	return OptimisationInterval{}, ErrNoCurrentInterval
+}
+
+// CoverageWindow is the period ahead of the current time that plan coverage is measured over.
+const CoverageWindow = 24 * time.Hour
+
+// Coverage reports how well the stored plan covers the window following a given time.
+type Coverage struct {
+	From            time.Time
+	To              time.Time
+	LastIntervalEnd time.Time
+	Gaps            []Gap
+	CoveredPercent  float64
+}
+
+// Gap is a period within the coverage window that no plan interval applies to.
+type Gap struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (g Gap) Duration() time.Duration {
+	return g.End.Sub(g.Start)
+}
+
+// Remaining returns how long the plan continues to provide intervals after the start of the window.
+func (c Coverage) Remaining() time.Duration {
+	if c.LastIntervalEnd.Before(c.From) {
+		return 0
+	}
+	return c.LastIntervalEnd.Sub(c.From)
+}
+
+func (c Coverage) LogFormat(location *time.Location) map[string]string {
+	return map[string]string{
+		"lastIntervalEnd": c.LastIntervalEnd.In(location).Format(time.RFC3339),
+		"gaps":            fmt.Sprintf("%d", len(c.Gaps)),
+		"coveredPercent":  fmt.Sprintf("%.1f", c.CoveredPercent),
+	}
+}
+
+func (p Handler) GetCoverage(from time.Time) (Coverage, error) {
+	plan, err := p.cachedPlan()
+	if err != nil {
+		return Coverage{}, fmt.Errorf("reading current plan: %w", err)
+	}
+
+	return plan.Coverage(from), nil
+}
+
+// Coverage calculates the coverage of the plan over the CoverageWindow following from.
+func (o OptimisationPlan) Coverage(from time.Time) Coverage {
+	to := from.Add(CoverageWindow)
+	coverage := Coverage{From: from, To: to}
+
+	intervals := make([]OptimisationInterval, len(o.OptimisationIntervals))
+	copy(intervals, o.OptimisationIntervals)
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Interval.StartTime.before(intervals[j].Interval.StartTime)
+	})
+
+	cursor := from
+	var covered time.Duration
+
+	for _, intv := range intervals {
+		intStart := intv.Interval.StartTime.Time()
+		intEnd := intv.Interval.EndTime.Time()
+
+		if intEnd.After(coverage.LastIntervalEnd) {
+			coverage.LastIntervalEnd = intEnd
+		}
+		if !intEnd.After(cursor) || !intStart.Before(to) {
+			continue
 		}
+
+		if intStart.After(cursor) {
+			coverage.Gaps = append(coverage.Gaps, Gap{Start: cursor, End: intStart})
+			cursor = intStart
+		}
+		if intEnd.After(to) {
+			intEnd = to
+		}
+		covered += intEnd.Sub(cursor)
+		cursor = intEnd
 	}
-	return OptimisationInterval{}, fmt.Errorf("no current interval found in plan")
+
+	if cursor.Before(to) {
+		coverage.Gaps = append(coverage.Gaps, Gap{Start: cursor, End: to})
+	}
+
+	coverage.CoveredPercent = 100 * float64(covered) / float64(CoverageWindow)
+
+	return coverage
 }
@@ -1,14 +1,20 @@
 package plan_test
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/plan"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testLogger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
@@ -149,10 +155,37 @@ func TestGetCurrentInterval_WhenIntervalNotPresent(t *testing.T) {
 	}
 }
 
+func TestGetCurrentInterval_WhenIntervalsOverlap(t *testing.T) {
+	handler := plan.NewHandler(testLogger, filepath.Join(t.TempDir(), "plan.json"))
+
+	// the interval starting first is current where intervals overlap
+	require.NoError(t, handler.WritePlan(plan.OptimisationPlan{
+		SiteID: "test-site",
+		OptimisationIntervals: []plan.OptimisationInterval{
+			newInterval(1000, 2000, 1),
+			newInterval(1200, 1500, 2),
+			newInterval(1800, 2400, 3),
+		},
+	}))
+
+	for at, expected := range map[int64]float32{1100: 1, 1300: 1, 1600: 1, 1900: 1, 2100: 3} {
+		intv, err := handler.GetCurrentInterval(time.Unix(at, 0))
+		require.NoError(t, err, at)
+		assert.EqualValues(t, expected, intv.MeterPower.Value, at)
+	}
+
+	stored, err := handler.ReadPlan()
+	require.NoError(t, err)
+	assert.Equal(t, [][3]float32{{1000, 2000, 1}, {2000, 2400, 3}}, intervalSpans(stored.OptimisationIntervals))
+}
+
 func TestIntervalLogFormat(t *testing.T) {
 	testPlan := GetOptimisationPlan()
-	logFormat := testPlan.OptimisationIntervals[0].LogFormat()
-	assert.EqualValues(t, logFormat["intervalStart"], "1715319000")
+	logFormat := testPlan.OptimisationIntervals[0].LogFormat(time.UTC)
+	assert.EqualValues(t, "2024-05-10T05:30:00Z", logFormat["intervalStart"])
+
+	logFormat = testPlan.OptimisationIntervals[0].LogFormat(time.FixedZone("AEST", 10*60*60))
+	assert.EqualValues(t, "2024-05-10T15:30:00+10:00", logFormat["intervalStart"])
 	assert.EqualValues(t, logFormat["meterPower"], "400")
 }
 
@@ -161,3 +194,710 @@ func TestPlanIsEmpty(t *testing.T) {
 	assert.False(t, testPlan.IsEmpty())
 	assert.True(t, plan.OptimisationPlan{}.IsEmpty())
 }
+
+func TestPlanCoverage_WhenPlanCoversPartOfWindow(t *testing.T) {
+	testPlan := GetOptimisationPlan()
+	// leave a gap between the first and second intervals
+	testPlan.OptimisationIntervals = append(testPlan.OptimisationIntervals[:1], testPlan.OptimisationIntervals[2])
+
+	from := time.Unix(1715319000, 0)
+	coverage := testPlan.Coverage(from)
+
+	assert.Equal(t, time.Unix(1715319900, 0), coverage.LastIntervalEnd)
+	assert.Equal(t, 15*time.Minute, coverage.Remaining())
+	assert.Len(t, coverage.Gaps, 2)
+	assert.Equal(t, time.Unix(1715319300, 0), coverage.Gaps[0].Start)
+	assert.Equal(t, 5*time.Minute, coverage.Gaps[0].Duration())
+	assert.Equal(t, from.Add(plan.CoverageWindow), coverage.Gaps[1].End)
+	assert.InDelta(t, 100*float64(10*time.Minute)/float64(plan.CoverageWindow), coverage.CoveredPercent, 0.0001)
+}
+
+func TestPlanCoverage_WhenPlanHasExpired(t *testing.T) {
+	testPlan := GetOptimisationPlan()
+
+	from := time.Unix(1715320000, 0)
+	coverage := testPlan.Coverage(from)
+
+	assert.Equal(t, time.Duration(0), coverage.Remaining())
+	assert.Len(t, coverage.Gaps, 1)
+	assert.InDelta(t, 0, coverage.CoveredPercent, 0.0001)
+}
+
+func TestGetCoverage_WhenNoPlanStored_ReturnsError(t *testing.T) {
+	handler := plan.NewHandler(testLogger, "/tmp/no/such/plan.json")
+
+	_, err := handler.GetCoverage(time.Now())
+	assert.Error(t, err)
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	optPlan := GetOptimisationPlan()
+	optPlan.OptimisationTimestamp = plan.OptimisationTimestamp{Seconds: 1715318000, Nanos: 500}
+	optPlan.Replace = true
+
+	decoded, err := plan.Decode(optPlan.MarshalProto(), plan.FormatProtobuf)
+	require.NoError(t, err)
+	assert.Equal(t, optPlan, decoded)
+}
+
+func TestUnmarshalProto(t *testing.T) {
+	// site_id "s1", one interval starting at 300 with a meter power of 2.5 kW,
+	// and an unknown field 15 that must be skipped
+	payload := []byte{
+		0x0a, 0x02, 's', '1',
+		0x1a, 0x10,
+		0x0a, 0x05, 0x0a, 0x03, 0x08, 0xac, 0x02,
+		0x22, 0x07, 0x0d, 0x00, 0x00, 0x20, 0x40, 0x10, 0x02,
+		0x78, 0x01,
+	}
+
+	decoded, err := plan.UnmarshalProto(payload)
+	require.NoError(t, err)
+
+	assert.Equal(t, "s1", decoded.SiteID)
+	require.Len(t, decoded.OptimisationIntervals, 1)
+	assert.EqualValues(t, 300, decoded.OptimisationIntervals[0].Interval.StartTime.Seconds)
+	assert.Equal(t, plan.OptimisationValue{Value: 2.5, Unit: 2}, decoded.OptimisationIntervals[0].MeterPower)
+}
+
+func TestUnmarshalProto_WhenMalformed_ReturnsError(t *testing.T) {
+	payload := GetOptimisationPlan().MarshalProto()
+
+	_, err := plan.UnmarshalProto(payload[:len(payload)-3])
+	assert.Error(t, err)
+
+	// site_id sent as a varint
+	_, err = plan.UnmarshalProto([]byte{0x08, 0x01})
+	assert.Error(t, err)
+
+	// a JSON plan is not valid protobuf
+	_, err = plan.Decode([]byte(`{"site_id":"s1"}`), plan.FormatProtobuf)
+	assert.Error(t, err)
+}
+
+func TestDecompress(t *testing.T) {
+	payload := GetOptimisationPlan().MarshalProto()
+
+	for _, compression := range []plan.Compression{plan.CompressionNone, plan.CompressionGzip, plan.CompressionZstd} {
+		compressed, err := plan.Compress(payload, compression)
+		require.NoError(t, err)
+		assert.Equal(t, compression, plan.DetectCompression(compressed))
+
+		decompressed, err := plan.Decompress(compressed, 1<<20)
+		require.NoError(t, err, compression)
+		assert.Equal(t, payload, decompressed, compression)
+	}
+}
+
+func TestDecompress_WhenTooLarge_ReturnsError(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+
+	for _, compression := range []plan.Compression{plan.CompressionNone, plan.CompressionGzip, plan.CompressionZstd} {
+		compressed, err := plan.Compress(bomb, compression)
+		require.NoError(t, err)
+
+		_, err = plan.Decompress(compressed, 1<<16)
+		assert.ErrorIs(t, err, plan.ErrTooLarge, compression)
+	}
+}
+
+func TestWritesAndReadsACompressedPlan(t *testing.T) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+
+	handler := plan.NewHandler(testLogger, planPath).WithCompression(plan.CompressionZstd, 1<<20)
+	require.NoError(t, handler.WritePlan(GetOptimisationPlan()))
+
+	content, err := os.ReadFile(planPath)
+	require.NoError(t, err)
+	assert.Equal(t, plan.CompressionZstd, plan.DetectCompression(content))
+
+	// a plan stored compressed can be read when compression is turned off
+	optPlan, err := plan.NewHandler(testLogger, planPath).ReadPlan()
+	require.NoError(t, err)
+	assert.Equal(t, GetOptimisationPlan(), optPlan)
+}
+
+func newTestKey(t *testing.T, id string) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	return id + ":" + base64.StdEncoding.EncodeToString(publicKey), privateKey
+}
+
+func TestVerifier(t *testing.T) {
+	oldKey, oldPrivateKey := newTestKey(t, "2024")
+	newKey, newPrivateKey := newTestKey(t, "2025")
+	_, otherPrivateKey := newTestKey(t, "2025")
+
+	verifier, err := plan.NewVerifier([]string{oldKey, newKey})
+	require.NoError(t, err)
+
+	payload := GetOptimisationPlan().MarshalProto()
+
+	// plans signed with either key are accepted while the keys are rotated
+	for id, privateKey := range map[string]ed25519.PrivateKey{"2024": oldPrivateKey, "2025": newPrivateKey} {
+		signed, err := plan.Sign(payload, id, privateKey)
+		require.NoError(t, err)
+
+		verified, err := verifier.Verify(signed)
+		require.NoError(t, err, id)
+		assert.Equal(t, payload, verified, id)
+	}
+
+	_, err = verifier.Verify(payload)
+	assert.ErrorIs(t, err, plan.ErrUnsigned)
+
+	_, err = verifier.Verify([]byte(`{"site_id":"1.2.3"}`))
+	assert.ErrorIs(t, err, plan.ErrUnsigned)
+
+	signed, err := plan.Sign(payload, "2025", otherPrivateKey)
+	require.NoError(t, err)
+	_, err = verifier.Verify(signed)
+	assert.ErrorIs(t, err, plan.ErrInvalidSignature)
+
+	signed, err = plan.Sign(payload, "2023", oldPrivateKey)
+	require.NoError(t, err)
+	_, err = verifier.Verify(signed)
+	assert.ErrorIs(t, err, plan.ErrUnknownKey)
+}
+
+func TestCheckFresh(t *testing.T) {
+	optPlan := GetOptimisationPlan()
+	optPlan.SiteID = "site"
+	optPlan.OptimisationTimestamp = plan.OptimisationTimestamp{Seconds: 1715318000}
+
+	assert.NoError(t, plan.CheckFresh(optPlan, "site", plan.OptimisationTimestamp{}))
+	assert.NoError(t, plan.CheckFresh(optPlan, "site", plan.OptimisationTimestamp{Seconds: 1715317999}))
+
+	assert.ErrorIs(t, plan.CheckFresh(optPlan, "other-site", plan.OptimisationTimestamp{}), plan.ErrWrongSite)
+	assert.ErrorIs(t, plan.CheckFresh(optPlan, "site", optPlan.OptimisationTimestamp), plan.ErrNotNewer)
+	assert.ErrorIs(t, plan.CheckFresh(optPlan, "site", plan.OptimisationTimestamp{Seconds: 1715318001}), plan.ErrNotNewer)
+}
+
+func TestVerifier_WhenPayloadTampered_ReturnsError(t *testing.T) {
+	key, privateKey := newTestKey(t, "k1")
+
+	verifier, err := plan.NewVerifier([]string{key})
+	require.NoError(t, err)
+
+	signed, err := plan.Sign([]byte(`{"site_id":"a"}`), "k1", privateKey)
+	require.NoError(t, err)
+
+	parts := strings.Split(string(signed), ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"site_id":"b"}`))
+
+	_, err = verifier.Verify([]byte(strings.Join(parts, ".")))
+	assert.ErrorIs(t, err, plan.ErrInvalidSignature)
+
+	// the none algorithm is never accepted
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+	parts[2] = ""
+
+	_, err = verifier.Verify([]byte(strings.Join(parts, ".")))
+	assert.ErrorIs(t, err, plan.ErrInvalidSignature)
+}
+
+func TestNewVerifier_RejectsInvalidKeys(t *testing.T) {
+	key, _ := newTestKey(t, "k1")
+
+	for _, keys := range [][]string{
+		nil,
+		{"k1"},
+		{"k1:not-base64!"},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{key, key},
+	} {
+		_, err := plan.NewVerifier(keys)
+		assert.Error(t, err, keys)
+	}
+}
+
+func newInterval(start, end int64, meterPower float32) plan.OptimisationInterval {
+	return plan.OptimisationInterval{
+		Interval: plan.OptimisationIntervalTimestamp{
+			StartTime: plan.OptimisationTimestamp{Seconds: start},
+			EndTime:   plan.OptimisationTimestamp{Seconds: end},
+		},
+		MeterPower: plan.OptimisationValue{Value: meterPower, Unit: 2},
+	}
+}
+
+func intervalSpans(intervals []plan.OptimisationInterval) [][3]float32 {
+	spans := make([][3]float32, len(intervals))
+	for i, intv := range intervals {
+		spans[i] = [3]float32{float32(intv.Interval.StartTime.Seconds), float32(intv.Interval.EndTime.Seconds), intv.MeterPower.Value}
+	}
+	return spans
+}
+
+func TestMerge(t *testing.T) {
+	stored := plan.OptimisationPlan{
+		SiteID:                "test-site",
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1000},
+		OptimisationIntervals: []plan.OptimisationInterval{
+			newInterval(1000, 1300, 1),
+			newInterval(1300, 1600, 2),
+			newInterval(1600, 1900, 3),
+			newInterval(1900, 2200, 4),
+		},
+	}
+	incoming := plan.OptimisationPlan{
+		SiteID:                "test-site",
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1400},
+		OptimisationIntervals: []plan.OptimisationInterval{
+			newInterval(1450, 1750, 10),
+		},
+	}
+
+	merged := plan.Merge(stored, incoming, time.Unix(1400, 0))
+
+	// the first interval has ended, the overlapped ones are trimmed and the tail is kept
+	assert.Equal(t, [][3]float32{
+		{1300, 1450, 2},
+		{1450, 1750, 10},
+		{1750, 1900, 3},
+		{1900, 2200, 4},
+	}, intervalSpans(merged.OptimisationIntervals))
+	assert.EqualValues(t, 1400, merged.OptimisationTimestamp.Seconds)
+
+	assert.EqualValues(t, 1000, merged.OptimisationIntervals[0].Provenance.OptimisationTimestamp.Seconds)
+	assert.EqualValues(t, 1400, merged.OptimisationIntervals[1].Provenance.OptimisationTimestamp.Seconds)
+	assert.EqualValues(t, 1400, merged.OptimisationIntervals[1].Provenance.Received.Seconds)
+}
+
+func TestMerge_WhenIncomingIsOlder_StoredIntervalsWin(t *testing.T) {
+	stored := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 2000},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(2000, 2300, 1)},
+	}
+	incoming := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1500},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1900, 2600, 5)},
+	}
+
+	merged := plan.Merge(stored, incoming, time.Unix(1800, 0))
+
+	assert.Equal(t, [][3]float32{
+		{1900, 2000, 5},
+		{2000, 2300, 1},
+		{2300, 2600, 5},
+	}, intervalSpans(merged.OptimisationIntervals))
+	assert.EqualValues(t, 2000, merged.OptimisationTimestamp.Seconds)
+}
+
+func TestMerge_WhenReplace_DiscardsStoredPlan(t *testing.T) {
+	stored := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1000},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1000, 1300, 1), newInterval(1300, 1600, 2)},
+	}
+	incoming := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1100},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1100, 1200, 7)},
+		Replace:               true,
+	}
+
+	merged := plan.Merge(stored, incoming, time.Unix(1100, 0))
+
+	assert.Equal(t, [][3]float32{{1100, 1200, 7}}, intervalSpans(merged.OptimisationIntervals))
+	assert.False(t, merged.Replace)
+}
+
+func TestMergePlan_StoresTheMergedPlan(t *testing.T) {
+	handler := plan.NewHandler(testLogger, filepath.Join(t.TempDir(), "plan.json"))
+
+	first := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1000},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1000, 1300, 1), newInterval(1300, 1600, 2)},
+	}
+	_, err := handler.MergePlan(first, time.Unix(1000, 0))
+	require.NoError(t, err)
+
+	second := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1100},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1000, 1300, 5)},
+	}
+	_, err = handler.MergePlan(second, time.Unix(1100, 0))
+	require.NoError(t, err)
+
+	stored, err := handler.ReadPlan()
+	require.NoError(t, err)
+	assert.Equal(t, [][3]float32{{1000, 1300, 5}, {1300, 1600, 2}}, intervalSpans(stored.OptimisationIntervals))
+	assert.EqualValues(t, 1000, stored.OptimisationIntervals[1].Provenance.OptimisationTimestamp.Seconds)
+}
+
+func TestArchiveEffectiveAt(t *testing.T) {
+	archive, err := plan.OpenArchive(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	for _, optimised := range []int64{1000, 2000, 3000} {
+		optPlan := plan.OptimisationPlan{
+			OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: optimised},
+			OptimisationIntervals: []plan.OptimisationInterval{newInterval(optimised, optimised+1000, float32(optimised))},
+		}
+		// each plan arrives a minute after it was optimised
+		require.NoError(t, archive.Add(optPlan, time.Unix(optimised+60, 0)))
+	}
+
+	archived, err := archive.EffectiveAt(time.Unix(2500, 0))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2000, archived.Plan.OptimisationTimestamp.Seconds)
+
+	// the plan optimised at 3000 had not been received yet
+	archived, err = archive.EffectiveAt(time.Unix(3030, 0))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2000, archived.Plan.OptimisationTimestamp.Seconds)
+
+	_, err = archive.EffectiveAt(time.Unix(1030, 0))
+	assert.ErrorIs(t, err, plan.ErrNoArchivedPlan)
+
+	plans, err := archive.List(time.Unix(1500, 0), time.Unix(3100, 0))
+	require.NoError(t, err)
+	require.Len(t, plans, 2)
+	assert.EqualValues(t, 2000, plans[0].Plan.OptimisationTimestamp.Seconds)
+}
+
+func TestArchiveKeepsPlansWithTheSameTimestamp(t *testing.T) {
+	archive, err := plan.OpenArchive(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	// merging an older plan keeps the stored optimisation timestamp
+	first := plan.OptimisationPlan{
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1000},
+		OptimisationIntervals: []plan.OptimisationInterval{newInterval(1000, 2000, 1)},
+	}
+	merged := first
+	merged.OptimisationIntervals = []plan.OptimisationInterval{newInterval(1000, 2000, 2)}
+
+	require.NoError(t, archive.Add(first, time.Unix(1060, 0)))
+	require.NoError(t, archive.Add(merged, time.Unix(1500, 0)))
+	require.NoError(t, archive.Add(merged, time.Unix(1500, 0)))
+
+	plans, err := archive.List(time.Time{}, time.Unix(2000, 0))
+	require.NoError(t, err)
+	require.Len(t, plans, 3)
+	assert.Equal(t, first, plans[0].Plan)
+
+	archived, err := archive.EffectiveAt(time.Unix(1400, 0))
+	require.NoError(t, err)
+	assert.Equal(t, first, archived.Plan)
+
+	archived, err = archive.EffectiveAt(time.Unix(1500, 0))
+	require.NoError(t, err)
+	assert.Equal(t, merged, archived.Plan)
+}
+
+func TestArchivePrunesExpiredPlans(t *testing.T) {
+	archive, err := plan.OpenArchive(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+
+	now := time.Unix(100000, 0)
+	old := plan.OptimisationPlan{OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: now.Add(-2 * time.Hour).Unix()}}
+	require.NoError(t, archive.Add(old, now.Add(-2*time.Hour)))
+
+	recent := plan.OptimisationPlan{OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: now.Unix()}}
+	require.NoError(t, archive.Add(recent, now))
+
+	plans, err := archive.List(time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+	assert.Equal(t, recent.OptimisationTimestamp, plans[0].Plan.OptimisationTimestamp)
+}
+
+func TestDiff(t *testing.T) {
+	oldPlan := plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{
+		newInterval(0, 300, 1),
+		newInterval(300, 600, 2),
+		newInterval(600, 900, 3),
+	}}
+	newPlan := plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{
+		newInterval(0, 300, 1),
+		newInterval(300, 900, 5),
+		newInterval(900, 1200, 6),
+	}}
+
+	diffs := plan.Diff(oldPlan, newPlan)
+	require.Len(t, diffs, 3)
+
+	assert.EqualValues(t, 300, diffs[0].Start.Unix())
+	assert.EqualValues(t, 600, diffs[0].End.Unix())
+	assert.Equal(t, float32(3), diffs[0].MeterPowerDelta)
+
+	assert.Equal(t, float32(2), diffs[1].MeterPowerDelta)
+
+	assert.EqualValues(t, 900, diffs[2].Start.Unix())
+	assert.Nil(t, diffs[2].Old)
+	assert.Equal(t, float32(6), diffs[2].MeterPowerDelta)
+
+	assert.Empty(t, plan.Diff(oldPlan, oldPlan))
+}
+
+func TestSetpointAt(t *testing.T) {
+	optPlan := plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{
+		newInterval(0, 600, -5),
+		newInterval(600, 1200, 5),
+		newInterval(1800, 2400, 10),
+	}}
+
+	tests := []struct {
+		name         string
+		interpolator plan.Interpolator
+		at           int64
+		expected     float32
+	}{
+		{"step", plan.Interpolator{Mode: plan.InterpolationStep}, 599, -5},
+		{"step after boundary", plan.Interpolator{Mode: plan.InterpolationStep}, 600, 5},
+		{"linear at midpoint", plan.Interpolator{Mode: plan.InterpolationLinear}, 300, -5},
+		{"linear at boundary", plan.Interpolator{Mode: plan.InterpolationLinear}, 600, 0},
+		{"linear between midpoints", plan.Interpolator{Mode: plan.InterpolationLinear}, 750, 2.5},
+		{"linear before a gap", plan.Interpolator{Mode: plan.InterpolationLinear}, 1100, 5},
+		{"ramp at boundary", plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 2}, 600, -5},
+		{"ramp part way", plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 2}, 750, 0},
+		{"ramp complete", plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 2}, 1000, 5},
+		{"ramp after a gap", plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 2}, 1800, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setpoint, err := optPlan.SetpointAt(time.Unix(tt.at, 0), tt.interpolator)
+			require.NoError(t, err)
+			assert.InDelta(t, tt.expected, setpoint.MeterPower.Value, 0.001)
+		})
+	}
+
+	_, err := optPlan.SetpointAt(time.Unix(1500, 0), plan.Interpolator{Mode: plan.InterpolationLinear})
+	assert.ErrorIs(t, err, plan.ErrNoCurrentInterval)
+}
+
+func TestSetpointAt_RampConvertsUnits(t *testing.T) {
+	previous := newInterval(0, 600, 0)
+	current := newInterval(600, 1200, 10000)
+	current.MeterPower.Unit = 1
+
+	optPlan := plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{previous, current}}
+
+	// 1 kW per minute for two minutes is 2000 W
+	setpoint, err := optPlan.SetpointAt(time.Unix(720, 0), plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 1})
+	require.NoError(t, err)
+	assert.InDelta(t, 2000, setpoint.MeterPower.Value, 0.001)
+}
+
+func TestInterpolatorValidate(t *testing.T) {
+	assert.NoError(t, plan.Interpolator{Mode: plan.InterpolationStep}.Validate())
+	assert.NoError(t, plan.Interpolator{Mode: plan.InterpolationRamp, RampRate: 1}.Validate())
+	assert.Error(t, plan.Interpolator{Mode: plan.InterpolationRamp}.Validate())
+	assert.Error(t, plan.Interpolator{Mode: "cubic"}.Validate())
+}
+
+func TestCompressionValidate(t *testing.T) {
+	assert.NoError(t, plan.CompressionNone.Validate())
+	assert.NoError(t, plan.CompressionZstd.Validate())
+	assert.NoError(t, plan.Compression("").Validate())
+	assert.Error(t, plan.Compression("brotli").Validate())
+}
+
+func TestHandlerCachesThePlan(t *testing.T) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	handler := plan.NewHandler(testLogger, planPath)
+
+	require.NoError(t, handler.WritePlan(plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{
+		newInterval(600, 900, 3),
+		newInterval(0, 300, 1),
+		newInterval(300, 600, 2),
+	}}))
+
+	// the plan continues to be served from memory if the file goes away
+	require.NoError(t, os.Remove(planPath))
+
+	intv, err := handler.GetCurrentInterval(time.Unix(450, 0))
+	require.NoError(t, err)
+	assert.Equal(t, float32(2), intv.MeterPower.Value)
+
+	_, err = handler.GetCurrentInterval(time.Unix(900, 0))
+	assert.ErrorIs(t, err, plan.ErrNoCurrentInterval)
+
+	// plans read back are sorted, and changing them doesn't change the cache
+	optPlan, err := handler.ReadPlan()
+	require.NoError(t, err)
+	assert.Equal(t, [][3]float32{{0, 300, 1}, {300, 600, 2}, {600, 900, 3}}, intervalSpans(optPlan.OptimisationIntervals))
+
+	optPlan.OptimisationIntervals[0].MeterPower.Value = 100
+	intv, err = handler.GetCurrentInterval(time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.Equal(t, float32(1), intv.MeterPower.Value)
+}
+
+func TestHandlerReloadsAChangedFile(t *testing.T) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	handler := plan.NewHandler(testLogger, planPath)
+
+	require.NoError(t, handler.WritePlan(plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{newInterval(0, 300, 1)}}))
+
+	// another process replaces the file
+	other := plan.NewHandler(testLogger, planPath)
+	require.NoError(t, other.WritePlan(plan.OptimisationPlan{OptimisationIntervals: []plan.OptimisationInterval{newInterval(0, 3000, 20)}}))
+
+	intv, err := handler.GetCurrentInterval(time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.Equal(t, float32(20), intv.MeterPower.Value)
+
+	// a corrupted file leaves the last good plan in use
+	require.NoError(t, os.WriteFile(planPath, []byte("not a plan"), 0o644))
+
+	intv, err = handler.GetCurrentInterval(time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.Equal(t, float32(20), intv.MeterPower.Value)
+}
+
+func TestTimestampJSON(t *testing.T) {
+	var ts plan.OptimisationTimestamp
+
+	require.NoError(t, json.Unmarshal([]byte(`{"seconds":1715319000,"nanos":250000000}`), &ts))
+	assert.Equal(t, plan.OptimisationTimestamp{Seconds: 1715319000, Nanos: 250000000}, ts)
+
+	encoded, err := json.Marshal(ts)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"seconds":1715319000,"nanos":250000000}`, string(encoded))
+
+	require.NoError(t, json.Unmarshal([]byte(`"2024-05-10T15:30:00.25+10:00"`), &ts))
+	assert.Equal(t, plan.OptimisationTimestamp{Seconds: 1715319000, Nanos: 250000000}, ts)
+	assert.True(t, ts.Time().Equal(time.Date(2024, 5, 10, 5, 30, 0, 250000000, time.UTC)))
+
+	assert.Equal(t, ts, plan.NewTimestamp(ts.Time()))
+	assert.Error(t, json.Unmarshal([]byte(`"10 May 2024"`), &ts))
+}
+
+func TestIsCurrent_HonoursNanos(t *testing.T) {
+	intv := plan.OptimisationInterval{Interval: plan.OptimisationIntervalTimestamp{
+		StartTime: plan.OptimisationTimestamp{Seconds: 100, Nanos: 500000000},
+		EndTime:   plan.OptimisationTimestamp{Seconds: 200, Nanos: 500000000},
+	}}
+
+	assert.False(t, intv.IsCurrent(time.Unix(100, 0)))
+	assert.True(t, intv.IsCurrent(time.Unix(100, 500000000)))
+	assert.True(t, intv.IsCurrent(time.Unix(200, 0)))
+	assert.False(t, intv.IsCurrent(time.Unix(200, 500000000)))
+}
+
+const testTariff = `
+charge_below: 0.15
+discharge_above: 0.40
+charge_power: 5
+discharge_power: 4
+seasons:
+  - name: summer
+    months: [12, 1, 2]
+    windows:
+      - {name: peak, days: weekday, start: "15:00", end: "21:00", import_price: 0.55, export_price: 0.08}
+      - {name: off-peak, start: "22:00", end: "07:00", import_price: 0.12, export_price: 0.05}
+  - name: rest of year
+    windows:
+      - {name: off-peak, start: "22:00", end: "07:00", import_price: 0.12, export_price: 0.05}
+`
+
+// siteZone is a site time zone other than the test machine's, so that the
+// tariff is shown to follow the zone it is loaded with.
+var siteZone = time.FixedZone("site", 10*60*60)
+
+func loadTestTariff(t *testing.T) *plan.Tariff {
+	path := filepath.Join(t.TempDir(), "tariff.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testTariff), 0o600))
+
+	tariff, err := plan.LoadTariff(path, siteZone)
+	require.NoError(t, err)
+
+	return tariff
+}
+
+func TestTariffIntervalAt(t *testing.T) {
+	tariff := loadTestTariff(t)
+
+	// A weekday in summer.
+	peak := tariff.IntervalAt(time.Date(2025, time.January, 15, 17, 0, 0, 0, siteZone))
+	assert.InDelta(t, -4, peak.MeterPower.Kilowatts(), 1e-6)
+	assert.InDelta(t, -4, peak.BatteryPower.Kilowatts(), 1e-6)
+	assert.Equal(t, time.Date(2025, time.January, 15, 15, 0, 0, 0, siteZone), peak.Interval.StartTime.Time().In(siteZone))
+	assert.Equal(t, time.Date(2025, time.January, 15, 21, 0, 0, 0, siteZone), peak.Interval.EndTime.Time().In(siteZone))
+
+	// Off-peak runs past midnight, but intervals stop there.
+	offPeak := tariff.IntervalAt(time.Date(2025, time.January, 15, 23, 0, 0, 0, siteZone))
+	assert.InDelta(t, 5, offPeak.MeterPower.Kilowatts(), 1e-6)
+	assert.Equal(t, time.Date(2025, time.January, 16, 0, 0, 0, 0, siteZone), offPeak.Interval.EndTime.Time().In(siteZone))
+
+	early := tariff.IntervalAt(time.Date(2025, time.January, 16, 3, 0, 0, 0, siteZone))
+	assert.InDelta(t, 5, early.MeterPower.Kilowatts(), 1e-6)
+	assert.Equal(t, time.Date(2025, time.January, 16, 7, 0, 0, 0, siteZone), early.Interval.EndTime.Time().In(siteZone))
+
+	// Outside any window the meter is held at zero.
+	shoulder := tariff.IntervalAt(time.Date(2025, time.January, 15, 10, 0, 0, 0, siteZone))
+	assert.Zero(t, shoulder.MeterPower.Value)
+	assert.Equal(t, time.Date(2025, time.January, 15, 7, 0, 0, 0, siteZone), shoulder.Interval.StartTime.Time().In(siteZone))
+	assert.Equal(t, time.Date(2025, time.January, 15, 15, 0, 0, 0, siteZone), shoulder.Interval.EndTime.Time().In(siteZone))
+
+	// No peak at the weekend, or outside summer.
+	weekend := tariff.IntervalAt(time.Date(2025, time.January, 18, 17, 0, 0, 0, siteZone))
+	assert.Zero(t, weekend.MeterPower.Value)
+	winter := tariff.IntervalAt(time.Date(2025, time.July, 16, 17, 0, 0, 0, siteZone))
+	assert.Zero(t, winter.MeterPower.Value)
+}
+
+func TestTariffIntervalAt_WhenClocksGoForwardAtMidnight(t *testing.T) {
+	santiago, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+
+	path := filepath.Join(t.TempDir(), "tariff.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testTariff), 0o600))
+	tariff, err := plan.LoadTariff(path, santiago)
+	require.NoError(t, err)
+
+	// 8 September 2024 starts at 01:00, so the day before ends at 23:00.
+	at := time.Date(2024, time.September, 7, 23, 30, 0, 0, santiago)
+
+	held := tariff.IntervalAt(at)
+	assert.Zero(t, held.MeterPower.Value)
+	assert.Zero(t, held.BatteryPower.Value)
+	assert.True(t, held.IsCurrent(at))
+}
+
+func TestTariffSchedule(t *testing.T) {
+	tariff := loadTestTariff(t)
+
+	from := time.Date(2025, time.January, 15, 12, 0, 0, 0, siteZone)
+	intervals := tariff.Schedule(from, from.Add(24*time.Hour))
+
+	var meterPower []float64
+	for i, intv := range intervals {
+		meterPower = append(meterPower, intv.MeterPower.Kilowatts())
+		if i > 0 {
+			assert.Equal(t, intervals[i-1].Interval.EndTime, intv.Interval.StartTime)
+		}
+	}
+
+	// Shoulder, peak, shoulder, off-peak to midnight, off-peak, shoulder.
+	assert.Equal(t, []float64{0, -4, 0, 5, 5, 0}, meterPower)
+	assert.Equal(t, from, intervals[0].Interval.StartTime.Time().In(siteZone))
+	assert.Equal(t, from.Add(24*time.Hour), intervals[len(intervals)-1].Interval.EndTime.Time().In(siteZone))
+}
+
+func TestTariffValidate(t *testing.T) {
+	tariff := plan.Tariff{
+		ChargeBelow:    0.1,
+		DischargeAbove: 0.4,
+		Seasons:        []plan.Season{{Windows: []plan.TariffWindow{{Name: "peak", Start: "25:00", End: "21:00"}}}},
+	}
+	assert.Error(t, tariff.Validate())
+
+	tariff.Seasons[0].Windows[0].Start = "15:00"
+	tariff.Seasons[0].Windows[0].Days = "holidays"
+	assert.Error(t, tariff.Validate())
+
+	tariff.Seasons[0].Windows[0].Days = ""
+	assert.NoError(t, tariff.Validate())
+	assert.Equal(t, plan.DaysAll, tariff.Seasons[0].Windows[0].Days)
+
+	tariff.ChargeBelow = 0.5
+	assert.Error(t, tariff.Validate())
+}
@@ -0,0 +1,312 @@
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the messages in plan.proto.
+const (
+	fieldTimestampSeconds = 1
+	fieldTimestampNanos   = 2
+
+	fieldValueValue = 1
+	fieldValueUnit  = 2
+
+	fieldIntervalStart = 1
+	fieldIntervalEnd   = 2
+
+	fieldIntervalTimestamp     = 1
+	fieldIntervalBatteryPower  = 2
+	fieldIntervalStateOfCharge = 3
+	fieldIntervalMeterPower    = 4
+
+	fieldPlanSiteID                = 1
+	fieldPlanOptimisationTimestamp = 2
+	fieldPlanOptimisationIntervals = 3
+	fieldPlanSetpointType          = 4
+	fieldPlanReplace               = 5
+)
+
+// unknownField is returned by a field decoder for fields it does not know.
+const unknownField = -1
+
+var errWrongWireType = errors.New("unexpected wire type")
+
+// Format is the encoding of a plan payload.
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatProtobuf Format = "protobuf"
+)
+
+// Decode decodes a plan payload in the given format.
+func Decode(payload []byte, format Format) (OptimisationPlan, error) {
+	if format == FormatProtobuf {
+		return UnmarshalProto(payload)
+	}
+
+	optPlan := OptimisationPlan{}
+	if err := json.Unmarshal(payload, &optPlan); err != nil {
+		return OptimisationPlan{}, fmt.Errorf("decoding json plan: %w", err)
+	}
+	return optPlan, nil
+}
+
+// UnmarshalProto decodes a plan encoded in the binary protobuf format of plan.proto.
+// Unknown fields are skipped, so that plans from newer schemas can still be read.
+func UnmarshalProto(data []byte) (OptimisationPlan, error) {
+	var optPlan OptimisationPlan
+
+	err := consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) (int, error) {
+		switch num {
+		case fieldPlanSiteID:
+			s, n, err := consumeBytes(value, typ)
+			optPlan.SiteID = string(s)
+			return n, err
+		case fieldPlanOptimisationTimestamp:
+			return consumeNested(value, typ, func(b []byte) error {
+				return unmarshalTimestamp(b, &optPlan.OptimisationTimestamp)
+			})
+		case fieldPlanOptimisationIntervals:
+			return consumeNested(value, typ, func(b []byte) error {
+				var intv OptimisationInterval
+				if err := unmarshalInterval(b, &intv); err != nil {
+					return err
+				}
+				optPlan.OptimisationIntervals = append(optPlan.OptimisationIntervals, intv)
+				return nil
+			})
+		case fieldPlanSetpointType:
+			v, n, err := consumeVarint(value, typ)
+			optPlan.SetpointType = int(int32(v))
+			return n, err
+		case fieldPlanReplace:
+			v, n, err := consumeVarint(value, typ)
+			optPlan.Replace = v != 0
+			return n, err
+		}
+		return unknownField, nil
+	})
+	if err != nil {
+		return OptimisationPlan{}, fmt.Errorf("decoding protobuf plan: %w", err)
+	}
+
+	return optPlan, nil
+}
+
+// MarshalProto encodes the plan in the binary protobuf format of plan.proto.
+func (o OptimisationPlan) MarshalProto() []byte {
+	var b []byte
+
+	if o.SiteID != "" {
+		b = protowire.AppendTag(b, fieldPlanSiteID, protowire.BytesType)
+		b = protowire.AppendString(b, o.SiteID)
+	}
+
+	b = appendNested(b, fieldPlanOptimisationTimestamp, marshalTimestamp(o.OptimisationTimestamp))
+
+	for _, intv := range o.OptimisationIntervals {
+		b = protowire.AppendTag(b, fieldPlanOptimisationIntervals, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalInterval(intv))
+	}
+
+	if o.SetpointType != 0 {
+		b = protowire.AppendTag(b, fieldPlanSetpointType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(o.SetpointType)))
+	}
+
+	if o.Replace {
+		b = protowire.AppendTag(b, fieldPlanReplace, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+
+	return b
+}
+
+func unmarshalInterval(data []byte, intv *OptimisationInterval) error {
+	return consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) (int, error) {
+		switch num {
+		case fieldIntervalTimestamp:
+			return consumeNested(value, typ, func(b []byte) error { return unmarshalIntervalTimestamp(b, &intv.Interval) })
+		case fieldIntervalBatteryPower:
+			return consumeNested(value, typ, func(b []byte) error { return unmarshalValue(b, &intv.BatteryPower) })
+		case fieldIntervalStateOfCharge:
+			v, n, err := consumeFloat(value, typ)
+			intv.StateOfCharge = v
+			return n, err
+		case fieldIntervalMeterPower:
+			return consumeNested(value, typ, func(b []byte) error { return unmarshalValue(b, &intv.MeterPower) })
+		}
+		return unknownField, nil
+	})
+}
+
+func unmarshalIntervalTimestamp(data []byte, ts *OptimisationIntervalTimestamp) error {
+	return consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) (int, error) {
+		switch num {
+		case fieldIntervalStart:
+			return consumeNested(value, typ, func(b []byte) error { return unmarshalTimestamp(b, &ts.StartTime) })
+		case fieldIntervalEnd:
+			return consumeNested(value, typ, func(b []byte) error { return unmarshalTimestamp(b, &ts.EndTime) })
+		}
+		return unknownField, nil
+	})
+}
+
+func marshalInterval(intv OptimisationInterval) []byte {
+	var timestamps []byte
+	timestamps = appendNested(timestamps, fieldIntervalStart, marshalTimestamp(intv.Interval.StartTime))
+	timestamps = appendNested(timestamps, fieldIntervalEnd, marshalTimestamp(intv.Interval.EndTime))
+
+	var b []byte
+	b = appendNested(b, fieldIntervalTimestamp, timestamps)
+	b = appendNested(b, fieldIntervalBatteryPower, marshalValue(intv.BatteryPower))
+
+	if intv.StateOfCharge != 0 {
+		b = protowire.AppendTag(b, fieldIntervalStateOfCharge, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(intv.StateOfCharge))
+	}
+
+	b = appendNested(b, fieldIntervalMeterPower, marshalValue(intv.MeterPower))
+
+	return b
+}
+
+func unmarshalTimestamp(data []byte, ts *OptimisationTimestamp) error {
+	return consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) (int, error) {
+		switch num {
+		case fieldTimestampSeconds:
+			v, n, err := consumeVarint(value, typ)
+			ts.Seconds = int64(v)
+			return n, err
+		case fieldTimestampNanos:
+			v, n, err := consumeVarint(value, typ)
+			ts.Nanos = int64(int32(v))
+			return n, err
+		}
+		return unknownField, nil
+	})
+}
+
+func marshalTimestamp(ts OptimisationTimestamp) []byte {
+	var b []byte
+
+	if ts.Seconds != 0 {
+		b = protowire.AppendTag(b, fieldTimestampSeconds, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ts.Seconds))
+	}
+	if ts.Nanos != 0 {
+		b = protowire.AppendTag(b, fieldTimestampNanos, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(int32(ts.Nanos))))
+	}
+
+	return b
+}
+
+func unmarshalValue(data []byte, val *OptimisationValue) error {
+	return consumeMessage(data, func(num protowire.Number, typ protowire.Type, value []byte) (int, error) {
+		switch num {
+		case fieldValueValue:
+			v, n, err := consumeFloat(value, typ)
+			val.Value = v
+			return n, err
+		case fieldValueUnit:
+			v, n, err := consumeVarint(value, typ)
+			val.Unit = int(int32(v))
+			return n, err
+		}
+		return unknownField, nil
+	})
+}
+
+func marshalValue(val OptimisationValue) []byte {
+	var b []byte
+
+	if val.Value != 0 {
+		b = protowire.AppendTag(b, fieldValueValue, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(val.Value))
+	}
+	if val.Unit != 0 {
+		b = protowire.AppendTag(b, fieldValueUnit, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(val.Unit)))
+	}
+
+	return b
+}
+
+// appendNested appends a message field, omitting it if the message is empty.
+func appendNested(b []byte, num protowire.Number, msg []byte) []byte {
+	if len(msg) == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// consumeMessage calls field for each field in data, with the bytes following
+// its tag. field returns how many of those bytes the value used, or unknownField if it
+// does not know the field, in which case the value is skipped.
+func consumeMessage(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n, err := field(num, typ, data)
+		if err != nil {
+			return fmt.Errorf("field %d: %w", num, err)
+		}
+		if n == unknownField {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// consumeNested decodes an embedded message with fn.
+func consumeNested(data []byte, typ protowire.Type, fn func([]byte) error) (int, error) {
+	msg, n, err := consumeBytes(data, typ)
+	if err != nil {
+		return n, err
+	}
+	return n, fn(msg)
+}
+
+func consumeBytes(data []byte, typ protowire.Type) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeBytes(data)
+	return v, n, protowire.ParseError(n)
+}
+
+func consumeVarint(data []byte, typ protowire.Type) (uint64, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeVarint(data)
+	return v, n, protowire.ParseError(n)
+}
+
+func consumeFloat(data []byte, typ protowire.Type) (float32, int, error) {
+	if typ != protowire.Fixed32Type {
+		return 0, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeFixed32(data)
+	return math.Float32frombits(v), n, protowire.ParseError(n)
+}
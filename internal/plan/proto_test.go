@@ -0,0 +1,182 @@
+package plan_test
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// samplePlan sets every field of plan.proto, as JSON with the schema's field names.
+const samplePlan = `{
+	"site_id": "test-site",
+	"optimisation_timestamp": {"seconds": 1715318000, "nanos": 5},
+	"optimisation_intervals": [{
+		"optimisation_interval": {"start_time": {"seconds": 1715319000, "nanos": 1}, "end_time": {"seconds": 1715319900, "nanos": 2}},
+		"battery_power": {"value": 100, "unit": 2},
+		"state_of_charge": 0.5,
+		"meter_power": {"value": -400, "unit": 1}
+	}],
+	"setpoint_type": 1,
+	"replace": true
+}`
+
+// loadPlanSchema builds the descriptor of OptimisationPlan from plan.proto,
+// which holds only top-level messages and enums with scalar, enum, message
+// and repeated fields.
+func loadPlanSchema(t *testing.T) protoreflect.MessageDescriptor {
+	file, err := os.Open("plan.proto")
+	require.NoError(t, err)
+	defer file.Close()
+
+	scalarTypes := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+		"float":  descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	}
+
+	fileProto := &descriptorpb.FileDescriptorProto{Name: proto.String("plan.proto"), Syntax: proto.String("proto3")}
+	enums := map[string]bool{}
+
+	var (
+		message *descriptorpb.DescriptorProto
+		enum    *descriptorpb.EnumDescriptorProto
+	)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		words := strings.Fields(strings.NewReplacer(";", " ", "=", " = ").Replace(line))
+
+		switch {
+		case len(words) == 0:
+		case words[0] == "package":
+			fileProto.Package = proto.String(words[1])
+		case words[0] == "message":
+			message = &descriptorpb.DescriptorProto{Name: proto.String(words[1])}
+			fileProto.MessageType = append(fileProto.MessageType, message)
+		case words[0] == "enum":
+			enum = &descriptorpb.EnumDescriptorProto{Name: proto.String(words[1])}
+			fileProto.EnumType = append(fileProto.EnumType, enum)
+			enums[words[1]] = true
+		case words[0] == "}":
+			message, enum = nil, nil
+		case enum != nil:
+			number, err := strconv.ParseInt(words[2], 10, 32)
+			require.NoError(t, err, line)
+			enum.Value = append(enum.Value, &descriptorpb.EnumValueDescriptorProto{Name: proto.String(words[0]), Number: proto.Int32(int32(number))})
+		case message != nil:
+			label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+			if words[0] == "repeated" {
+				label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+				words = words[1:]
+			}
+			require.Len(t, words, 4, line)
+
+			number, err := strconv.ParseInt(words[3], 10, 32)
+			require.NoError(t, err, line)
+
+			field := &descriptorpb.FieldDescriptorProto{Name: proto.String(words[1]), Number: proto.Int32(int32(number)), Label: label.Enum()}
+			if typ, ok := scalarTypes[words[0]]; ok {
+				field.Type = typ.Enum()
+			} else {
+				field.TypeName = proto.String("." + fileProto.GetPackage() + "." + words[0])
+			}
+			message.Field = append(message.Field, field)
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	for _, message := range fileProto.MessageType {
+		for _, field := range message.Field {
+			if field.Type != nil {
+				continue
+			}
+			if enums[field.GetTypeName()[len(fileProto.GetPackage())+2:]] {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum()
+			} else {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+			}
+		}
+	}
+
+	fileDesc, err := protodesc.NewFile(fileProto, nil)
+	require.NoError(t, err)
+
+	planDesc := fileDesc.Messages().ByName("OptimisationPlan")
+	require.NotNil(t, planDesc)
+
+	return planDesc
+}
+
+// assertAllFieldsSet checks that the sample covers every field in the schema,
+// so that a field added to plan.proto must be added to the sample too.
+func assertAllFieldsSet(t *testing.T, msg protoreflect.Message) {
+	fields := msg.Descriptor().Fields()
+	for i := range fields.Len() {
+		field := fields.Get(i)
+		if !assert.True(t, msg.Has(field), "%s is not set in the sample plan", field.FullName()) {
+			continue
+		}
+
+		switch {
+		case field.IsList() && field.Message() != nil:
+			list := msg.Get(field).List()
+			for j := range list.Len() {
+				assertAllFieldsSet(t, list.Get(j).Message())
+			}
+		case field.Message() != nil:
+			assertAllFieldsSet(t, msg.Get(field).Message())
+		}
+	}
+}
+
+// TestProtoCodecMatchesSchema checks the hand-written codec in proto.go
+// against the schema in plan.proto, in both directions.
+func TestProtoCodecMatchesSchema(t *testing.T) {
+	planDesc := loadPlanSchema(t)
+
+	sample := dynamicpb.NewMessage(planDesc)
+	require.NoError(t, protojson.Unmarshal([]byte(samplePlan), sample))
+	assertAllFieldsSet(t, sample)
+
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(sample)
+	require.NoError(t, err)
+
+	decoded, err := plan.UnmarshalProto(encoded)
+	require.NoError(t, err)
+
+	expected := plan.OptimisationPlan{
+		SiteID:                "test-site",
+		OptimisationTimestamp: plan.OptimisationTimestamp{Seconds: 1715318000, Nanos: 5},
+		OptimisationIntervals: []plan.OptimisationInterval{{
+			Interval: plan.OptimisationIntervalTimestamp{
+				StartTime: plan.OptimisationTimestamp{Seconds: 1715319000, Nanos: 1},
+				EndTime:   plan.OptimisationTimestamp{Seconds: 1715319900, Nanos: 2},
+			},
+			BatteryPower:  plan.OptimisationValue{Value: 100, Unit: 2},
+			StateOfCharge: 0.5,
+			MeterPower:    plan.OptimisationValue{Value: -400, Unit: 1},
+		}},
+		SetpointType: 1,
+		Replace:      true,
+	}
+	assert.Equal(t, expected, decoded)
+
+	reencoded := dynamicpb.NewMessage(planDesc)
+	require.NoError(t, proto.Unmarshal(expected.MarshalProto(), reencoded))
+	assert.True(t, proto.Equal(sample, reencoded), "MarshalProto does not match plan.proto")
+}
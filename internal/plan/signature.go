@@ -0,0 +1,153 @@
+package plan
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AlgEdDSA is the JWS algorithm of Ed25519 signatures, from RFC 8037.
+const AlgEdDSA = "EdDSA"
+
+var (
+	ErrUnsigned         = errors.New("plan is not signed")
+	ErrUnknownKey       = errors.New("plan is signed with an unknown key")
+	ErrInvalidSignature = errors.New("plan signature is invalid")
+	ErrWrongSite        = errors.New("plan is for another site")
+	ErrNotNewer         = errors.New("plan is not newer than the last plan accepted")
+)
+
+var jwsEncoding = base64.RawURLEncoding
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verifier checks the signatures of plans against a set of trusted Ed25519
+// public keys. Each key has an ID, so that keys can be rotated by trusting the
+// new key alongside the old one until every plan is signed with the new key.
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a verifier that trusts the given keys, each written as
+// its ID and its base64 encoded Ed25519 public key, separated by a colon.
+func NewVerifier(keys []string) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string]ed25519.PublicKey, len(keys))}
+
+	for _, key := range keys {
+		id, publicKey, err := ParsePublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := v.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate plan key %q", id)
+		}
+		v.keys[id] = publicKey
+	}
+
+	if len(v.keys) == 0 {
+		return nil, errors.New("no plan keys")
+	}
+
+	return v, nil
+}
+
+// ParsePublicKey parses a key written as "<id>:<base64 Ed25519 public key>".
+func ParsePublicKey(key string) (string, ed25519.PublicKey, error) {
+	id, encoded, found := strings.Cut(key, ":")
+	if !found || id == "" {
+		return "", nil, fmt.Errorf("plan key must be <id>:<base64 public key>")
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding plan key %q: %w", id, err)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("plan key %q is %d bytes, not an Ed25519 public key", id, len(publicKey))
+	}
+
+	return id, ed25519.PublicKey(publicKey), nil
+}
+
+// Verify checks a plan signed as a JWS in compact serialisation, with the EdDSA
+// algorithm and the ID of the signing key in its kid header, and returns the
+// signed payload. The payload is the plan as it would be published unsigned,
+// in either format and optionally compressed.
+func (v *Verifier) Verify(signed []byte) ([]byte, error) {
+	parts := bytes.Split(signed, []byte("."))
+	if len(parts) != 3 {
+		return nil, ErrUnsigned
+	}
+
+	var header jwsHeader
+
+	encodedHeader, err := jwsEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, ErrUnsigned
+	}
+	if err := json.Unmarshal(encodedHeader, &header); err != nil {
+		return nil, ErrUnsigned
+	}
+
+	if header.Alg != AlgEdDSA {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, header.Alg)
+	}
+
+	publicKey, exists := v.keys[header.Kid]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, header.Kid)
+	}
+
+	signature, err := jwsEncoding.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding signature: %w", ErrInvalidSignature, err)
+	}
+
+	signingInput := signed[:len(parts[0])+1+len(parts[1])]
+	if !ed25519.Verify(publicKey, signingInput, signature) {
+		return nil, fmt.Errorf("%w: key %q", ErrInvalidSignature, header.Kid)
+	}
+
+	payload, err := jwsEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %w", ErrInvalidSignature, err)
+	}
+
+	return payload, nil
+}
+
+// CheckFresh rejects a plan for another site, or one whose optimisation
+// timestamp is not newer than that of the last plan accepted. A signature
+// only shows that the cloud published a plan at some point, so without this
+// check any validly signed plan could be replayed later.
+func CheckFresh(optPlan OptimisationPlan, siteID string, lastAccepted OptimisationTimestamp) error {
+	if optPlan.SiteID != siteID {
+		return fmt.Errorf("%w: %q, not %q", ErrWrongSite, optPlan.SiteID, siteID)
+	}
+	if !optPlan.OptimisationTimestamp.after(lastAccepted) {
+		return fmt.Errorf("%w: optimised at %s, last accepted plan at %s", ErrNotNewer,
+			optPlan.OptimisationTimestamp.Time().Format(time.RFC3339Nano), lastAccepted.Time().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// Sign signs a plan payload as Verify expects, with the key of the given ID.
+func Sign(payload []byte, keyID string, privateKey ed25519.PrivateKey) ([]byte, error) {
+	header, err := json.Marshal(jwsHeader{Alg: AlgEdDSA, Kid: keyID})
+	if err != nil {
+		return nil, fmt.Errorf("encoding signature header: %w", err)
+	}
+
+	signingInput := jwsEncoding.EncodeToString(header) + "." + jwsEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(privateKey, []byte(signingInput))
+
+	return []byte(signingInput + "." + jwsEncoding.EncodeToString(signature)), nil
+}
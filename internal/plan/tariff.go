@@ -0,0 +1,266 @@
+package plan
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Days a tariff window applies on.
+const (
+	DaysAll     = "all"
+	DaysWeekday = "weekday"
+	DaysWeekend = "weekend"
+)
+
+// Tariff is a site's time-of-use tariff, and the rules for scheduling the
+// battery from it. The battery charges from the grid at ChargePower kW in
+// windows whose import price is at or below ChargeBelow, and discharges at
+// DischargePower kW in windows whose import or export price is at or above
+// DischargeAbove. Otherwise the meter is held at zero. Prices are per kWh.
+type Tariff struct {
+	Seasons        []Season `yaml:"seasons"`
+	ChargeBelow    float64  `yaml:"charge_below"`
+	DischargeAbove float64  `yaml:"discharge_above"`
+	ChargePower    float64  `yaml:"charge_power"`
+	DischargePower float64  `yaml:"discharge_power"`
+
+	// location is the site's time zone, which windows are in. Without one,
+	// the local time zone is used.
+	location *time.Location
+}
+
+// Season is the set of tariff windows that applies in some months of the
+// year, or all year if Months is empty.
+type Season struct {
+	Name    string         `yaml:"name"`
+	Months  []time.Month   `yaml:"months"`
+	Windows []TariffWindow `yaml:"windows"`
+}
+
+// TariffWindow is a time of day, from Start to End as HH:MM in the site's
+// time zone, with its prices. A window ending at or before its start runs
+// past midnight. Days is all, weekday or weekend, and is judged by the day
+// at each moment of the window. Where windows overlap, the first one listed
+// applies.
+type TariffWindow struct {
+	Name        string  `yaml:"name"`
+	Days        string  `yaml:"days"`
+	Start       string  `yaml:"start"`
+	End         string  `yaml:"end"`
+	ImportPrice float64 `yaml:"import_price"`
+	ExportPrice float64 `yaml:"export_price"`
+
+	start, end time.Duration
+}
+
+// LoadTariff reads a tariff from a YAML or JSON file, with its windows in the
+// given time zone.
+func LoadTariff(path string, location *time.Location) (*Tariff, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading tariff: %w", err)
+	}
+
+	var tariff Tariff
+	if err := yaml.Unmarshal(data, &tariff); err != nil {
+		return nil, fmt.Errorf("parsing tariff: %w", err)
+	}
+
+	if err := tariff.Validate(); err != nil {
+		return nil, err
+	}
+	tariff.location = location
+
+	return &tariff, nil
+}
+
+// Validate checks the tariff's windows, and parses their times of day.
+func (t *Tariff) Validate() error {
+	for i := range t.Seasons {
+		season := &t.Seasons[i]
+
+		for _, month := range season.Months {
+			if month < time.January || month > time.December {
+				return fmt.Errorf("season %q: invalid month %d", season.Name, month)
+			}
+		}
+
+		for j := range season.Windows {
+			window := &season.Windows[j]
+
+			switch window.Days {
+			case "":
+				window.Days = DaysAll
+			case DaysAll, DaysWeekday, DaysWeekend:
+			default:
+				return fmt.Errorf("window %q: unknown days %q", window.Name, window.Days)
+			}
+
+			var err error
+			if window.start, err = parseTimeOfDay(window.Start); err != nil {
+				return fmt.Errorf("window %q: start: %w", window.Name, err)
+			}
+			if window.end, err = parseTimeOfDay(window.End); err != nil {
+				return fmt.Errorf("window %q: end: %w", window.Name, err)
+			}
+		}
+	}
+
+	if t.ChargeBelow >= t.DischargeAbove {
+		return fmt.Errorf("charge_below (%g) must be less than discharge_above (%g)", t.ChargeBelow, t.DischargeAbove)
+	}
+
+	return nil
+}
+
+// WindowAt returns the tariff window that applies at a time, if any.
+func (t *Tariff) WindowAt(at time.Time) (TariffWindow, bool) {
+	local := at.In(t.timeZone())
+	month := local.Month()
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	weekend := local.Weekday() == time.Saturday || local.Weekday() == time.Sunday
+
+	for _, season := range t.Seasons {
+		if len(season.Months) > 0 && !slices.Contains(season.Months, month) {
+			continue
+		}
+
+		for _, window := range season.Windows {
+			if (window.Days == DaysWeekday && weekend) || (window.Days == DaysWeekend && !weekend) {
+				continue
+			}
+			if window.contains(sinceMidnight) {
+				return window, true
+			}
+		}
+	}
+
+	return TariffWindow{}, false
+}
+
+// Schedule generates synthetic plan intervals from the tariff, covering from
+// to to. Each interval runs for as long as the same setpoint applies, and no
+// interval spans midnight, where the season or days may change.
+func (t *Tariff) Schedule(from, to time.Time) []OptimisationInterval {
+	boundaries := []time.Time{from, to}
+
+	for day := t.midnight(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		boundaries = append(boundaries, day)
+		for _, season := range t.Seasons {
+			for _, window := range season.Windows {
+				boundaries = append(boundaries, atTimeOfDay(day, window.start), atTimeOfDay(day, window.end))
+			}
+		}
+	}
+
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	var intervals []OptimisationInterval
+
+	for i := 1; i < len(boundaries); i++ {
+		start, end := boundaries[i-1], boundaries[i]
+		if start.Before(from) || end.After(to) || !start.Before(end) {
+			continue
+		}
+
+		intv := t.intervalAt(start)
+		intv.Interval = OptimisationIntervalTimestamp{StartTime: NewTimestamp(start), EndTime: NewTimestamp(end)}
+
+		// Extend the previous interval if the setpoint continues, up to midnight.
+		if n := len(intervals); n > 0 && !start.Equal(t.midnight(start)) && sameSetpoints(&intervals[n-1], &intv) {
+			intervals[n-1].Interval.EndTime = intv.Interval.EndTime
+			continue
+		}
+
+		intervals = append(intervals, intv)
+	}
+
+	return intervals
+}
+
+// IntervalAt returns the synthetic interval current at a time.
+func (t *Tariff) IntervalAt(at time.Time) OptimisationInterval {
+	day := t.midnight(at)
+	intervals := t.Schedule(day, day.AddDate(0, 0, 1))
+
+	// Where the clocks go forward at midnight, the day's schedule ends early,
+	// so the meter is held at zero until the next day's schedule starts.
+	i := currentIndex(intervals, at)
+	if i < 0 {
+		start := at.Truncate(time.Minute)
+		return OptimisationInterval{
+			Interval:     OptimisationIntervalTimestamp{StartTime: NewTimestamp(start), EndTime: NewTimestamp(start.Add(time.Minute))},
+			MeterPower:   OptimisationValue{Unit: UnitKilowatt},
+			BatteryPower: OptimisationValue{Unit: UnitKilowatt},
+		}
+	}
+
+	return intervals[i]
+}
+
+// intervalAt returns the setpoints the tariff gives at a time.
+func (t *Tariff) intervalAt(at time.Time) OptimisationInterval {
+	var power float64
+
+	if window, ok := t.WindowAt(at); ok {
+		switch {
+		case window.ImportPrice <= t.ChargeBelow:
+			power = t.ChargePower
+		case window.ImportPrice >= t.DischargeAbove || window.ExportPrice >= t.DischargeAbove:
+			power = -t.DischargePower
+		}
+	}
+
+	return OptimisationInterval{
+		MeterPower:   OptimisationValue{Value: float32(power), Unit: UnitKilowatt},
+		BatteryPower: OptimisationValue{Value: float32(power), Unit: UnitKilowatt},
+	}
+}
+
+func (w TariffWindow) contains(sinceMidnight time.Duration) bool {
+	if w.end <= w.start {
+		return sinceMidnight >= w.start || sinceMidnight < w.end
+	}
+	return sinceMidnight >= w.start && sinceMidnight < w.end
+}
+
+// parseTimeOfDay parses HH:MM, allowing 24:00 for the end of the day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("parsing %q as HH:MM: %w", value, err)
+	}
+
+	sinceMidnight := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	if hours < 0 || minutes < 0 || minutes > 59 || sinceMidnight > 24*time.Hour {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	return sinceMidnight, nil
+}
+
+// timeZone returns the time zone the tariff's windows are in.
+func (t *Tariff) timeZone() *time.Location {
+	if t.location == nil {
+		return time.Local
+	}
+	return t.location
+}
+
+// midnight returns the start of the day of a time, in the tariff's time zone.
+func (t *Tariff) midnight(at time.Time) time.Time {
+	year, month, day := at.In(t.timeZone()).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.timeZone())
+}
+
+// atTimeOfDay returns the time of day on the day starting at midnight, going
+// by the clock so that days with a daylight saving change are handled.
+func atTimeOfDay(day time.Time, sinceMidnight time.Duration) time.Time {
+	year, month, date := day.Date()
+	return time.Date(year, month, date, 0, int(sinceMidnight.Minutes()), 0, 0, day.Location())
+}
@@ -0,0 +1,67 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// NewTimestamp converts a time to a plan timestamp.
+func NewTimestamp(t time.Time) OptimisationTimestamp {
+	return OptimisationTimestamp{Seconds: t.Unix(), Nanos: int64(t.Nanosecond())}
+}
+
+// Time returns the timestamp as a time in the local time zone.
+func (t OptimisationTimestamp) Time() time.Time {
+	return time.Unix(t.Seconds, t.Nanos)
+}
+
+// String formats the timestamp as RFC 3339 in the local time zone.
+func (t OptimisationTimestamp) String() string {
+	return t.Format(time.Local)
+}
+
+// Format formats the timestamp as RFC 3339 in the given time zone.
+func (t OptimisationTimestamp) Format(location *time.Location) string {
+	return t.Time().In(location).Format(time.RFC3339Nano)
+}
+
+// UnmarshalJSON accepts both the object form, with seconds and nanos, and an
+// RFC 3339 string, which is how protobuf JSON represents a Timestamp. Plans
+// are always marshalled in the object form.
+func (t *OptimisationTimestamp) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("parsing timestamp: %w", err)
+		}
+
+		*t = NewTimestamp(parsed)
+		return nil
+	}
+
+	// The alias has the same fields without this method.
+	type object OptimisationTimestamp
+
+	var o object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
+	}
+
+	*t = OptimisationTimestamp(o)
+	return nil
+}
+
+func (t OptimisationTimestamp) after(other OptimisationTimestamp) bool {
+	return t.Time().After(other.Time())
+}
+
+func (t OptimisationTimestamp) before(other OptimisationTimestamp) bool {
+	return t.Time().Before(other.Time())
+}
@@ -0,0 +1,259 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/modbus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// CommandSink delivers commands to the site.
+type CommandSink interface {
+	Name() string
+	Send(commands []CommandPayload) error
+}
+
+// SinkResult is the outcome of sending a command to one command sink. A nil
+// Err means the sink accepted the command.
+type SinkResult struct {
+	Sink string
+	Err  error
+}
+
+// Delivery is the outcome of sending a command to each command sink, in order.
+type Delivery []SinkResult
+
+// Delivered returns the names of the sinks that accepted the command.
+func (d Delivery) Delivered() []string {
+	delivered := []string{}
+	for _, result := range d {
+		if result.Err == nil {
+			delivered = append(delivered, result.Sink)
+		}
+	}
+	return delivered
+}
+
+// Err returns the errors of the sinks that failed together, or nil if every
+// sink accepted the command.
+func (d Delivery) Err() error {
+	var errs []error
+	for _, result := range d {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s output: %w", result.Sink, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LogFormat returns the outputs the command was delivered to and those that
+// failed as fields for the outage log.
+func (d Delivery) LogFormat() map[string]string {
+	failed := []string{}
+	for _, result := range d {
+		if result.Err != nil {
+			failed = append(failed, result.Sink)
+		}
+	}
+
+	fields := map[string]string{"deliveredTo": strings.Join(d.Delivered(), ",")}
+	if len(failed) > 0 {
+		fields["failedOutputs"] = strings.Join(failed, ",")
+	}
+	return fields
+}
+
+// NewCommandSinks creates a sink for each output enabled in the configuration, in order.
+func NewCommandSinks(cfg config.Config, mqttClient mqtt.Client) ([]CommandSink, error) {
+	sinks := []CommandSink{}
+
+	for _, output := range cfg.Outputs.Enabled {
+		switch output {
+		case config.OutputMQTT:
+			if cfg.MQTT.WriteCommandTopic == "" {
+				return nil, fmt.Errorf("mqtt output enabled without a write command topic")
+			}
+			sinks = append(sinks, NewMQTTCommandSink(mqttClient, cfg.MQTT.WriteCommandTopic))
+		case config.OutputHTTP:
+			if cfg.Outputs.HTTP.URL == "" {
+				return nil, fmt.Errorf("http output enabled without a url")
+			}
+			sinks = append(sinks, NewHTTPCommandSink(cfg.Outputs.HTTP.URL, &http.Client{Timeout: cfg.Outputs.HTTP.Timeout}))
+		case config.OutputModbus:
+			modbusCfg := cfg.Outputs.Modbus
+			if modbusCfg.Address == "" {
+				return nil, fmt.Errorf("modbus output enabled without an address")
+			}
+
+			switch modbusCfg.Quantity {
+			case config.QuantityBatteryPower, config.QuantityMeterPower:
+			default:
+				return nil, fmt.Errorf("modbus output has unknown quantity %q", modbusCfg.Quantity)
+			}
+
+			register := modbus.Register{
+				UnitID:    modbusCfg.UnitID,
+				Address:   modbusCfg.Register,
+				DataType:  modbus.DataType(modbusCfg.DataType),
+				ByteOrder: modbus.ByteOrder(modbusCfg.ByteOrder),
+				Scale:     modbusCfg.Scale,
+			}
+			if err := register.Validate(); err != nil {
+				return nil, fmt.Errorf("modbus output register: %w", err)
+			}
+
+			sinks = append(sinks, NewModbusCommandSink(modbus.NewClient(modbusCfg.Address, modbusCfg.Timeout), register, modbusCfg.Quantity, modbusCfg.Verify))
+		case config.OutputFile:
+			sinks = append(sinks, NewFileCommandSink(cfg.Outputs.File.Path))
+		default:
+			return nil, fmt.Errorf("unknown output %q", output)
+		}
+	}
+
+	return sinks, nil
+}
+
+// MQTTCommandSink publishes commands to the commands handler over MQTT.
+type MQTTCommandSink struct {
+	mqttClient mqtt.Client
+	topic      string
+}
+
+func NewMQTTCommandSink(mqttClient mqtt.Client, topic string) *MQTTCommandSink {
+	return &MQTTCommandSink{mqttClient: mqttClient, topic: topic}
+}
+
+func (m *MQTTCommandSink) Name() string {
+	return config.OutputMQTT
+}
+
+func (m *MQTTCommandSink) Send(commands []CommandPayload) error {
+	encPayload, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("marshalling command payload: %w", err)
+	}
+
+	m.mqttClient.Publish(m.topic, 1, false, encPayload)
+	return nil
+}
+
+// HTTPCommandSink POSTs commands as JSON to a webhook, such as a local site controller.
+type HTTPCommandSink struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewHTTPCommandSink(url string, httpClient *http.Client) *HTTPCommandSink {
+	return &HTTPCommandSink{url: url, httpClient: httpClient}
+}
+
+func (h *HTTPCommandSink) Name() string {
+	return config.OutputHTTP
+}
+
+func (h *HTTPCommandSink) Send(commands []CommandPayload) error {
+	encPayload, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("marshalling command payload: %w", err)
+	}
+
+	resp, err := h.httpClient.Post(h.url, "application/json", bytes.NewReader(encPayload))
+	if err != nil {
+		return fmt.Errorf("posting commands to %s: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting commands to %s: unexpected status %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// ModbusCommandSink writes a setpoint of the first command, in kW, to a
+// register on a Modbus TCP device, optionally reading it back to verify it.
+// The quantity selects the battery or meter setpoint.
+type ModbusCommandSink struct {
+	client   *modbus.Client
+	register modbus.Register
+	quantity string
+	verify   bool
+}
+
+func NewModbusCommandSink(client *modbus.Client, register modbus.Register, quantity string, verify bool) *ModbusCommandSink {
+	return &ModbusCommandSink{client: client, register: register, quantity: quantity, verify: verify}
+}
+
+func (m *ModbusCommandSink) Name() string {
+	return config.OutputModbus
+}
+
+func (m *ModbusCommandSink) Send(commands []CommandPayload) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	value := commands[0].Value
+	if m.quantity == config.QuantityBatteryPower {
+		if commands[0].BatteryPower == nil {
+			return errors.New("command has no battery setpoint")
+		}
+		value = *commands[0].BatteryPower
+	}
+
+	if m.verify {
+		return m.client.WriteVerified(m.register, value)
+	}
+	return m.client.WriteValue(m.register, value)
+}
+
+// FileCommandSink appends commands as JSON lines to a file, or to stdout if
+// the path is "-", so that a dry run shows what would have been sent.
+type FileCommandSink struct {
+	mu   *sync.Mutex
+	path string
+}
+
+func NewFileCommandSink(path string) *FileCommandSink {
+	return &FileCommandSink{mu: new(sync.Mutex), path: path}
+}
+
+func (f *FileCommandSink) Name() string {
+	return config.OutputFile
+}
+
+func (f *FileCommandSink) Send(commands []CommandPayload) error {
+	encPayload, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("marshalling command payload: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.path == "-" {
+		_, err = os.Stdout.Write(append(encPayload, '\n'))
+		return err
+	}
+
+	fileHandle, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening command file %s: %w", f.path, err)
+	}
+	defer fileHandle.Close()
+
+	if _, err := fileHandle.Write(append(encPayload, '\n')); err != nil {
+		return fmt.Errorf("writing command file %s: %w", f.path, err)
+	}
+	return nil
+}
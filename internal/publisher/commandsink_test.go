@@ -0,0 +1,157 @@
+package publisher_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/modbus/modbustest"
+	"github.com/EvergenEnergy/remote-standby/internal/mqtt"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPCommandSinkPostsCommands(t *testing.T) {
+	var received []publisher.CommandPayload
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	sink := publisher.NewHTTPCommandSink(server.URL, server.Client())
+	require.NoError(t, sink.Send([]publisher.CommandPayload{{Action: "SETPOINT", Value: 12.5}}))
+
+	assert.Equal(t, []publisher.CommandPayload{{Action: "SETPOINT", Value: 12.5}}, received)
+}
+
+func TestHTTPCommandSinkFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink := publisher.NewHTTPCommandSink(server.URL, server.Client())
+	assert.ErrorContains(t, sink.Send([]publisher.CommandPayload{{Action: "SETPOINT", Value: 1}}), "503")
+}
+
+func TestFileCommandSinkAppendsCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.jsonl")
+	sink := publisher.NewFileCommandSink(path)
+
+	require.NoError(t, sink.Send([]publisher.CommandPayload{{Action: "SETPOINT", Value: 1}}))
+	require.NoError(t, sink.Send([]publisher.CommandPayload{{Action: "SETPOINT", Value: 2}}))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `[{"action":"SETPOINT","value":2}]`, lines[1])
+}
+
+func TestNewCommandSinksRejectsIncompleteOutputs(t *testing.T) {
+	cfg := getTestConfig()
+
+	cfg.Outputs.Enabled = []string{config.OutputHTTP}
+	_, err := publisher.NewCommandSinks(cfg, nil)
+	assert.Error(t, err)
+
+	cfg.Outputs.Enabled = []string{"carrier-pigeon"}
+	_, err = publisher.NewCommandSinks(cfg, nil)
+	assert.Error(t, err)
+
+	cfg.Outputs.Enabled = []string{config.OutputMQTT, config.OutputFile}
+	sinks, err := publisher.NewCommandSinks(cfg, nil)
+	require.NoError(t, err)
+	require.Len(t, sinks, 2)
+	assert.Equal(t, config.OutputFile, sinks[1].Name())
+}
+
+func TestPublishCommandTriesEverySink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.jsonl")
+
+	cfg := getTestConfig()
+	publisherSvc := publisher.NewService(testLogger, cfg, mqtt.NewClient(cfg), nil,
+		publisher.NewHTTPCommandSink("http://127.0.0.1:1", http.DefaultClient),
+		publisher.NewFileCommandSink(path),
+	)
+
+	delivery, err := publisherSvc.PublishCommand(plan.OptimisationInterval{MeterPower: plan.OptimisationValue{Value: 5, Unit: 2}})
+	require.NoError(t, err)
+	assert.ErrorContains(t, delivery.Err(), "http output")
+	assert.Equal(t, []string{config.OutputFile}, delivery.Delivered())
+	assert.Equal(t, map[string]string{"deliveredTo": "file", "failedOutputs": "http"}, delivery.LogFormat())
+	assert.FileExists(t, path)
+}
+
+func TestPublishCommandFailsWhenNoSinkAccepts(t *testing.T) {
+	cfg := getTestConfig()
+	publisherSvc := publisher.NewService(testLogger, cfg, nil, nil,
+		publisher.NewHTTPCommandSink("http://127.0.0.1:1", http.DefaultClient),
+	)
+
+	delivery, err := publisherSvc.PublishCommand(plan.OptimisationInterval{MeterPower: plan.OptimisationValue{Value: 5, Unit: 2}})
+	assert.ErrorContains(t, err, "http output")
+	assert.Empty(t, delivery.Delivered())
+}
+
+func TestModbusCommandSinkWritesSetpoint(t *testing.T) {
+	server, err := modbustest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	cfg := getTestConfig()
+	cfg.Outputs.Enabled = []string{config.OutputModbus}
+	cfg.Outputs.Modbus = config.ModbusOutputConfig{
+		Address: server.Address(), UnitID: 1, Register: 40100, Quantity: config.QuantityMeterPower,
+		DataType: "int16", ByteOrder: "ABCD", Scale: 1000, Verify: true, Timeout: time.Second,
+	}
+
+	sinks, err := publisher.NewCommandSinks(cfg, nil)
+	require.NoError(t, err)
+
+	publisherSvc := publisher.NewService(testLogger, cfg, nil, nil, sinks...)
+	_, err = publisherSvc.PublishCommand(plan.OptimisationInterval{MeterPower: plan.OptimisationValue{Value: -5, Unit: 2}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []uint16{uint16(0x10000 - 5000)}, server.Registers(1, 40100, 1))
+}
+
+func TestModbusCommandSinkWritesBatterySetpoint(t *testing.T) {
+	server, err := modbustest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	cfg := getTestConfig()
+	cfg.Outputs.Enabled = []string{config.OutputModbus}
+	cfg.Outputs.Modbus = config.ModbusOutputConfig{
+		Address: server.Address(), UnitID: 1, Register: 40100, Quantity: config.QuantityBatteryPower,
+		DataType: "int16", ByteOrder: "ABCD", Scale: 1000, Verify: true, Timeout: time.Second,
+	}
+
+	sinks, err := publisher.NewCommandSinks(cfg, nil)
+	require.NoError(t, err)
+
+	publisherSvc := publisher.NewService(testLogger, cfg, nil, nil, sinks...)
+	_, err = publisherSvc.PublishCommand(plan.OptimisationInterval{
+		MeterPower:   plan.OptimisationValue{Value: -5, Unit: 2},
+		BatteryPower: plan.OptimisationValue{Value: -3000, Unit: 1},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{uint16(0x10000 - 3000)}, server.Registers(1, 40100, 1))
+
+	// Commands without a battery setpoint are not written.
+	_, err = publisherSvc.PublishCommandPayload(publisher.CommandPayload{Action: cfg.MQTT.CommandAction, Value: 2})
+	assert.ErrorContains(t, err, "no battery setpoint")
+}
@@ -0,0 +1,155 @@
+package publisher
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+)
+
+// ErrorCategory identifies the area of the service an error originated in.
+// Errors of each category are published to their own subtopic of the error topic.
+type ErrorCategory string
+
+const (
+	ErrorCategoryStandby        ErrorCategory = "Standby"
+	ErrorCategoryPlan           ErrorCategory = "Plan"
+	ErrorCategoryPlanCoverage   ErrorCategory = "PlanCoverage"
+	ErrorCategoryCommand        ErrorCategory = "Command"
+	ErrorCategoryStorage        ErrorCategory = "Storage"
+	ErrorCategoryConnectivity   ErrorCategory = "Connectivity"
+	ErrorCategoryConfig         ErrorCategory = "Config"
+	ErrorCategoryEnvelope       ErrorCategory = "Envelope"
+	ErrorCategoryDemandResponse ErrorCategory = "DemandResponse"
+)
+
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityError    Severity = "error"
+	SeverityCritical Severity = "critical"
+)
+
+// Level maps a severity onto the slog level it is logged at.
+func (s Severity) Level() slog.Level {
+	switch s {
+	case SeverityInfo:
+		return slog.LevelInfo
+	case SeverityWarning:
+		return slog.LevelWarn
+	case SeverityCritical:
+		return slog.LevelError + 4
+	default:
+		return slog.LevelError
+	}
+}
+
+// ErrorCode is a stable identifier for a specific kind of error.
+// Codes are part of the published payload and must not be renamed.
+type ErrorCode string
+
+const (
+	CodePlanInvalid                    ErrorCode = "PLAN_INVALID"
+	CodePlanSignatureInvalid           ErrorCode = "PLAN_SIGNATURE_INVALID"
+	CodePlanReplayed                   ErrorCode = "PLAN_REPLAYED"
+	CodePlanUnavailable                ErrorCode = "PLAN_UNAVAILABLE"
+	CodeNoCurrentInterval              ErrorCode = "PLAN_NO_CURRENT_INTERVAL"
+	CodeCoverageUnavailable            ErrorCode = "PLAN_COVERAGE_UNAVAILABLE"
+	CodeCoverageHorizonLow             ErrorCode = "PLAN_COVERAGE_HORIZON_LOW"
+	CodeCoveragePercentLow             ErrorCode = "PLAN_COVERAGE_PERCENT_LOW"
+	CodePlanDrift                      ErrorCode = "PLAN_DRIFT_DETECTED"
+	CodeCommandPublishFailed           ErrorCode = "COMMAND_PUBLISH_FAILED"
+	CodePlanWriteFailed                ErrorCode = "STORAGE_PLAN_WRITE_FAILED"
+	CodeOutageLogDegraded              ErrorCode = "STORAGE_OUTAGE_LOG_DEGRADED"
+	CodeBrokerUnavailable              ErrorCode = "CONNECTIVITY_BROKER_UNAVAILABLE"
+	CodeCommandNotConfigured           ErrorCode = "CONFIG_COMMAND_NOT_CONFIGURED"
+	CodeReportNotConfigured            ErrorCode = "CONFIG_REPORT_NOT_CONFIGURED"
+	CodeReportPublishFailed            ErrorCode = "STANDBY_REPORT_PUBLISH_FAILED"
+	CodeShadowNotConfigured            ErrorCode = "CONFIG_SHADOW_NOT_CONFIGURED"
+	CodeEnvelopeInvalid                ErrorCode = "ENVELOPE_INVALID"
+	CodeDemandResponseInvalid          ErrorCode = "DEMAND_RESPONSE_INVALID"
+	CodeDemandResponseSignatureInvalid ErrorCode = "DEMAND_RESPONSE_SIGNATURE_INVALID"
+	CodeDemandResponseReplayed         ErrorCode = "DEMAND_RESPONSE_REPLAYED"
+	CodeDemandResponseWriteFailed      ErrorCode = "STORAGE_DEMAND_RESPONSE_WRITE_FAILED"
+	CodeEnvelopeWriteFailed            ErrorCode = "STORAGE_ENVELOPE_WRITE_FAILED"
+	CodeUnclassified                   ErrorCode = "STANDBY_UNCLASSIFIED"
+)
+
+type errorClass struct {
+	category ErrorCategory
+	severity Severity
+}
+
+var errorCodes = map[ErrorCode]errorClass{
+	CodePlanInvalid:                    {ErrorCategoryPlan, SeverityError},
+	CodePlanSignatureInvalid:           {ErrorCategoryPlan, SeverityError},
+	CodePlanReplayed:                   {ErrorCategoryPlan, SeverityError},
+	CodePlanUnavailable:                {ErrorCategoryPlan, SeverityCritical},
+	CodeNoCurrentInterval:              {ErrorCategoryPlan, SeverityCritical},
+	CodeCoverageUnavailable:            {ErrorCategoryPlanCoverage, SeverityWarning},
+	CodeCoverageHorizonLow:             {ErrorCategoryPlanCoverage, SeverityWarning},
+	CodeCoveragePercentLow:             {ErrorCategoryPlanCoverage, SeverityWarning},
+	CodePlanDrift:                      {ErrorCategoryPlan, SeverityWarning},
+	CodeCommandPublishFailed:           {ErrorCategoryCommand, SeverityCritical},
+	CodePlanWriteFailed:                {ErrorCategoryStorage, SeverityError},
+	CodeOutageLogDegraded:              {ErrorCategoryStorage, SeverityError},
+	CodeBrokerUnavailable:              {ErrorCategoryConnectivity, SeverityError},
+	CodeCommandNotConfigured:           {ErrorCategoryConfig, SeverityCritical},
+	CodeReportNotConfigured:            {ErrorCategoryConfig, SeverityWarning},
+	CodeReportPublishFailed:            {ErrorCategoryStandby, SeverityError},
+	CodeShadowNotConfigured:            {ErrorCategoryConfig, SeverityWarning},
+	CodeEnvelopeInvalid:                {ErrorCategoryEnvelope, SeverityError},
+	CodeDemandResponseInvalid:          {ErrorCategoryDemandResponse, SeverityError},
+	CodeDemandResponseSignatureInvalid: {ErrorCategoryDemandResponse, SeverityError},
+	CodeDemandResponseReplayed:         {ErrorCategoryDemandResponse, SeverityError},
+	CodeDemandResponseWriteFailed:      {ErrorCategoryStorage, SeverityError},
+	CodeEnvelopeWriteFailed:            {ErrorCategoryStorage, SeverityError},
+	CodeUnclassified:                   {ErrorCategoryStandby, SeverityError},
+}
+
+// Category returns the category the code is published under,
+// falling back to the Standby category for unknown codes.
+func (c ErrorCode) Category() ErrorCategory {
+	if class, ok := errorCodes[c]; ok {
+		return class.category
+	}
+	return ErrorCategoryStandby
+}
+
+func (c ErrorCode) Severity() Severity {
+	if class, ok := errorCodes[c]; ok {
+		return class.severity
+	}
+	return SeverityError
+}
+
+var ErrCommandNotConfigured = errors.New("command output not configured")
+
+var ErrReportNotConfigured = errors.New("report topic not configured")
+
+// LogAttrs returns the payload's fields as slog attributes, so that logged
+// errors carry the same information as published ones.
+func (p ErrorPayload) LogAttrs() []any {
+	attrs := []any{
+		slog.String("category", string(p.Category)),
+		slog.String("severity", string(p.Severity)),
+		slog.String("code", string(p.Code)),
+	}
+
+	if len(p.Details) > 0 {
+		keys := make([]string, 0, len(p.Details))
+		for k := range p.Details {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		details := make([]any, 0, len(keys))
+		for _, k := range keys {
+			details = append(details, slog.String(k, p.Details[k]))
+		}
+		attrs = append(attrs, slog.Group("details", details...))
+	}
+
+	return attrs
+}
@@ -1,57 +1,155 @@
 package publisher
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
 	"github.com/EvergenEnergy/remote-standby/internal/plan"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Service struct {
-	logger     *slog.Logger
-	cfg        config.Config
-	mqttClient mqtt.Client
+	logger       *slog.Logger
+	cfg          config.Config
+	mqttClient   mqtt.Client
+	queue        *Queue
+	commandSinks []CommandSink
+	envelope     *envelope.Tracker
 }
 
-func NewService(logger *slog.Logger, cfg config.Config, mqttClient mqtt.Client) *Service {
+// NewService creates a publisher. If queue is not nil, errors and status events
+// that cannot be delivered are stored in it until the broker is reachable again.
+// Commands are sent to each of commandSinks, or if none are given, published
+// to the write command topic.
+func NewService(logger *slog.Logger, cfg config.Config, mqttClient mqtt.Client, queue *Queue, commandSinks ...CommandSink) *Service {
+	if len(commandSinks) == 0 && cfg.MQTT.WriteCommandTopic != "" {
+		commandSinks = []CommandSink{NewMQTTCommandSink(mqttClient, cfg.MQTT.WriteCommandTopic)}
+	}
+
 	return &Service{
-		logger:     logger,
-		cfg:        cfg,
-		mqttClient: mqttClient,
+		logger:       logger,
+		cfg:          cfg,
+		mqttClient:   mqttClient,
+		queue:        queue,
+		commandSinks: commandSinks,
+	}
+}
+
+// EnableEnvelope makes every command keep within the operating envelope in
+// force when it is sent.
+func (s *Service) EnableEnvelope(tracker *envelope.Tracker) {
+	s.envelope = tracker
+}
+
+// Limits returns the operating envelope's limits at a time, or no limits if
+// there is no envelope.
+func (s *Service) Limits(at time.Time) envelope.Limits {
+	if s.envelope == nil {
+		return envelope.NoLimits
 	}
+
+	limits, _ := s.envelope.Limits(at)
+	return limits
 }
 
 type CommandPayload struct {
 	Action string  `json:"action"`
 	Value  float64 `json:"value"`
+	// BatteryPower is the battery setpoint in kW, positive when charging,
+	// for outputs that command the battery directly. Commands that don't
+	// come from a plan interval have none. It is not sent to the commands
+	// handler.
+	BatteryPower *float64 `json:"-"`
+}
+
+// clamp limits the command's meter setpoint to the envelope, moving the
+// battery setpoint by as much, taking the site's load to be unchanged.
+func (c CommandPayload) clamp(limits envelope.Limits) CommandPayload {
+	clamped := limits.Clamp(c.Value)
+	if c.BatteryPower != nil {
+		batteryPower := *c.BatteryPower + clamped - c.Value
+		c.BatteryPower = &batteryPower
+	}
+	c.Value = clamped
+
+	return c
+}
+
+// ShadowCommandPayload is a command the standby would have issued in shadow
+// mode, compared with the latest command observed from the cloud, if any.
+type ShadowCommandPayload struct {
+	Command         CommandPayload  `json:"command"`
+	CloudCommand    *CommandPayload `json:"cloud_command,omitempty"`
+	CloudCommandAge int64           `json:"cloud_command_age_seconds,omitempty"`
+	Difference      *float64        `json:"difference,omitempty"`
+	Timestamp       int64           `json:"timestamp"`
 }
 
 type ErrorPayload struct {
-	Category  string `json:"category"`
-	Message   string `json:"message"`
-	Timestamp int64  `json:"timestamp"`
+	Category  ErrorCategory     `json:"category"`
+	Severity  Severity          `json:"severity"`
+	Code      ErrorCode         `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+type EventPayload struct {
+	Event     string            `json:"event"`
+	Message   string            `json:"message"`
+	Mode      string            `json:"mode,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// OutageReportPayload summarises what the standby did during an outage.
+// StartTime and EndTime repeat Start and End in the site's time zone.
+type OutageReportPayload struct {
+	Start           int64            `json:"start"`
+	End             int64            `json:"end"`
+	StartTime       string           `json:"start_time"`
+	EndTime         string           `json:"end_time"`
+	DurationSeconds int64            `json:"duration_seconds"`
+	CommandsIssued  int              `json:"commands_issued"`
+	Intervals       []ReportInterval `json:"intervals"`
+	Errors          []ReportError    `json:"errors"`
+	FallbackUsage   map[string]int   `json:"fallback_usage"`
+	Truncated       bool             `json:"truncated,omitempty"`
+}
+
+// ReportInterval is a plan interval that commands were issued from during an outage.
+type ReportInterval struct {
+	Start      int64   `json:"start"`
+	StartTime  string  `json:"start_time"`
+	MeterPower float64 `json:"meter_power"`
+	Source     string  `json:"source"`
+	Commands   int     `json:"commands"`
 }
 
-const errorCategoryStandby = "Standby"
+// ReportError aggregates repeated occurrences of the same error during an outage.
+type ReportError struct {
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+	Count   int    `json:"count"`
+	First   int64  `json:"first"`
+	Last    int64  `json:"last"`
+}
 
 const (
-	MeterPowerUnitWatt     = 1
-	MeterPowerUnitKilowatt = 2
-	MeterPowerUnitMegawatt = 3
+	MeterPowerUnitWatt     = plan.UnitWatt
+	MeterPowerUnitKilowatt = plan.UnitKilowatt
+	MeterPowerUnitMegawatt = plan.UnitMegawatt
 )
 
-func (s *Service) PublishError(message string, receivedError error) {
-	s.logger.Error(message, "error", receivedError)
+func (s *Service) PublishError(code ErrorCode, message string, receivedError error, details map[string]string) {
+	payload := BuildErrorPayload(code, message, receivedError, details)
 
-	payload := ErrorPayload{
-		Category:  errorCategoryStandby,
-		Message:   fmt.Sprintf("Error %s: %s", message, receivedError),
-		Timestamp: time.Now().Unix(),
-	}
+	s.logger.Log(context.Background(), payload.Severity.Level(), message, append(payload.LogAttrs(), "error", receivedError)...)
 
 	encPayload, err := json.Marshal(payload)
 	if err != nil {
@@ -66,26 +164,132 @@ func (s *Service) PublishError(message string, receivedError error) {
 
 	errTopic := fmt.Sprintf("%s/%s", s.cfg.MQTT.ErrorTopic, payload.Category)
 
-	s.mqttClient.Publish(errTopic, 1, false, encPayload)
+	s.publishOrQueue(errTopic, encPayload)
 }
 
-func (s *Service) PublishCommand(optInterval plan.OptimisationInterval) error {
-	if s.cfg.MQTT.WriteCommandTopic == "" || s.cfg.MQTT.CommandAction == "" {
-		return fmt.Errorf("no command topic (%s) or action (%s) configured", s.cfg.MQTT.WriteCommandTopic, s.cfg.MQTT.CommandAction)
+// PublishEvent publishes a status event, such as a change of mode, to the status topic.
+func (s *Service) PublishEvent(event, message, mode string, details map[string]string) {
+	if s.cfg.MQTT.StatusTopic == "" {
+		return
 	}
 
-	payload := []CommandPayload{BuildCommandPayload(s.cfg.MQTT.CommandAction, optInterval)}
+	encPayload, err := json.Marshal(EventPayload{
+		Event:     event,
+		Message:   message,
+		Mode:      mode,
+		Details:   details,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		s.logger.Error("marshalling event payload", "error", err)
+		return
+	}
+
+	s.publishOrQueue(s.cfg.MQTT.StatusTopic, encPayload)
+}
+
+// PublishOutageReport publishes a report on a completed outage to the report topic.
+func (s *Service) PublishOutageReport(report OutageReportPayload) error {
+	if s.cfg.MQTT.ReportTopic == "" {
+		return ErrReportNotConfigured
+	}
+
+	encPayload, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshalling outage report: %w", err)
+	}
+
+	s.publishOrQueue(s.cfg.MQTT.ReportTopic, encPayload)
+	return nil
+}
+
+// PublishShadowCommand publishes a command the standby would have issued to the shadow topic.
+func (s *Service) PublishShadowCommand(payload ShadowCommandPayload) error {
+	if s.cfg.MQTT.ShadowTopic == "" {
+		return fmt.Errorf("no shadow topic configured")
+	}
 
 	encPayload, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("marshalling command payload: %w", err)
+		return fmt.Errorf("marshalling shadow command: %w", err)
 	}
 
-	s.mqttClient.Publish(s.cfg.MQTT.WriteCommandTopic, 1, false, encPayload)
+	s.publishOrQueue(s.cfg.MQTT.ShadowTopic, encPayload)
 	return nil
 }
 
-func BuildCommandPayload(action string, optInterval plan.OptimisationInterval) CommandPayload {
+// publishOrQueue publishes directly while connected and nothing is waiting to
+// be delivered, and otherwise adds the message to the queue so that it is
+// delivered in order once the connection is restored.
+func (s *Service) publishOrQueue(topic string, payload []byte) {
+	if s.queue == nil {
+		s.mqttClient.Publish(topic, 1, false, payload)
+		return
+	}
+
+	connected := s.mqttClient.IsConnectionOpen()
+	if connected && s.queue.Len() == 0 {
+		s.mqttClient.Publish(topic, 1, false, payload)
+		return
+	}
+
+	if err := s.queue.Enqueue(topic, payload); err != nil {
+		s.logger.Error("queueing message", "topic", topic, "error", err)
+		return
+	}
+
+	// Draining waits for each delivery, so it is left to the queue's
+	// drainer rather than blocking callers that may be running inside a
+	// message handler.
+	if connected {
+		s.queue.Signal(s.mqttClient)
+	}
+}
+
+func BuildErrorPayload(code ErrorCode, message string, receivedError error, details map[string]string) ErrorPayload {
+	return ErrorPayload{
+		Category:  code.Category(),
+		Severity:  code.Severity(),
+		Code:      code,
+		Message:   fmt.Sprintf("Error %s: %s", message, receivedError),
+		Details:   details,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// PublishCommand sends the command for the interval to every command sink.
+// Each sink is tried even if an earlier one fails, and the outcome for each
+// is returned. An error is returned only if no sink accepted the command.
+func (s *Service) PublishCommand(optInterval plan.OptimisationInterval) (Delivery, error) {
+	return s.PublishCommandPayload(BuildCommandPayload(s.cfg.MQTT.CommandAction, optInterval, s.Limits(time.Now())))
+}
+
+// PublishCommandPayload sends a command to every command sink, as
+// PublishCommand does, for commands that don't come from a plan interval.
+// The command is limited to the operating envelope.
+func (s *Service) PublishCommandPayload(command CommandPayload) (Delivery, error) {
+	if len(s.commandSinks) == 0 || s.cfg.MQTT.CommandAction == "" {
+		return nil, fmt.Errorf("%w: no command outputs (%d) or action (%s) configured",
+			ErrCommandNotConfigured, len(s.commandSinks), s.cfg.MQTT.CommandAction)
+	}
+
+	payload := []CommandPayload{command.clamp(s.Limits(time.Now()))}
+
+	delivery := make(Delivery, 0, len(s.commandSinks))
+	for _, sink := range s.commandSinks {
+		delivery = append(delivery, SinkResult{Sink: sink.Name(), Err: sink.Send(payload)})
+	}
+
+	if len(delivery.Delivered()) == 0 {
+		return delivery, delivery.Err()
+	}
+
+	return delivery, nil
+}
+
+// BuildCommandPayload builds the command for the interval's meter setpoint,
+// carrying its battery setpoint too, limited to the operating envelope.
+func BuildCommandPayload(action string, optInterval plan.OptimisationInterval, limits envelope.Limits) CommandPayload {
 	meterValue := float64(optInterval.MeterPower.Value)
 	meterUnit := optInterval.MeterPower.Unit
 
@@ -100,8 +304,29 @@ func BuildCommandPayload(action string, optInterval plan.OptimisationInterval) C
 		publishMeterValue = meterValue * 1000
 	}
 
-	return CommandPayload{
-		Action: action,
-		Value:  publishMeterValue,
+	command := CommandPayload{Action: action, Value: publishMeterValue}
+	// A battery setpoint without a unit is taken to be missing.
+	if optInterval.BatteryPower.Unit != 0 {
+		batteryPower := optInterval.BatteryPower.Kilowatts()
+		command.BatteryPower = &batteryPower
 	}
+
+	return command.clamp(limits)
+}
+
+// ParseCommandPayload reads a command message in the format the commands
+// handler accepts, returning the first command with the given action.
+func ParseCommandPayload(payload []byte, action string) (CommandPayload, error) {
+	var commands []CommandPayload
+	if err := json.Unmarshal(payload, &commands); err != nil {
+		return CommandPayload{}, fmt.Errorf("unmarshalling command payload: %w", err)
+	}
+
+	for _, command := range commands {
+		if command.Action == action {
+			return command, nil
+		}
+	}
+
+	return CommandPayload{}, fmt.Errorf("no %s command in payload", action)
 }
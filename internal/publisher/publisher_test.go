@@ -1,16 +1,19 @@
 package publisher_test
 
 import (
+	"errors"
 	"log/slog"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
 	"github.com/EvergenEnergy/remote-standby/internal/mqtt"
 	"github.com/EvergenEnergy/remote-standby/internal/plan"
 	"github.com/EvergenEnergy/remote-standby/internal/publisher"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testLogger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
@@ -31,11 +34,34 @@ func TestBuildCommandPayloads(t *testing.T) {
 	for _, tc := range tests {
 		payload := publisher.BuildCommandPayload("actionvalue", plan.OptimisationInterval{
 			MeterPower: plan.OptimisationValue{Value: tc.meterPower, Unit: tc.meterUnit},
-		})
+		}, envelope.NoLimits)
 		assert.InDelta(t, tc.expected, payload.Value, 0.0001)
 	}
 }
 
+func TestBuildCommandPayload_ClampsToEnvelope(t *testing.T) {
+	limits := envelope.NewLimits(5, 1.5)
+
+	importing := publisher.BuildCommandPayload("actionvalue", plan.OptimisationInterval{
+		MeterPower: plan.OptimisationValue{Value: 7000, Unit: publisher.MeterPowerUnitWatt},
+	}, limits)
+	assert.InDelta(t, 5, importing.Value, 0.0001)
+
+	// The battery setpoint moves by as much as the meter's.
+	exporting := publisher.BuildCommandPayload("actionvalue", plan.OptimisationInterval{
+		MeterPower:   plan.OptimisationValue{Value: -3, Unit: publisher.MeterPowerUnitKilowatt},
+		BatteryPower: plan.OptimisationValue{Value: -4, Unit: publisher.MeterPowerUnitKilowatt},
+	}, limits)
+	assert.InDelta(t, -1.5, exporting.Value, 0.0001)
+	require.NotNil(t, exporting.BatteryPower)
+	assert.InDelta(t, -2.5, *exporting.BatteryPower, 0.0001)
+
+	within := publisher.BuildCommandPayload("actionvalue", plan.OptimisationInterval{
+		MeterPower: plan.OptimisationValue{Value: -1, Unit: publisher.MeterPowerUnitKilowatt},
+	}, limits)
+	assert.InDelta(t, -1, within.Value, 0.0001)
+}
+
 // The PublishCommand and PublishError methods are more thoroughly tested in the standby_test package.
 
 func getTestConfig() config.Config {
@@ -59,9 +85,9 @@ func getTestConfig() config.Config {
 func TestPublishesCommand(t *testing.T) {
 	cfg := getTestConfig()
 	mqttClient := mqtt.NewClient(cfg)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
 
-	err := publisherSvc.PublishCommand(plan.OptimisationInterval{
+	_, err := publisherSvc.PublishCommand(plan.OptimisationInterval{
 		Interval: plan.OptimisationIntervalTimestamp{
 			StartTime: plan.OptimisationTimestamp{
 				Seconds: time.Now().Unix(),
@@ -89,9 +115,63 @@ func TestPublishesError(t *testing.T) {
 	cfg.MQTT.CommandAction = ""
 
 	mqttClient := mqtt.NewClient(cfg)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
+
+	_, err := publisherSvc.PublishCommand(plan.OptimisationInterval{})
+	publisherSvc.PublishError(publisher.CodeCommandNotConfigured, "something went wrong publishing a command", err, nil)
+	assert.ErrorIs(t, err, publisher.ErrCommandNotConfigured)
+}
+
+func TestPublishOutageReport_WhenNoTopicIsConfigured(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.MQTT.ReportTopic = ""
+
+	publisherSvc := publisher.NewService(testLogger, cfg, mqtt.NewClient(cfg), nil)
+
+	err := publisherSvc.PublishOutageReport(publisher.OutageReportPayload{})
+	assert.ErrorIs(t, err, publisher.ErrReportNotConfigured)
+}
+
+func TestBuildErrorPayload(t *testing.T) {
+	payload := publisher.BuildErrorPayload(publisher.CodePlanWriteFailed, "writing plan", errors.New("disk full"), map[string]string{"path": "plan.json"})
+
+	assert.Equal(t, publisher.ErrorCategoryStorage, payload.Category)
+	assert.Equal(t, publisher.SeverityError, payload.Severity)
+	assert.Equal(t, publisher.CodePlanWriteFailed, payload.Code)
+	assert.Equal(t, "Error writing plan: disk full", payload.Message)
+	assert.Equal(t, "plan.json", payload.Details["path"])
+	assert.NotZero(t, payload.Timestamp)
+}
+
+func TestErrorCodeClassification(t *testing.T) {
+	type test struct {
+		code     publisher.ErrorCode
+		category publisher.ErrorCategory
+		severity publisher.Severity
+	}
+
+	tests := []test{
+		{code: publisher.CodeNoCurrentInterval, category: publisher.ErrorCategoryPlan, severity: publisher.SeverityCritical},
+		{code: publisher.CodeCoverageHorizonLow, category: publisher.ErrorCategoryPlanCoverage, severity: publisher.SeverityWarning},
+		{code: publisher.CodeBrokerUnavailable, category: publisher.ErrorCategoryConnectivity, severity: publisher.SeverityError},
+		{code: publisher.CodeCommandNotConfigured, category: publisher.ErrorCategoryConfig, severity: publisher.SeverityCritical},
+		{code: publisher.ErrorCode("NOT_A_CODE"), category: publisher.ErrorCategoryStandby, severity: publisher.SeverityError},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.category, tc.code.Category(), tc.code)
+		assert.Equal(t, tc.severity, tc.code.Severity(), tc.code)
+	}
+}
+
+func TestParseCommandPayload(t *testing.T) {
+	command, err := publisher.ParseCommandPayload([]byte(`[{"action":"OTHER","value":1},{"action":"STORAGEPOINT","value":-2.5}]`), "STORAGEPOINT")
+	assert.NoError(t, err)
+	assert.InDelta(t, -2.5, command.Value, 0.0001)
+
+	_, err = publisher.ParseCommandPayload([]byte(`[{"action":"OTHER","value":1}]`), "STORAGEPOINT")
+	assert.Error(t, err)
 
-	err := publisherSvc.PublishCommand(plan.OptimisationInterval{})
-	publisherSvc.PublishError("something went wrong publishing a command", err)
+	_, err = publisher.ParseCommandPayload([]byte(`not json`), "STORAGEPOINT")
 	assert.Error(t, err)
 }
@@ -0,0 +1,304 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	queueFileSuffix = ".json"
+	tmpFileSuffix   = ".tmp"
+)
+
+// publishTimeout bounds how long a delivery waits for the broker to acknowledge a message.
+const publishTimeout = 10 * time.Second
+
+// Queue is a disk-backed store of outbound messages that could not be delivered
+// while the broker was unreachable. Messages are kept in the order they were
+// enqueued, survive restarts, and are bounded by total size and age. A single
+// drainer goroutine delivers them once it is signalled that the broker is
+// reachable.
+type Queue struct {
+	logger   *slog.Logger
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu      *sync.Mutex
+	entries []queueEntry
+	size    int64
+	nextSeq uint64
+
+	drainMu      *sync.Mutex
+	wake         chan struct{}
+	startDrainer sync.Once
+}
+
+type queueEntry struct {
+	seq        uint64
+	size       int64
+	enqueuedAt time.Time
+}
+
+type QueuedMessage struct {
+	Topic      string `json:"topic"`
+	Payload    []byte `json:"payload"`
+	EnqueuedAt int64  `json:"enqueued_at"`
+}
+
+// OpenQueue opens the queue stored in dir, creating the directory if needed
+// and loading any messages left over from a previous run.
+func OpenQueue(logger *slog.Logger, dir string, maxBytes int64, maxAge time.Duration) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating queue directory %s: %w", dir, err)
+	}
+
+	q := &Queue{
+		logger:   logger,
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		mu:       new(sync.Mutex),
+		drainMu:  new(sync.Mutex),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("reading queue directory %s: %w", q.dir, err)
+	}
+
+	for _, file := range files {
+		// A message being written when the process stopped was never
+		// enqueued, so its temporary file is removed.
+		if !file.IsDir() && strings.HasSuffix(file.Name(), tmpFileSuffix) {
+			if err := os.Remove(filepath.Join(q.dir, file.Name())); err != nil {
+				q.logger.Error("removing partially written queued message", "file", file.Name(), "error", err)
+			}
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), queueFileSuffix), 10, 64)
+		if file.IsDir() || !strings.HasSuffix(file.Name(), queueFileSuffix) || err != nil {
+			continue
+		}
+
+		msg, size, err := q.read(seq)
+		if err != nil {
+			q.logger.Warn("discarding unreadable queued message", "file", file.Name(), "error", err)
+			q.remove(seq)
+			continue
+		}
+
+		q.entries = append(q.entries, queueEntry{seq: seq, size: size, enqueuedAt: time.Unix(msg.EnqueuedAt, 0)})
+		q.size += size
+	}
+
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+
+	if len(q.entries) > 0 {
+		q.nextSeq = q.entries[len(q.entries)-1].seq + 1
+	}
+
+	return nil
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileSuffix))
+}
+
+func (q *Queue) read(seq uint64) (QueuedMessage, int64, error) {
+	content, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return QueuedMessage{}, 0, fmt.Errorf("reading queued message: %w", err)
+	}
+
+	msg := QueuedMessage{}
+	if err := json.Unmarshal(content, &msg); err != nil {
+		return QueuedMessage{}, 0, fmt.Errorf("unmarshalling queued message: %w", err)
+	}
+
+	return msg, int64(len(content)), nil
+}
+
+func (q *Queue) remove(seq uint64) {
+	if err := os.Remove(q.path(seq)); err != nil && !os.IsNotExist(err) {
+		q.logger.Error("removing queued message", "seq", seq, "error", err)
+	}
+}
+
+// Enqueue persists a message for later delivery, discarding the oldest
+// messages if the queue grows beyond its size limit.
+func (q *Queue) Enqueue(topic string, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+
+	encMsg, err := json.Marshal(QueuedMessage{Topic: topic, Payload: payload, EnqueuedAt: now.Unix()})
+	if err != nil {
+		return fmt.Errorf("marshalling queued message: %w", err)
+	}
+
+	seq := q.nextSeq
+	tmpPath := q.path(seq) + tmpFileSuffix
+
+	if err := os.WriteFile(tmpPath, encMsg, 0o644); err != nil {
+		return fmt.Errorf("writing queued message: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.path(seq)); err != nil {
+		return fmt.Errorf("storing queued message: %w", err)
+	}
+
+	q.nextSeq++
+	q.entries = append(q.entries, queueEntry{seq: seq, size: int64(len(encMsg)), enqueuedAt: now})
+	q.size += int64(len(encMsg))
+
+	q.prune(now)
+
+	return nil
+}
+
+// prune drops messages that have expired or that exceed the size limit, oldest first.
+func (q *Queue) prune(now time.Time) {
+	for len(q.entries) > 0 {
+		oldest := q.entries[0]
+
+		expired := q.maxAge > 0 && now.Sub(oldest.enqueuedAt) > q.maxAge
+		oversized := q.maxBytes > 0 && q.size > q.maxBytes
+
+		if !expired && !oversized {
+			return
+		}
+
+		q.logger.Warn("dropping queued message", "seq", oldest.seq, "expired", expired, "oversized", oversized)
+		q.remove(oldest.seq)
+		q.entries = q.entries[1:]
+		q.size -= oldest.size
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries)
+}
+
+// Drain publishes queued messages in order, removing each once it has been
+// delivered. It stops at the first message that fails to publish so that
+// order is preserved for the next attempt. Only one drain runs at a time, and
+// the queue is not locked while a message is being published, so messages
+// can still be enqueued meanwhile.
+func (q *Queue) Drain(publish func(topic string, payload []byte) error) error {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	for {
+		entry, msg, ok := q.next()
+		if !ok {
+			return nil
+		}
+
+		if msg != nil {
+			if err := publish(msg.Topic, msg.Payload); err != nil {
+				return fmt.Errorf("publishing queued message %d: %w", entry.seq, err)
+			}
+		}
+
+		q.mu.Lock()
+		// The message may have been pruned while it was being published.
+		if len(q.entries) > 0 && q.entries[0].seq == entry.seq {
+			q.remove(entry.seq)
+			q.entries = q.entries[1:]
+			q.size -= entry.size
+		}
+		q.mu.Unlock()
+	}
+}
+
+// next returns the oldest message in the queue after pruning, or a nil
+// message if it is unreadable and should be discarded.
+func (q *Queue) next() (queueEntry, *QueuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune(time.Now())
+
+	if len(q.entries) == 0 {
+		return queueEntry{}, nil, false
+	}
+
+	entry := q.entries[0]
+	msg, _, err := q.read(entry.seq)
+	if err != nil {
+		q.logger.Warn("discarding unreadable queued message", "seq", entry.seq, "error", err)
+		return entry, nil, true
+	}
+
+	return entry, &msg, true
+}
+
+// OnConnect signals the drainer to deliver the queue through the newly
+// connected client. It can be registered as the client's connect handler.
+func (q *Queue) OnConnect(client mqtt.Client) {
+	q.Signal(client)
+}
+
+// Signal wakes the drainer, starting it on the first call, so that queued
+// messages are delivered through client. Signals that arrive during a drain
+// cause a single further drain once it finishes.
+func (q *Queue) Signal(client mqtt.Client) {
+	q.startDrainer.Do(func() {
+		go q.runDrainer(client)
+	})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) runDrainer(client mqtt.Client) {
+	for range q.wake {
+		q.drain(client)
+	}
+}
+
+func (q *Queue) drain(client mqtt.Client) {
+	pending := q.Len()
+	if pending == 0 {
+		return
+	}
+
+	q.logger.Info("draining queued messages", "count", pending)
+
+	err := q.Drain(func(topic string, payload []byte) error {
+		token := client.Publish(topic, 1, false, payload)
+		if !token.WaitTimeout(publishTimeout) {
+			return fmt.Errorf("timed out waiting for broker")
+		}
+		return token.Error()
+	})
+	if err != nil {
+		q.logger.Error("draining queued messages", "error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package publisher_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type delivered struct {
+	topic   string
+	payload string
+}
+
+func collect(msgs *[]delivered) func(string, []byte) error {
+	return func(topic string, payload []byte) error {
+		*msgs = append(*msgs, delivered{topic: topic, payload: string(payload)})
+		return nil
+	}
+}
+
+func TestQueue_DrainsMessagesInOrder(t *testing.T) {
+	queue, err := publisher.OpenQueue(testLogger, t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	for i := range 3 {
+		require.NoError(t, queue.Enqueue("topic/a", []byte(fmt.Sprintf("msg-%d", i))))
+	}
+	assert.Equal(t, 3, queue.Len())
+
+	msgs := []delivered{}
+	require.NoError(t, queue.Drain(collect(&msgs)))
+
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, []delivered{{"topic/a", "msg-0"}, {"topic/a", "msg-1"}, {"topic/a", "msg-2"}}, msgs)
+}
+
+func TestQueue_SurvivesReopening(t *testing.T) {
+	dir := t.TempDir()
+
+	queue, err := publisher.OpenQueue(testLogger, dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, queue.Enqueue("topic/a", []byte("first")))
+	require.NoError(t, queue.Enqueue("topic/b", []byte("second")))
+
+	reopened, err := publisher.OpenQueue(testLogger, dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reopened.Len())
+
+	require.NoError(t, reopened.Enqueue("topic/c", []byte("third")))
+
+	msgs := []delivered{}
+	require.NoError(t, reopened.Drain(collect(&msgs)))
+	assert.Equal(t, []delivered{{"topic/a", "first"}, {"topic/b", "second"}, {"topic/c", "third"}}, msgs)
+}
+
+func TestQueue_StopsDrainingAtFirstFailure(t *testing.T) {
+	queue, err := publisher.OpenQueue(testLogger, t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, queue.Enqueue("topic/a", []byte("first")))
+	require.NoError(t, queue.Enqueue("topic/a", []byte("second")))
+
+	err = queue.Drain(func(string, []byte) error { return errors.New("not connected") })
+	assert.Error(t, err)
+	assert.Equal(t, 2, queue.Len())
+
+	msgs := []delivered{}
+	require.NoError(t, queue.Drain(collect(&msgs)))
+	assert.Equal(t, "first", msgs[0].payload)
+}
+
+func TestQueue_DropsOldestWhenOverSizeLimit(t *testing.T) {
+	queue, err := publisher.OpenQueue(testLogger, t.TempDir(), 250, 0)
+	require.NoError(t, err)
+
+	for i := range 5 {
+		require.NoError(t, queue.Enqueue("topic/a", []byte(fmt.Sprintf("msg-%d", i))))
+	}
+	assert.Less(t, queue.Len(), 5)
+
+	msgs := []delivered{}
+	require.NoError(t, queue.Drain(collect(&msgs)))
+	assert.Equal(t, "msg-4", msgs[len(msgs)-1].payload)
+	assert.NotEqual(t, "msg-0", msgs[0].payload)
+}
+
+func TestQueue_DropsExpiredMessages(t *testing.T) {
+	queue, err := publisher.OpenQueue(testLogger, t.TempDir(), 0, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, queue.Enqueue("topic/a", []byte("stale")))
+
+	time.Sleep(2 * time.Second)
+
+	msgs := []delivered{}
+	require.NoError(t, queue.Drain(collect(&msgs)))
+	assert.Empty(t, msgs)
+}
+
+func TestQueue_RemovesPartiallyWrittenMessagesOnLoad(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "00000000000000000007.json.tmp")
+	require.NoError(t, os.WriteFile(leftover, []byte(`{"topic":`), 0o644))
+
+	queue, err := publisher.OpenQueue(testLogger, dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, queue.Len())
+	assert.NoFileExists(t, leftover)
+}
+
+func TestQueue_AcceptsMessagesWhileDraining(t *testing.T) {
+	queue, err := publisher.OpenQueue(testLogger, t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, queue.Enqueue("topic/a", []byte("first")))
+
+	msgs := []delivered{}
+	err = queue.Drain(func(topic string, payload []byte) error {
+		// Enqueueing from within a delivery must not block on the drain.
+		if string(payload) == "first" {
+			require.NoError(t, queue.Enqueue("topic/a", []byte("second")))
+		}
+		return collect(&msgs)(topic, payload)
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []delivered{{"topic/a", "first"}, {"topic/a", "second"}}, msgs)
+	assert.Equal(t, 0, queue.Len())
+}
@@ -0,0 +1,109 @@
+package standby
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/demandresponse"
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// EnableDemandResponse makes the service accept demand response events on
+// the demand response topic, keep them in the store, and follow them in
+// place of the plan while they are active.
+func (s *Service) EnableDemandResponse(store *demandresponse.Store) {
+	s.demandResponse = store
+}
+
+func (s *Service) handleDemandResponseMessage(_ mqtt.Client, msg mqtt.Message) {
+	s.logger.Debug(fmt.Sprintf("Received demand response event: %s from topic: %s", msg.Payload(), msg.Topic()))
+
+	payload, err := s.verifySignature(msg.Payload())
+	if err != nil {
+		s.publisher.PublishError(publisher.CodeDemandResponseSignatureInvalid, "verifying demand response event signature", err, map[string]string{"topic": msg.Topic()})
+		return
+	}
+
+	event, err := demandresponse.Parse(payload)
+	if err != nil {
+		s.publisher.PublishError(publisher.CodeDemandResponseInvalid, "reading demand response event", err, map[string]string{"topic": msg.Topic()})
+		return
+	}
+
+	if s.verifier != nil {
+		if err := s.demandResponse.CheckFresh(event, s.cfg.SiteName); err != nil {
+			s.publisher.PublishError(publisher.CodeDemandResponseReplayed, "checking demand response event is fresh", err, map[string]string{"topic": msg.Topic()})
+			return
+		}
+	}
+
+	if err := s.demandResponse.Add(event, time.Now()); err != nil {
+		s.publisher.PublishError(publisher.CodeDemandResponseWriteFailed, "storing demand response event", err, map[string]string{"path": s.cfg.Standby.DemandResponseFile})
+		return
+	}
+
+	fields := event.LogFormat(s.location)
+	if event.Cancel {
+		fields = map[string]string{"eventId": event.EventID, "cancel": "true"}
+	}
+	s.recordEvent(outagelog.EventDemandResponse, fields)
+}
+
+// activeDemandResponse returns the demand response event active at a time, if any.
+func (s *Service) activeDemandResponse(at time.Time) (demandresponse.Event, bool) {
+	if s.demandResponse == nil {
+		return demandresponse.Event{}, false
+	}
+	return s.demandResponse.Active(at)
+}
+
+// applyDemandResponse overrides the interval's setpoint with the event's
+// target, and adds the event to the fields recorded with the command.
+func (s *Service) applyDemandResponse(event demandresponse.Event, interval plan.OptimisationInterval, fields map[string]string) plan.OptimisationInterval {
+	if !interval.IsEmpty() {
+		fields["plannedMeterPower"] = fmt.Sprintf("%.0f", interval.MeterPower.Value)
+	}
+	fields["source"] = sourceDemandResponse
+	fields["eventId"] = event.EventID
+	fields["targetPower"] = fmt.Sprintf("%.3f", event.TargetPower)
+
+	return event.Override(interval)
+}
+
+// checkDemandResponse records when demand response events start and end, in
+// either mode. The end is recorded with the outcome: how many commands the
+// standby issued for the event, and in standby mode, how far the latest cloud
+// command was from the event's target.
+func (s *Service) checkDemandResponse(currentTime time.Time) {
+	event, active := s.activeDemandResponse(currentTime)
+	if s.currentEvent != nil && active && s.currentEvent.EventID == event.EventID {
+		// An update to the event, such as a new target or end, carries on
+		// the same event.
+		s.currentEvent = &event
+		return
+	}
+
+	if s.currentEvent != nil {
+		fields := s.currentEvent.LogFormat(s.location)
+		fields["commands"] = strconv.Itoa(s.eventCommands)
+		if currentTime.Before(s.currentEvent.End()) {
+			fields["endedEarly"] = "true"
+		}
+		if cloud := s.latestCloudCommand(); cloud != nil && s.InStandbyMode() {
+			fields["cloudValue"] = fmt.Sprintf("%.3f", cloud.Value)
+			fields["difference"] = fmt.Sprintf("%.3f", cloud.Value-s.currentEvent.TargetPower)
+		}
+		s.recordEvent(outagelog.EventDemandResponseEnd, fields)
+		s.currentEvent = nil
+	}
+
+	if active {
+		s.recordEvent(outagelog.EventDemandResponseStart, event.LogFormat(s.location))
+		s.currentEvent = &event
+		s.eventCommands = 0
+	}
+}
@@ -0,0 +1,117 @@
+package standby
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// DriftSample compares a command received from the cloud with the setpoint
+// the stored plan gives for the same moment, both in kW.
+type DriftSample struct {
+	Time  time.Time
+	Cloud float64
+	Plan  float64
+}
+
+func (d DriftSample) Error() float64 {
+	return d.Cloud - d.Plan
+}
+
+// DriftStats summarises the samples within the drift window. Missing counts
+// cloud commands for which the plan had no interval at all.
+type DriftStats struct {
+	Samples      int
+	Missing      int
+	MeanError    float64
+	MeanAbsError float64
+	MaxAbsError  float64
+	RMSError     float64
+}
+
+func (d DriftStats) LogFormat() map[string]string {
+	return map[string]string{
+		"samples":      fmt.Sprintf("%d", d.Samples),
+		"missing":      fmt.Sprintf("%d", d.Missing),
+		"meanError":    fmt.Sprintf("%.3f", d.MeanError),
+		"meanAbsError": fmt.Sprintf("%.3f", d.MeanAbsError),
+		"maxAbsError":  fmt.Sprintf("%.3f", d.MaxAbsError),
+		"rmsError":     fmt.Sprintf("%.3f", d.RMSError),
+	}
+}
+
+// DriftTracker keeps the drift samples of a rolling window.
+type DriftTracker struct {
+	mu      *sync.Mutex
+	window  time.Duration
+	samples []DriftSample
+	missing []time.Time
+}
+
+func NewDriftTracker(window time.Duration) *DriftTracker {
+	return &DriftTracker{mu: new(sync.Mutex), window: window}
+}
+
+func (d *DriftTracker) Add(sample DriftSample) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.samples = append(d.samples, sample)
+	d.prune(sample.Time)
+}
+
+// AddMissing records a cloud command for which the plan had no setpoint.
+func (d *DriftTracker) AddMissing(at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.missing = append(d.missing, at)
+	d.prune(at)
+}
+
+// Stats returns the statistics of the samples within the window ending at now.
+func (d *DriftTracker) Stats(now time.Time) DriftStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.prune(now)
+
+	stats := DriftStats{Samples: len(d.samples), Missing: len(d.missing)}
+	if stats.Samples == 0 {
+		return stats
+	}
+
+	var sum, sumAbs, sumSquares float64
+	for _, sample := range d.samples {
+		err := sample.Error()
+		sum += err
+		sumAbs += math.Abs(err)
+		sumSquares += err * err
+		stats.MaxAbsError = math.Max(stats.MaxAbsError, math.Abs(err))
+	}
+
+	n := float64(stats.Samples)
+	stats.MeanError = sum / n
+	stats.MeanAbsError = sumAbs / n
+	stats.RMSError = math.Sqrt(sumSquares / n)
+
+	return stats
+}
+
+// prune drops samples older than the window. d.mu must be held.
+func (d *DriftTracker) prune(now time.Time) {
+	cutoff := now.Add(-d.window)
+
+	i := 0
+	for i < len(d.samples) && d.samples[i].Time.Before(cutoff) {
+		i++
+	}
+	d.samples = d.samples[i:]
+
+	i = 0
+	for i < len(d.missing) && d.missing[i].Before(cutoff) {
+		i++
+	}
+	d.missing = d.missing[i:]
+}
@@ -0,0 +1,56 @@
+package standby
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// EnableEnvelope makes the service update the operating envelope from the
+// envelope topic. Commands are kept within it by the publisher.
+func (s *Service) EnableEnvelope(tracker *envelope.Tracker) {
+	s.envelope = tracker
+}
+
+func (s *Service) handleEnvelopeMessage(_ mqtt.Client, msg mqtt.Message) {
+	s.logger.Debug(fmt.Sprintf("Received envelope: %s from topic: %s", msg.Payload(), msg.Topic()))
+
+	payload, err := envelope.Parse(msg.Payload())
+	if err != nil {
+		s.publisher.PublishError(publisher.CodeEnvelopeInvalid, "reading operating envelope", err, map[string]string{"topic": msg.Topic()})
+		return
+	}
+
+	if err := s.envelope.Update(payload); err != nil {
+		s.publisher.PublishError(publisher.CodeEnvelopeWriteFailed, "storing operating envelope", err, map[string]string{"path": s.cfg.Envelope.File})
+	}
+
+	limits, source := s.envelope.Limits(time.Now())
+	s.logger.Info("Operating envelope updated", "controls", len(payload.DERControl), "source", source,
+		"maxImport", limits.MaxImport, "maxExport", limits.MaxExport)
+}
+
+// recordEnvelope adds the limits to the fields recorded with the command if
+// they change the interval's setpoint.
+func (s *Service) recordEnvelope(currentTime time.Time, interval plan.OptimisationInterval, fields map[string]string) {
+	if s.envelope == nil {
+		return
+	}
+
+	limits, source := s.envelope.Limits(currentTime)
+
+	unlimited := publisher.BuildCommandPayload(s.cfg.MQTT.CommandAction, interval, envelope.NoLimits).Value
+	if limits.Clamp(unlimited) == unlimited {
+		return
+	}
+
+	fields["envelope"] = source
+	fields["unlimitedValue"] = fmt.Sprintf("%.3f", unlimited)
+	for key, value := range limits.LogFormat() {
+		fields[key] = value
+	}
+}
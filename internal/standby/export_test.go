@@ -0,0 +1,68 @@
+package standby
+
+import (
+	"context"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// CheckPlanCoverage runs a single plan coverage check, for tests.
+func (s *Service) CheckPlanCoverage(currentTime time.Time) {
+	s.checkPlanCoverage(currentTime)
+}
+
+// CheckShadow runs a single shadow mode check, for tests.
+func (s *Service) CheckShadow(currentTime time.Time) {
+	s.checkShadow(currentTime)
+}
+
+// RunDetector runs the outage detector until ctx is done, for tests.
+func (s *Service) RunDetector(ctx context.Context) {
+	s.runDetector(ctx)
+}
+
+// HandleCommandMessage handles a cloud command published to topic, for tests.
+func (s *Service) HandleCommandMessage(topic string, payload []byte) {
+	s.handleCommandMessage(nil, testMessage{topic: topic, payload: payload})
+}
+
+// CheckForOutage runs a single outage check, for tests.
+func (s *Service) CheckForOutage(currentTime time.Time) {
+	s.checkForOutage(currentTime)
+}
+
+// CheckDemandResponse runs a single demand response check, for tests.
+func (s *Service) CheckDemandResponse(currentTime time.Time) {
+	s.checkDemandResponse(currentTime)
+}
+
+// PublishSetpoint publishes the command for currentTime, for tests.
+func (s *Service) PublishSetpoint(currentTime time.Time) {
+	s.publishSetpoint(currentTime)
+}
+
+// RecordTelemetry records telemetry received at received, for tests.
+func (s *Service) RecordTelemetry(telemetry TelemetryPayload, received time.Time) {
+	s.recordTelemetry(telemetry, received)
+}
+
+// HandlePlanMessage handles a plan published to topic, for tests.
+func (s *Service) HandlePlanMessage(topic string, payload []byte) {
+	s.handlePlanMessage(nil, testMessage{topic: topic, payload: payload})
+}
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m testMessage) Topic() string   { return m.topic }
+func (m testMessage) Payload() []byte { return m.payload }
+
+// HandleDemandResponseMessage handles a demand response event published to
+// topic, for tests.
+func (s *Service) HandleDemandResponseMessage(topic string, payload []byte) {
+	s.handleDemandResponseMessage(nil, testMessage{topic: topic, payload: payload})
+}
@@ -0,0 +1,120 @@
+package standby
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/controller"
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+)
+
+// EnableSelfConsumption makes the service run the self-consumption
+// controller during an outage whenever the plan has no setpoint.
+func (s *Service) EnableSelfConsumption(controller *controller.SelfConsumption) {
+	s.controller = controller
+}
+
+// EnableTariffFallback makes the service follow a schedule generated from
+// the tariff during an outage whenever the plan has no setpoint.
+func (s *Service) EnableTariffFallback(tariff *plan.Tariff) {
+	s.tariff = tariff
+}
+
+// tariffSetpoint returns the tariff schedule's interval in place of the plan,
+// which could not give a setpoint because of planErr, recording why in fields.
+func (s *Service) tariffSetpoint(currentTime time.Time, planErr error, fields map[string]string) plan.OptimisationInterval {
+	fields["source"] = sourceTariff
+	fields["planError"] = planErr.Error()
+
+	return s.tariff.IntervalAt(currentTime)
+}
+
+// publishFallback publishes a command from the fallback strategy in place of
+// the plan, which could not give a setpoint because of planErr.
+func (s *Service) publishFallback(currentTime time.Time, planErr error) {
+	if s.controller == nil {
+		s.noCommandAvailable(currentTime, planErr)
+		return
+	}
+
+	socFields := map[string]string{}
+	socLimits, socReason := s.socMeterLimits(currentTime, socFields)
+
+	output, err := s.controller.StepWithin(currentTime, socLimits)
+	if err != nil {
+		s.noCommandAvailable(currentTime, fmt.Errorf("%w, and self-consumption fallback unavailable: %w", planErr, err))
+		return
+	}
+	if !output.Due {
+		return
+	}
+
+	fields := output.LogFormat()
+	fields["source"] = sourceController
+	fields["planError"] = planErr.Error()
+	for key, value := range socFields {
+		fields[key] = value
+	}
+	if socReason != "" && (output.Command.Value == socLimits.MaxImport || output.Command.Value == -socLimits.MaxExport) {
+		fields["socHold"] = socReason
+	}
+
+	if s.cfg.Standby.Shadow {
+		s.publishShadow(compareShadowCommand(output.Command, s.latestCloudCommand(), currentTime, fields), fields)
+		return
+	}
+
+	delivery, err := s.controller.Publish(output)
+	if err != nil {
+		s.commandPublishFailed(err, fields)
+		return
+	}
+
+	s.commandPublished(delivery, fields)
+}
+
+// noCommandAvailable records and reports that no command could be issued.
+// While shadowing the cloud in standby mode nothing is missing from the
+// site, and a plan that has run out is already reported by the plan coverage
+// warnings, so it is only logged.
+func (s *Service) noCommandAvailable(currentTime time.Time, err error) {
+	if s.InStandbyMode() {
+		s.logger.Debug("no shadow command available", "error", err)
+		return
+	}
+
+	s.recordEvent(outagelog.EventNoCommandAvailable, map[string]string{"error": err.Error()})
+
+	code := publisher.CodePlanUnavailable
+	if errors.Is(err, plan.ErrNoCurrentInterval) {
+		code = publisher.CodeNoCurrentInterval
+	}
+	s.publisher.PublishError(code, "getting current command", err, map[string]string{"time": currentTime.In(s.location).Format(time.RFC3339)})
+}
+
+// commandPublished records a command in the outage log with the outputs it
+// was delivered to, and reports any outputs that did not accept it.
+func (s *Service) commandPublished(delivery publisher.Delivery, details map[string]string) {
+	for key, value := range delivery.LogFormat() {
+		details[key] = value
+	}
+
+	if err := delivery.Err(); err != nil {
+		s.publisher.PublishError(publisher.CodeCommandPublishFailed, "publishing current command to some outputs", err, details)
+	}
+
+	s.recordEvent(outagelog.EventCommandPublished, details)
+}
+
+// commandPublishFailed records and reports that a command could not be sent.
+func (s *Service) commandPublishFailed(err error, details map[string]string) {
+	code := publisher.CodeCommandPublishFailed
+	if errors.Is(err, publisher.ErrCommandNotConfigured) {
+		code = publisher.CodeCommandNotConfigured
+	}
+	s.publisher.PublishError(code, "publishing current command", err, details)
+	s.recordEvent(outagelog.EventCommandPublishFailed, map[string]string{"error": err.Error()})
+}
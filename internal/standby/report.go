@@ -0,0 +1,113 @@
+package standby
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+)
+
+// sourcePlan, sourceController, sourceTariff, sourceDemandResponse and
+// sourceNone identify where the setpoint for a command came from, or that no
+// setpoint was available at all.
+const (
+	sourcePlan           = "plan"
+	sourceController     = "controller"
+	sourceTariff         = "tariff"
+	sourceDemandResponse = "demand_response"
+	sourceNone           = "none"
+)
+
+// BuildOutageReport summarises the outage log records written between start
+// and end, with times shown in the given time zone.
+func BuildOutageReport(start, end time.Time, records []outagelog.Record, location *time.Location) publisher.OutageReportPayload {
+	report := publisher.OutageReportPayload{
+		Start:           start.Unix(),
+		End:             end.Unix(),
+		StartTime:       start.In(location).Format(time.RFC3339),
+		EndTime:         end.In(location).Format(time.RFC3339),
+		DurationSeconds: int64(end.Sub(start).Seconds()),
+		Intervals:       []publisher.ReportInterval{},
+		Errors:          []publisher.ReportError{},
+		FallbackUsage:   map[string]int{},
+	}
+
+	intervals := map[int64]int{}
+	errs := map[string]int{}
+
+	// The report is truncated if the log no longer holds the start of the
+	// outage, which need not be the first record in the window.
+	report.Truncated = true
+
+	for _, record := range records {
+		if record.Timestamp.After(end) {
+			break
+		}
+
+		switch record.Event {
+		case outagelog.EventEnteredCommandMode:
+			report.Truncated = false
+		case outagelog.EventCommandPublished:
+			report.CommandsIssued++
+
+			source := record.Fields["source"]
+			if source == "" {
+				source = sourcePlan
+			}
+			report.FallbackUsage[source]++
+
+			// Only commands from plan intervals are broken down by interval.
+			if record.Fields["intervalStart"] == "" {
+				continue
+			}
+
+			intStart := parseIntervalStart(record.Fields["intervalStart"])
+			if idx, ok := intervals[intStart.UnixNano()]; ok {
+				report.Intervals[idx].Commands++
+				continue
+			}
+			meterPower, _ := strconv.ParseFloat(record.Fields["meterPower"], 64)
+			intervals[intStart.UnixNano()] = len(report.Intervals)
+			report.Intervals = append(report.Intervals, publisher.ReportInterval{
+				Start:      intStart.Unix(),
+				StartTime:  intStart.In(location).Format(time.RFC3339),
+				MeterPower: meterPower,
+				Source:     source,
+				Commands:   1,
+			})
+		case outagelog.EventNoCommandAvailable, outagelog.EventCommandPublishFailed:
+			if record.Event == outagelog.EventNoCommandAvailable {
+				report.FallbackUsage[sourceNone]++
+			}
+
+			key := string(record.Event) + record.Fields["error"]
+			if idx, ok := errs[key]; ok {
+				report.Errors[idx].Count++
+				report.Errors[idx].Last = record.Timestamp.Unix()
+				continue
+			}
+			errs[key] = len(report.Errors)
+			report.Errors = append(report.Errors, publisher.ReportError{
+				Message: record.Message,
+				Error:   record.Fields["error"],
+				Count:   1,
+				First:   record.Timestamp.Unix(),
+				Last:    record.Timestamp.Unix(),
+			})
+		}
+	}
+
+	return report
+}
+
+// parseIntervalStart parses the start of an interval recorded in the outage
+// log, which older records hold as Unix seconds.
+func parseIntervalStart(value string) time.Time {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0)
+	}
+
+	start, _ := time.Parse(time.RFC3339Nano, value)
+	return start
+}
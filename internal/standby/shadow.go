@@ -0,0 +1,87 @@
+package standby
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/publisher"
+	"github.com/EvergenEnergy/remote-standby/internal/storage"
+)
+
+// BuildShadowCommand builds the command the standby would issue for the
+// interval within the limits, compared with the latest cloud command if there
+// is one, along with the fields to record in the outage log, which show times
+// in the time zone of now.
+func BuildShadowCommand(
+	action string, interval plan.OptimisationInterval, limits envelope.Limits, cloud *storage.Command, now time.Time,
+) (publisher.ShadowCommandPayload, map[string]string) {
+	fields := interval.LogFormat(now.Location())
+	fields["source"] = sourcePlan
+
+	payload := compareShadowCommand(publisher.BuildCommandPayload(action, interval, limits), cloud, now, fields)
+
+	return payload, fields
+}
+
+// compareShadowCommand builds the shadow payload for a command, compared with
+// the latest cloud command if there is one, and adds the comparison to fields.
+func compareShadowCommand(command publisher.CommandPayload, cloud *storage.Command, now time.Time, fields map[string]string) publisher.ShadowCommandPayload {
+	payload := publisher.ShadowCommandPayload{Command: command, Timestamp: now.Unix()}
+
+	fields["value"] = fmt.Sprintf("%.3f", command.Value)
+
+	if cloud == nil {
+		return payload
+	}
+
+	difference := command.Value - cloud.Value
+	age := now.Sub(cloud.Received)
+
+	payload.CloudCommand = &publisher.CommandPayload{Action: cloud.Action, Value: cloud.Value}
+	payload.CloudCommandAge = int64(age.Seconds())
+	payload.Difference = &difference
+
+	fields["cloudValue"] = fmt.Sprintf("%.3f", cloud.Value)
+	fields["cloudCommandAge"] = age.Truncate(time.Second).String()
+	fields["difference"] = fmt.Sprintf("%.3f", difference)
+
+	return payload
+}
+
+// checkShadow works out the command the standby would issue while the cloud
+// is still active, in shadow mode, so that it is compared with the cloud's
+// commands as they arrive rather than only after they have stopped.
+func (s *Service) checkShadow(currentTime time.Time) {
+	if s.cfg.Standby.Shadow && s.InStandbyMode() {
+		s.publishSetpoint(currentTime)
+	}
+}
+
+// publishShadowCommand publishes and logs the command the standby would have
+// issued, without sending it to the site, along with how it was adjusted.
+func (s *Service) publishShadowCommand(currentTime time.Time, interval plan.OptimisationInterval, adjustments map[string]string) {
+	payload, fields := BuildShadowCommand(s.cfg.MQTT.CommandAction, interval, s.publisher.Limits(currentTime), s.latestCloudCommand(), currentTime.In(s.location))
+	for key, value := range adjustments {
+		fields[key] = value
+	}
+
+	s.publishShadow(payload, fields)
+}
+
+func (s *Service) latestCloudCommand() *storage.Command {
+	if latest, ok := s.storageSvc.GetLatestCommand(); ok {
+		return &latest
+	}
+	return nil
+}
+
+func (s *Service) publishShadow(payload publisher.ShadowCommandPayload, fields map[string]string) {
+	if err := s.publisher.PublishShadowCommand(payload); err != nil {
+		s.publisher.PublishError(publisher.CodeShadowNotConfigured, "publishing shadow command", err, nil)
+	}
+
+	s.recordEvent(outagelog.EventShadowCommand, fields)
+}
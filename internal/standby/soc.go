@@ -0,0 +1,184 @@
+package standby
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
+	"github.com/EvergenEnergy/remote-standby/internal/storage"
+)
+
+// Reasons the battery setpoint was held.
+const (
+	socHoldMin       = "soc_min"
+	socHoldMax       = "soc_max"
+	socHoldDeviation = "soc_deviation"
+)
+
+// SoCEstimator tracks the battery's state of charge from telemetry. Between
+// state of charge readings, it extrapolates from the latest battery power
+// reading, if the battery's capacity is known.
+type SoCEstimator struct {
+	mu       sync.Mutex
+	capacity float64
+	maxAge   time.Duration
+
+	known        bool
+	soc          float64
+	at           time.Time
+	batteryPower float64
+	lastSoC      time.Time
+}
+
+// NewSoCEstimator returns an estimator for a battery of the given capacity in
+// kWh, or zero to not extrapolate, whose estimate lapses maxAge after the
+// last state of charge reading. Battery power readings only move the
+// estimate, and don't keep it from lapsing.
+func NewSoCEstimator(capacity float64, maxAge time.Duration) *SoCEstimator {
+	return &SoCEstimator{capacity: capacity, maxAge: maxAge}
+}
+
+// ObserveSoC records a state of charge reading.
+func (e *SoCEstimator) ObserveSoC(soc float64, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.known = true
+	e.soc = soc
+	e.at = at
+	e.lastSoC = at
+}
+
+// ObserveBatteryPower records a battery power reading in kW, positive when charging.
+func (e *SoCEstimator) ObserveBatteryPower(power float64, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.known && at.After(e.at) {
+		e.soc = e.extrapolate(at)
+		e.at = at
+	}
+	e.batteryPower = power
+}
+
+// Estimate returns the estimated state of charge at the given time, or false
+// if there is no recent enough state of charge reading to estimate it from.
+func (e *SoCEstimator) Estimate(at time.Time) (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.known || (e.maxAge > 0 && at.Sub(e.lastSoC) > e.maxAge) {
+		return 0, false
+	}
+
+	return e.extrapolate(at), true
+}
+
+func (e *SoCEstimator) extrapolate(at time.Time) float64 {
+	if e.capacity <= 0 || !at.After(e.at) {
+		return e.soc
+	}
+
+	charged := e.batteryPower * at.Sub(e.at).Hours() / e.capacity
+	return math.Max(0, math.Min(1, e.soc+charged))
+}
+
+// SoCLimits are the bounds the battery is kept within during an outage.
+type SoCLimits struct {
+	Min          float64
+	Max          float64
+	MaxDeviation float64
+}
+
+// HoldForSoC holds the battery in place of the interval's battery setpoint if
+// following it would take the state of charge beyond its limits, or further
+// from the plan's state of charge when it has already deviated too far. The
+// meter setpoint is adjusted to match, taking positive battery power as
+// charging. It returns the reason the battery was held, if it was.
+func HoldForSoC(interval plan.OptimisationInterval, soc float64, limits SoCLimits) (plan.OptimisationInterval, string) {
+	battery := interval.BatteryPower.Kilowatts()
+	charging, discharging := battery > 0, battery < 0
+
+	var reason string
+
+	deviation := soc - float64(interval.StateOfCharge)
+	deviated := interval.StateOfCharge != 0 && limits.MaxDeviation > 0 && math.Abs(deviation) > limits.MaxDeviation
+
+	switch {
+	case discharging && soc <= limits.Min:
+		reason = socHoldMin
+	case charging && soc >= limits.Max:
+		reason = socHoldMax
+	case deviated && ((discharging && deviation < 0) || (charging && deviation > 0)):
+		reason = socHoldDeviation
+	default:
+		return interval, ""
+	}
+
+	interval.MeterPower = interval.MeterPower.WithKilowatts(interval.MeterPower.Kilowatts() - battery)
+	interval.BatteryPower = interval.BatteryPower.WithKilowatts(0)
+
+	return interval, reason
+}
+
+// socMeterLimits returns the meter setpoints that keep the battery from
+// discharging at or below the minimum state of charge, or charging at or above
+// the maximum, for the self-consumption controller, which sets the meter rather
+// than the battery. The battery's share of a meter setpoint is found from the
+// latest meter and battery power readings, taking the battery as idle without
+// a recent battery power reading. It also returns the reason for the limits,
+// if there are any, and adds the estimated state of charge to fields.
+func (s *Service) socMeterLimits(currentTime time.Time, fields map[string]string) (envelope.Limits, string) {
+	soc, ok := s.soc.Estimate(currentTime)
+	if !ok {
+		return envelope.NoLimits, ""
+	}
+	fields["soc"] = fmt.Sprintf("%.3f", soc)
+
+	meter, ok := s.storageSvc.GetReading(storage.ReadingMeterPower)
+	if !ok {
+		return envelope.NoLimits, ""
+	}
+
+	// The meter setpoint at which the battery would be idle.
+	idle := meter.Value
+	if battery, ok := s.storageSvc.GetReading(storage.ReadingBatteryPower); ok && !s.readingExpired(battery, currentTime) {
+		idle -= battery.Value
+	}
+
+	switch {
+	case soc <= s.socLimits.Min:
+		return envelope.Limits{MaxImport: math.Inf(1), MaxExport: -idle}, socHoldMin
+	case soc >= s.socLimits.Max:
+		return envelope.Limits{MaxImport: idle, MaxExport: math.Inf(1)}, socHoldMax
+	default:
+		return envelope.NoLimits, ""
+	}
+}
+
+// readingExpired reports whether a telemetry reading is too old to act on.
+func (s *Service) readingExpired(reading storage.Reading, currentTime time.Time) bool {
+	maxAge := s.cfg.Standby.TelemetryMaxAge
+	return maxAge > 0 && currentTime.Sub(reading.Received) > maxAge
+}
+
+// holdForSoC applies HoldForSoC with the current estimate, and adds what it
+// did to the fields recorded with the command.
+func (s *Service) holdForSoC(currentTime time.Time, interval plan.OptimisationInterval, fields map[string]string) plan.OptimisationInterval {
+	soc, ok := s.soc.Estimate(currentTime)
+	if !ok {
+		return interval
+	}
+	fields["soc"] = fmt.Sprintf("%.3f", soc)
+
+	held, reason := HoldForSoC(interval, soc, s.socLimits)
+	if reason != "" {
+		fields["socHold"] = reason
+		fields["plannedMeterPower"] = fmt.Sprintf("%.0f", interval.MeterPower.Value)
+	}
+
+	return held
+}
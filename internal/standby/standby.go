@@ -2,13 +2,18 @@ package standby
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/controller"
+	"github.com/EvergenEnergy/remote-standby/internal/demandresponse"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
 	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
 	"github.com/EvergenEnergy/remote-standby/internal/plan"
 	"github.com/EvergenEnergy/remote-standby/internal/publisher"
@@ -33,6 +38,25 @@ type Service struct {
 	mutex       *sync.Mutex
 	mode        ServiceMode
 	logHandler  *outagelog.Handler
+	verifier    *plan.Verifier
+	archive     *plan.Archive
+	location    *time.Location
+
+	interpolator plan.Interpolator
+	soc          *SoCEstimator
+	socLimits    SoCLimits
+	controller   *controller.SelfConsumption
+	tariff       *plan.Tariff
+	envelope     *envelope.Tracker
+
+	demandResponse *demandresponse.Store
+	currentEvent   *demandresponse.Event
+	eventCommands  int
+
+	drift               *DriftTracker
+	lastCoverageWarning time.Time
+	lastDriftAlert      time.Time
+	outageStart         time.Time
 }
 
 func NewService(
@@ -47,11 +71,41 @@ func NewService(
 		publisher:   publisher,
 		mutex:       new(sync.Mutex),
 		mode:        StandbyMode,
-		planHandler: plan.NewHandler(logger, cfg.Standby.BackupFile),
+		planHandler: plan.NewHandler(logger, cfg.Standby.BackupFile).WithCompression(plan.Compression(cfg.Standby.PlanCompression), cfg.Standby.PlanMaxSize),
 		logHandler:  logHandler,
+		location:    time.Local,
+		drift:       NewDriftTracker(cfg.Standby.DriftWindow),
+		interpolator: plan.Interpolator{
+			Mode:     plan.Interpolation(cfg.Standby.Interpolation),
+			RampRate: cfg.Standby.RampRate,
+		},
+		soc: NewSoCEstimator(cfg.Standby.BatteryCapacity, cfg.Standby.TelemetryMaxAge),
+		socLimits: SoCLimits{
+			Min:          cfg.Standby.SoCMin,
+			Max:          cfg.Standby.SoCMax,
+			MaxDeviation: cfg.Standby.SoCMaxDeviation,
+		},
 	}
 }
 
+// SetLocation sets the site's time zone, which times in outage log records,
+// published errors and outage reports are shown in. It is the local time zone
+// by default.
+func (s *Service) SetLocation(location *time.Location) {
+	s.location = location
+}
+
+// EnablePlanVerification makes the service reject plans that are not signed
+// by one of the verifier's keys.
+func (s *Service) EnablePlanVerification(verifier *plan.Verifier) {
+	s.verifier = verifier
+}
+
+// EnablePlanArchive makes the service keep every plan it accepts in the archive.
+func (s *Service) EnablePlanArchive(archive *plan.Archive) {
+	s.archive = archive
+}
+
 func (s *Service) subscribeToTopic(topic string, handler mqtt.MessageHandler) {
 	token := s.mqttClient.Subscribe(topic, 1, handler)
 	token.Wait()
@@ -60,26 +114,119 @@ func (s *Service) subscribeToTopic(topic string, handler mqtt.MessageHandler) {
 
 func (s *Service) handleCommandMessage(_ mqtt.Client, msg mqtt.Message) {
 	s.logger.Debug(fmt.Sprintf("Received command: %s from topic: %s", msg.Payload(), msg.Topic()))
-	s.storageSvc.SetCommandTimestamp(time.Now())
+
+	received := time.Now()
+	s.storageSvc.SetCommandTimestamp(received)
+
+	command, err := publisher.ParseCommandPayload(msg.Payload(), s.cfg.MQTT.CommandAction)
+	if err != nil {
+		s.logger.Debug("command not recognised", "error", err)
+		return
+	}
+	s.storageSvc.SetLatestCommand(storage.Command{Action: command.Action, Value: command.Value, Received: received})
+
+	if s.InStandbyMode() {
+		s.trackDrift(received, command.Value)
+	}
+}
+
+// trackDrift compares a cloud command with the setpoint the plan gives for the same moment.
+func (s *Service) trackDrift(received time.Time, cloudValue float64) {
+	interval, err := s.planHandler.GetCurrentInterval(received)
+
+	// During a demand response event the cloud is expected to follow the event.
+	event, eventActive := s.activeDemandResponse(received)
+	switch {
+	case eventActive:
+		interval = event.Override(interval)
+	case err != nil:
+		s.drift.AddMissing(received)
+		return
+	}
+
+	planValue := publisher.BuildCommandPayload(s.cfg.MQTT.CommandAction, interval, s.publisher.Limits(received)).Value
+	s.drift.Add(DriftSample{Time: received, Cloud: cloudValue, Plan: planValue})
 }
 
 func (s *Service) handlePlanMessage(_ mqtt.Client, msg mqtt.Message) {
 	s.logger.Debug(fmt.Sprintf("Received plan in message: %s from topic: %s", msg.Payload(), msg.Topic()))
 
-	optPlan := plan.OptimisationPlan{}
+	format := plan.FormatJSON
+	if s.cfg.MQTT.ProtobufSuffix != "" && strings.HasSuffix(msg.Topic(), s.cfg.MQTT.ProtobufSuffix) {
+		format = plan.FormatProtobuf
+	}
+
+	payload, err := s.verifySignature(msg.Payload())
+	if err != nil {
+		s.publisher.PublishError(publisher.CodePlanSignatureInvalid, "verifying optimisation plan signature", err, map[string]string{"topic": msg.Topic()})
+		return
+	}
+
+	var optPlan plan.OptimisationPlan
 
-	err := json.Unmarshal(msg.Payload(), &optPlan)
+	payload, err = plan.Decompress(payload, s.cfg.Standby.PlanMaxSize)
+	if err == nil {
+		optPlan, err = plan.Decode(payload, format)
+	}
 	if err == nil && optPlan.IsEmpty() {
 		err = fmt.Errorf("optimisation plan is empty")
 	}
 	if err != nil {
-		s.publisher.PublishError("reading optimisation plan", err)
+		s.publisher.PublishError(publisher.CodePlanInvalid, "reading optimisation plan", err, map[string]string{"topic": msg.Topic(), "format": string(format)})
+		return
+	}
+
+	if s.verifier != nil {
+		if err := s.checkPlanFresh(optPlan); err != nil {
+			s.publisher.PublishError(publisher.CodePlanReplayed, "checking optimisation plan is fresh", err, map[string]string{"topic": msg.Topic()})
+			return
+		}
 	}
 
-	err = s.planHandler.WritePlan(optPlan)
+	received := time.Now()
+
+	merged, err := s.planHandler.MergePlan(optPlan, received)
 	if err != nil {
-		s.publisher.PublishError("writing optimisation plan", err)
+		s.publisher.PublishError(publisher.CodePlanWriteFailed, "writing optimisation plan", err, map[string]string{"path": s.cfg.Standby.BackupFile})
+		return
+	}
+	s.logger.Debug("Stored optimisation plan", "replace", optPlan.Replace, "received", len(optPlan.OptimisationIntervals), "stored", len(merged.OptimisationIntervals))
+
+	if s.archive != nil {
+		if err := s.archive.Add(merged, received); err != nil {
+			s.publisher.PublishError(publisher.CodePlanWriteFailed, "archiving optimisation plan", err, map[string]string{"path": s.cfg.Standby.PlanArchiveDir})
+		}
+	}
+}
+
+// verifySignature returns the payload of a message signed with one of the
+// plan keys. Without plan keys, it returns the message as it is if unsigned
+// messages are allowed.
+func (s *Service) verifySignature(message []byte) ([]byte, error) {
+	if s.verifier != nil {
+		return s.verifier.Verify(message)
+	}
+	if !s.cfg.Standby.AllowUnsignedPlans {
+		return nil, fmt.Errorf("%w: no plan keys configured and unsigned plans are not allowed", plan.ErrUnsigned)
+	}
+	return message, nil
+}
+
+// checkPlanFresh rejects a signed plan that is for another site or is no
+// newer than the stored plan, which carries the timestamp of the newest plan
+// accepted.
+func (s *Service) checkPlanFresh(optPlan plan.OptimisationPlan) error {
+	var lastAccepted plan.OptimisationTimestamp
+
+	stored, err := s.planHandler.ReadPlan()
+	switch {
+	case err == nil:
+		lastAccepted = stored.OptimisationTimestamp
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("reading stored plan: %w", err)
 	}
+
+	return plan.CheckFresh(optPlan, s.cfg.SiteName, lastAccepted)
 }
 
 func (s *Service) runMQTT() error {
@@ -89,6 +236,15 @@ func (s *Service) runMQTT() error {
 
 	s.subscribeToTopic(s.cfg.MQTT.StandbyTopic, s.handlePlanMessage)
 	s.subscribeToTopic(s.cfg.MQTT.ReadCommandTopic, s.handleCommandMessage)
+	if s.cfg.MQTT.TelemetryTopic != "" {
+		s.subscribeToTopic(s.cfg.MQTT.TelemetryTopic, s.handleTelemetryMessage)
+	}
+	if s.envelope != nil && s.cfg.MQTT.EnvelopeTopic != "" {
+		s.subscribeToTopic(s.cfg.MQTT.EnvelopeTopic, s.handleEnvelopeMessage)
+	}
+	if s.demandResponse != nil && s.cfg.MQTT.DemandResponseTopic != "" {
+		s.subscribeToTopic(s.cfg.MQTT.DemandResponseTopic, s.handleDemandResponseMessage)
+	}
 
 	return nil
 }
@@ -102,10 +258,31 @@ func (s *Service) runDetector(ctx context.Context) {
 
 	ticker := time.NewTicker(checkInterval)
 
+	// Commands are published on every check unless a command interval is set.
+	var commandTicks <-chan time.Time
+	if s.cfg.Standby.CommandInterval > 0 {
+		commandTicker := time.NewTicker(s.cfg.Standby.CommandInterval)
+		defer commandTicker.Stop()
+		commandTicks = commandTicker.C
+	}
+
 	for {
 		select {
 		case <-ticker.C:
-			s.checkForOutage(time.Now())
+			currentTime := time.Now()
+			s.checkDemandResponse(currentTime)
+			s.checkForOutage(currentTime)
+			if s.cfg.Standby.CommandInterval == 0 {
+				s.checkShadow(currentTime)
+			}
+			s.checkPlanCoverage(currentTime)
+			s.checkPlanDrift(currentTime)
+		case currentTime := <-commandTicks:
+			s.checkDemandResponse(currentTime)
+			if s.InCommandMode() {
+				s.publishSetpoint(currentTime)
+			}
+			s.checkShadow(currentTime)
 		case <-ctx.Done():
 			ticker.Stop()
 
@@ -125,7 +302,8 @@ func (s *Service) checkForOutage(currentTime time.Time) {
 		if s.InCommandMode() {
 			s.logger.Info("Commands resumed after outage", "time since last command", timeSinceLastCmd)
 			s.setMode(StandbyMode)
-			s.logHandler.Append("Resumed standby mode", map[string]string{"timeSinceLastCmd": timeSinceLastCmd.String()})
+			s.recordEvent(outagelog.EventResumedStandbyMode, map[string]string{"timeSinceLastCmd": timeSinceLastCmd.String()})
+			s.reportOutage(currentTime)
 		}
 		return
 	}
@@ -133,25 +311,158 @@ func (s *Service) checkForOutage(currentTime time.Time) {
 	if s.InStandbyMode() {
 		s.logger.Info("Outage detected", "config threshold", outageThreshold, "time since last command", timeSinceLastCmd)
 		s.setMode(CommandMode)
-		s.logHandler.Append("Entered command mode", map[string]string{"timeSinceLastCmd": timeSinceLastCmd.String()})
+		s.outageStart = currentTime
+		if s.controller != nil {
+			s.controller.Reset()
+		}
+		s.recordEvent(outagelog.EventEnteredCommandMode, map[string]string{"timeSinceLastCmd": timeSinceLastCmd.String()})
+	} else if s.cfg.Standby.CommandInterval > 0 {
+		return
+	}
+
+	s.publishSetpoint(currentTime)
+}
+
+// publishSetpoint sends the command for the plan's setpoint at the current time.
+func (s *Service) publishSetpoint(currentTime time.Time) {
+	adjustments := map[string]string{}
+
+	// A demand response event takes priority over the plan and the fallbacks.
+	event, eventActive := s.activeDemandResponse(currentTime)
+
+	currentInterval, err := s.planHandler.GetSetpoint(currentTime, s.interpolator)
+	switch {
+	case err != nil && eventActive:
+		adjustments["planError"] = err.Error()
+	case err != nil && s.tariff != nil:
+		currentInterval = s.tariffSetpoint(currentTime, err, adjustments)
+	case err != nil:
+		s.publishFallback(currentTime, err)
+		return
 	}
 
-	currentInterval, err := s.planHandler.GetCurrentInterval(currentTime)
+	// The controller starts afresh if the plan runs out again.
+	if s.controller != nil {
+		s.controller.Reset()
+	}
+
+	if eventActive {
+		currentInterval = s.applyDemandResponse(event, currentInterval, adjustments)
+	}
+
+	currentInterval = s.holdForSoC(currentTime, currentInterval, adjustments)
+	s.recordEnvelope(currentTime, currentInterval, adjustments)
+
+	if s.cfg.Standby.Shadow {
+		s.publishShadowCommand(currentTime, currentInterval, adjustments)
+		if eventActive {
+			s.eventCommands++
+		}
+		return
+	}
+
+	delivery, err := s.publisher.PublishCommand(currentInterval)
 	if err != nil {
-		s.logHandler.Append("No command available", nil)
+		s.commandPublishFailed(err, currentInterval.LogFormat(s.location))
+		return
+	}
+	if eventActive {
+		s.eventCommands++
+	}
 
-		s.publisher.PublishError("getting current command", err)
+	details := currentInterval.LogFormat(s.location)
+	details["source"] = sourcePlan
+	for key, value := range adjustments {
+		details[key] = value
+	}
+	s.commandPublished(delivery, details)
+}
+
+// checkPlanCoverage warns when the stored plan is close to running out or has
+// too many gaps, so that it can be refreshed before an outage relies on it.
+func (s *Service) checkPlanCoverage(currentTime time.Time) {
+	warningInterval := s.cfg.Standby.CoverageWarningInterval
+	if !s.lastCoverageWarning.IsZero() && currentTime.Sub(s.lastCoverageWarning) < warningInterval {
 		return
 	}
 
-	err = s.publisher.PublishCommand(currentInterval)
+	coverage, err := s.planHandler.GetCoverage(currentTime)
 	if err != nil {
-		s.publisher.PublishError("publishing current command", err)
-		s.logHandler.Append("Error publishing command", map[string]string{"error": err.Error()})
+		s.lastCoverageWarning = currentTime
+		s.publisher.PublishError(publisher.CodeCoverageUnavailable, "checking plan coverage", err, nil)
+		return
+	}
+
+	s.logger.Debug("plan coverage", "lastIntervalEnd", coverage.LastIntervalEnd, "gaps", len(coverage.Gaps), "coveredPercent", coverage.CoveredPercent)
+
+	var (
+		code        publisher.ErrorCode
+		coverageErr error
+	)
+
+	switch {
+	case coverage.Remaining() < s.cfg.Standby.CoverageMinHorizon:
+		code = publisher.CodeCoverageHorizonLow
+		coverageErr = fmt.Errorf("plan ends at %s, within %s", coverage.LastIntervalEnd.In(s.location).Format(time.RFC3339), s.cfg.Standby.CoverageMinHorizon)
+	case coverage.CoveredPercent < s.cfg.Standby.CoverageMinPercent:
+		code = publisher.CodeCoveragePercentLow
+		coverageErr = fmt.Errorf("plan covers %.1f%% of the next %s in %d gaps, below %.1f%%",
+			coverage.CoveredPercent, plan.CoverageWindow, len(coverage.Gaps), s.cfg.Standby.CoverageMinPercent)
+	default:
 		return
 	}
 
-	s.logHandler.Append("Published command", currentInterval.LogFormat())
+	s.lastCoverageWarning = currentTime
+	s.publisher.PublishError(code, "insufficient plan coverage", coverageErr, coverage.LogFormat(s.location))
+}
+
+// checkPlanDrift alerts when the cloud's commands have been diverging from
+// the stored plan, which suggests the plan cannot be trusted in an outage.
+func (s *Service) checkPlanDrift(currentTime time.Time) {
+	if !s.lastDriftAlert.IsZero() && currentTime.Sub(s.lastDriftAlert) < s.cfg.Standby.DriftAlertInterval {
+		return
+	}
+
+	stats := s.drift.Stats(currentTime)
+	s.logger.Debug("plan drift", "samples", stats.Samples, "meanAbsError", stats.MeanAbsError, "maxAbsError", stats.MaxAbsError)
+
+	if stats.Samples < s.cfg.Standby.DriftMinSamples || stats.MeanAbsError <= s.cfg.Standby.DriftThreshold {
+		return
+	}
+
+	s.lastDriftAlert = currentTime
+
+	driftErr := fmt.Errorf("cloud commands differ from the plan by %.3f kW on average over %d commands in the last %s, above %.3f kW",
+		stats.MeanAbsError, stats.Samples, s.cfg.Standby.DriftWindow, s.cfg.Standby.DriftThreshold)
+	s.publisher.PublishError(publisher.CodePlanDrift, "plan diverges from cloud commands", driftErr, stats.LogFormat())
+}
+
+// reportOutage publishes a summary of the outage that has just ended.
+func (s *Service) reportOutage(endTime time.Time) {
+	records, err := s.logHandler.Query(outagelog.Filter{From: s.outageStart})
+	if err != nil {
+		s.logger.Error("reading outage log for report", "error", err)
+	}
+
+	report := BuildOutageReport(s.outageStart, endTime, records, s.location)
+
+	s.logger.Info("Reporting outage", "duration", endTime.Sub(s.outageStart), "commands issued", report.CommandsIssued)
+
+	if err := s.publisher.PublishOutageReport(report); err != nil {
+		code := publisher.CodeReportPublishFailed
+		if errors.Is(err, publisher.ErrReportNotConfigured) {
+			code = publisher.CodeReportNotConfigured
+		}
+		s.publisher.PublishError(code, "publishing outage report", err, nil)
+	}
+}
+
+// recordEvent appends an event to the outage log and publishes it as a status
+// event, which is queued for delivery if the broker is unreachable.
+func (s *Service) recordEvent(event outagelog.EventType, fields map[string]string) {
+	mode := string(s.getMode())
+	s.logHandler.Append(event, mode, fields)
+	s.publisher.PublishEvent(string(event), event.Message(), mode, fields)
 }
 
 func (s *Service) Start(ctx context.Context) error {
@@ -160,13 +471,20 @@ func (s *Service) Start(ctx context.Context) error {
 	}
 
 	go s.runDetector(ctx)
-	s.logHandler.Append("Service started", nil)
+
+	var fields map[string]string
+	if s.cfg.Standby.Shadow {
+		s.logger.Info("Running in shadow mode, commands will be published to the shadow topic only", "topic", s.cfg.MQTT.ShadowTopic)
+		fields = map[string]string{"shadow": "true"}
+	}
+	s.recordEvent(outagelog.EventServiceStarted, fields)
+
 	return nil
 }
 
 func (s *Service) Stop() {
 	s.stopMQTT()
-	s.logHandler.Append("Service stopped", nil)
+	s.recordEvent(outagelog.EventServiceStopped, nil)
 }
 
 func (s *Service) setMode(newMode ServiceMode) {
@@ -2,15 +2,21 @@ package standby_test
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/demandresponse"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
 	"github.com/EvergenEnergy/remote-standby/internal/mqtt"
 	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
 	"github.com/EvergenEnergy/remote-standby/internal/plan"
@@ -19,6 +25,7 @@ import (
 	"github.com/EvergenEnergy/remote-standby/internal/storage"
 	pahoMQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -37,10 +44,11 @@ func getTestConfig() config.Config {
 			CommandAction:     "STORAGEPOINT",
 		},
 		Standby: config.StandbyConfig{
-			CheckInterval:   time.Duration(1 * time.Second),
-			OutageThreshold: time.Duration(2 * time.Second),
-			BackupFile:      "/tmp/backup-plan.json",
-			OutageLogFile:   "/tmp/outage.log",
+			CheckInterval:      time.Duration(1 * time.Second),
+			OutageThreshold:    time.Duration(2 * time.Second),
+			BackupFile:         "/tmp/backup-plan.json",
+			OutageLogFile:      "/tmp/outage.log",
+			AllowUnsignedPlans: true,
 		},
 	}
 }
@@ -52,7 +60,7 @@ func TestUpdatesTimestamp_Integration(t *testing.T) {
 	cfg := getTestConfig()
 	mqttClient := mqtt.NewClient(cfg)
 	storageSvc := storage.NewService(testLogger)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
 	logHandle, err := outagelog.Open(cfg.Standby.OutageLogFile)
 	assert.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
@@ -100,7 +108,7 @@ func TestPublishesError_Integration(t *testing.T) {
 	cfg := getTestConfig()
 	mqttClient := mqtt.NewClient(cfg)
 	storageSvc := storage.NewService(testLogger)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
 	logHandle, err := outagelog.Open(cfg.Standby.OutageLogFile)
 	assert.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
@@ -114,7 +122,7 @@ func TestPublishesError_Integration(t *testing.T) {
 	assert.NoError(t, err)
 	defer svc.Stop()
 
-	errTopic := fmt.Sprintf("%s/%s", cfg.MQTT.ErrorTopic, "Standby")
+	errTopic := fmt.Sprintf("%s/%s", cfg.MQTT.ErrorTopic, publisher.ErrorCategoryPlan)
 	mqttClient.Subscribe(errTopic, 1, func(client pahoMQTT.Client, msg pahoMQTT.Message) {
 		setErr(true)
 	})
@@ -150,6 +158,159 @@ func getOptPlan() plan.OptimisationPlan {
 	}
 }
 
+// recordingClient is an MQTT client that records what is published instead of
+// sending it to a broker.
+type recordingClient struct {
+	pahoMQTT.Client
+
+	mu        sync.Mutex
+	published map[string][][]byte
+}
+
+func (c *recordingClient) Publish(topic string, _ byte, _ bool, payload interface{}) pahoMQTT.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.published == nil {
+		c.published = map[string][][]byte{}
+	}
+	c.published[topic] = append(c.published[topic], payload.([]byte))
+
+	return &pahoMQTT.DummyToken{}
+}
+
+func (c *recordingClient) errorCodes(t *testing.T, topic string) []publisher.ErrorCode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var codes []publisher.ErrorCode
+	for _, payload := range c.published[topic] {
+		var errPayload publisher.ErrorPayload
+		require.NoError(t, json.Unmarshal(payload, &errPayload))
+		codes = append(codes, errPayload.Code)
+	}
+	return codes
+}
+
+func newCoverageTestService(t *testing.T, intervals [][2]time.Time) (*standby.Service, *recordingClient) {
+	cfg := getTestConfig()
+	cfg.Standby.CoverageMinPercent = 50
+	cfg.Standby.CoverageMinHorizon = 6 * time.Hour
+	cfg.Standby.CoverageWarningInterval = time.Hour
+
+	return newRecordingTestService(t, cfg, intervals)
+}
+
+// newRecordingTestService returns a service with a plan made of the given
+// intervals, if any, whose messages are recorded rather than published.
+func newRecordingTestService(t *testing.T, cfg config.Config, intervals [][2]time.Time) (*standby.Service, *recordingClient) {
+	if intervals == nil {
+		return newPlanTestService(t, cfg, nil)
+	}
+
+	optPlan := getOptPlan()
+	optPlan.OptimisationIntervals = nil
+	for _, interval := range intervals {
+		optPlan.OptimisationIntervals = append(optPlan.OptimisationIntervals, plan.OptimisationInterval{
+			Interval: plan.OptimisationIntervalTimestamp{
+				StartTime: plan.NewTimestamp(interval[0]),
+				EndTime:   plan.NewTimestamp(interval[1]),
+			},
+			MeterPower: plan.OptimisationValue{Value: 400, Unit: 2},
+		})
+	}
+	return newPlanTestService(t, cfg, &optPlan)
+}
+
+// newPlanTestService returns a service that has stored optPlan, if it is not
+// nil, and publishes to a recording client.
+func newPlanTestService(t *testing.T, cfg config.Config, optPlan *plan.OptimisationPlan) (*standby.Service, *recordingClient) {
+	cfg.Standby.BackupFile = filepath.Join(t.TempDir(), "backup-plan.json")
+
+	if optPlan != nil {
+		require.NoError(t, plan.NewHandler(testLogger, cfg.Standby.BackupFile).WritePlan(*optPlan))
+	}
+
+	client := &recordingClient{}
+	publisherSvc := publisher.NewService(testLogger, cfg, client, nil)
+	logHandler := outagelog.NewHandler(outagelog.NewRingSink(100), testLogger)
+
+	return standby.NewService(testLogger, cfg, storage.NewService(testLogger), publisherSvc, logHandler, client), client
+}
+
+func (c *recordingClient) messages(topic string) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.published[topic]
+}
+
+// lastCommand returns the value of the last command published to topic.
+func (c *recordingClient) lastCommand(t *testing.T, topic string) float64 {
+	messages := c.messages(topic)
+	require.NotEmpty(t, messages)
+
+	var payload []publisher.CommandPayload
+	require.NoError(t, json.Unmarshal(messages[len(messages)-1], &payload))
+	require.Len(t, payload, 1)
+	return payload[0].Value
+}
+
+func TestCheckPlanCoverage_RateLimitsWarnings(t *testing.T) {
+	now := time.Unix(1715319000, 0)
+	standbySvc, client := newCoverageTestService(t, [][2]time.Time{{now, now.Add(time.Hour)}})
+	errTopic := getTestConfig().MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlanCoverage)
+
+	standbySvc.CheckPlanCoverage(now)
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodeCoverageHorizonLow}, client.errorCodes(t, errTopic))
+
+	// Warnings are not repeated within the warning interval.
+	standbySvc.CheckPlanCoverage(now.Add(30 * time.Minute))
+	assert.Len(t, client.errorCodes(t, errTopic), 1)
+
+	standbySvc.CheckPlanCoverage(now.Add(time.Hour))
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodeCoverageHorizonLow, publisher.CodeCoverageHorizonLow}, client.errorCodes(t, errTopic))
+}
+
+func TestCheckPlanCoverage_ChoosesErrorCode(t *testing.T) {
+	now := time.Unix(1715319000, 0)
+	errTopic := getTestConfig().MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlanCoverage)
+
+	tests := []struct {
+		name      string
+		intervals [][2]time.Time
+		expected  []publisher.ErrorCode
+	}{
+		{
+			name:     "no plan",
+			expected: []publisher.ErrorCode{publisher.CodeCoverageUnavailable},
+		},
+		{
+			name:      "plan ends soon",
+			intervals: [][2]time.Time{{now, now.Add(time.Hour)}},
+			expected:  []publisher.ErrorCode{publisher.CodeCoverageHorizonLow},
+		},
+		{
+			name:      "plan has gaps",
+			intervals: [][2]time.Time{{now, now.Add(time.Hour)}, {now.Add(23 * time.Hour), now.Add(24 * time.Hour)}},
+			expected:  []publisher.ErrorCode{publisher.CodeCoveragePercentLow},
+		},
+		{
+			name:      "plan covers the window",
+			intervals: [][2]time.Time{{now, now.Add(24 * time.Hour)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standbySvc, client := newCoverageTestService(t, tt.intervals)
+
+			standbySvc.CheckPlanCoverage(now)
+			assert.Equal(t, tt.expected, client.errorCodes(t, errTopic))
+		})
+	}
+}
+
 func TestStoresAndReplaysAPlan_Integration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode.")
@@ -171,7 +332,7 @@ func TestStoresAndReplaysAPlan_Integration(t *testing.T) {
 	cfg := getTestConfig()
 	mqttClient := mqtt.NewClient(cfg)
 	storageSvc := storage.NewService(testLogger)
-	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient)
+	publisherSvc := publisher.NewService(testLogger, cfg, mqttClient, nil)
 	logHandle, err := outagelog.Open(cfg.Standby.OutageLogFile)
 	assert.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
@@ -228,7 +389,7 @@ func TestDetectsOutage_Integration(t *testing.T) {
 	cfg := getTestConfig()
 	mqttClient := mqtt.NewClient(cfg)
 	storageSvc := storage.NewService(testLogger)
-	publisher := publisher.NewService(testLogger, cfg, mqttClient)
+	publisher := publisher.NewService(testLogger, cfg, mqttClient, nil)
 	logHandle, err := outagelog.Open(cfg.Standby.OutageLogFile)
 	assert.NoError(t, err)
 	logHandler := outagelog.NewHandler(logHandle, testLogger)
@@ -265,3 +426,584 @@ func TestDetectsOutage_Integration(t *testing.T) {
 
 	svc.Stop()
 }
+
+func TestBuildOutageReport(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+	end := start.Add(10 * time.Minute)
+
+	records := []outagelog.Record{
+		{Timestamp: start, Event: outagelog.EventEnteredCommandMode},
+		{Timestamp: start.Add(time.Minute), Event: outagelog.EventCommandPublished, Fields: map[string]string{"intervalStart": "1715319000", "meterPower": "400"}},
+		// records written since interval starts were logged in RFC 3339
+		{Timestamp: start.Add(2 * time.Minute), Event: outagelog.EventCommandPublished, Fields: map[string]string{"intervalStart": "2024-05-10T15:30:00+10:00", "meterPower": "400"}},
+		{Timestamp: start.Add(6 * time.Minute), Event: outagelog.EventNoCommandAvailable, Fields: map[string]string{"error": "no current interval found in plan"}},
+		{Timestamp: start.Add(7 * time.Minute), Event: outagelog.EventNoCommandAvailable, Fields: map[string]string{"error": "no current interval found in plan"}},
+		{Timestamp: start.Add(8 * time.Minute), Event: outagelog.EventCommandPublished, Fields: map[string]string{"source": "controller", "value": "-1.500"}},
+		{Timestamp: end, Event: outagelog.EventResumedStandbyMode},
+	}
+
+	report := standby.BuildOutageReport(start, end, records, time.UTC)
+
+	assert.Equal(t, start.Unix(), report.Start)
+	assert.EqualValues(t, 600, report.DurationSeconds)
+	assert.Equal(t, 3, report.CommandsIssued)
+	assert.False(t, report.Truncated)
+
+	assert.Len(t, report.Intervals, 1)
+	assert.Equal(t, int64(1715319000), report.Intervals[0].Start)
+	assert.Equal(t, "2024-05-10T05:30:00Z", report.Intervals[0].StartTime)
+	assert.Equal(t, "2024-05-10T05:40:00Z", report.EndTime)
+	assert.InDelta(t, 400, report.Intervals[0].MeterPower, 0.0001)
+	assert.Equal(t, 2, report.Intervals[0].Commands)
+
+	assert.Len(t, report.Errors, 1)
+	assert.Equal(t, 2, report.Errors[0].Count)
+	assert.Equal(t, start.Add(7*time.Minute).Unix(), report.Errors[0].Last)
+
+	assert.Equal(t, map[string]int{"plan": 2, "none": 2, "controller": 1}, report.FallbackUsage)
+}
+
+func TestBuildOutageReport_WhenOutageStartIsMissing_IsTruncated(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+
+	report := standby.BuildOutageReport(start, start.Add(time.Minute), nil, time.Local)
+
+	assert.True(t, report.Truncated)
+	assert.Zero(t, report.CommandsIssued)
+}
+
+func TestBuildOutageReport_WhenAnotherEventComesFirst_IsNotTruncated(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+
+	records := []outagelog.Record{
+		{Timestamp: start, Event: outagelog.EventDemandResponseStart},
+		{Timestamp: start, Event: outagelog.EventEnteredCommandMode},
+		{Timestamp: start.Add(time.Minute), Event: outagelog.EventCommandPublished, Fields: map[string]string{"source": "demand_response"}},
+	}
+
+	report := standby.BuildOutageReport(start, start.Add(time.Minute), records, time.UTC)
+
+	assert.False(t, report.Truncated)
+	assert.Equal(t, 1, report.CommandsIssued)
+}
+
+func TestBuildShadowCommand(t *testing.T) {
+	now := time.Unix(1715319000, 0)
+	interval := plan.OptimisationInterval{
+		Interval:   plan.OptimisationIntervalTimestamp{StartTime: plan.OptimisationTimestamp{Seconds: now.Unix()}},
+		MeterPower: plan.OptimisationValue{Value: 2500, Unit: publisher.MeterPowerUnitWatt},
+	}
+	cloud := storage.Command{Action: "STORAGEPOINT", Value: 4, Received: now.Add(-90 * time.Second)}
+
+	payload, fields := standby.BuildShadowCommand("STORAGEPOINT", interval, envelope.NoLimits, &cloud, now)
+
+	assert.InDelta(t, 2.5, payload.Command.Value, 0.0001)
+	assert.InDelta(t, 4, payload.CloudCommand.Value, 0.0001)
+	assert.EqualValues(t, 90, payload.CloudCommandAge)
+	assert.InDelta(t, -1.5, *payload.Difference, 0.0001)
+	assert.Equal(t, "-1.500", fields["difference"])
+	assert.Equal(t, "1m30s", fields["cloudCommandAge"])
+}
+
+func TestBuildShadowCommand_WithoutCloudCommand(t *testing.T) {
+	interval := plan.OptimisationInterval{MeterPower: plan.OptimisationValue{Value: 3, Unit: publisher.MeterPowerUnitKilowatt}}
+
+	payload, fields := standby.BuildShadowCommand("STORAGEPOINT", interval, envelope.NoLimits, nil, time.Now())
+
+	assert.InDelta(t, 3, payload.Command.Value, 0.0001)
+	assert.Nil(t, payload.CloudCommand)
+	assert.Nil(t, payload.Difference)
+	assert.NotContains(t, fields, "difference")
+}
+
+func TestDriftTrackerStats(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+	tracker := standby.NewDriftTracker(time.Hour)
+
+	tracker.Add(standby.DriftSample{Time: start, Cloud: 10, Plan: 0})
+	tracker.Add(standby.DriftSample{Time: start.Add(40 * time.Minute), Cloud: 5, Plan: 4})
+	tracker.Add(standby.DriftSample{Time: start.Add(50 * time.Minute), Cloud: 2, Plan: 5})
+
+	stats := tracker.Stats(start.Add(50 * time.Minute))
+	assert.Equal(t, 3, stats.Samples)
+	assert.Equal(t, 0, stats.Missing)
+	assert.InDelta(t, 8.0/3, stats.MeanError, 0.0001)
+	assert.InDelta(t, 14.0/3, stats.MeanAbsError, 0.0001)
+	assert.InDelta(t, 10, stats.MaxAbsError, 0.0001)
+
+	tracker.AddMissing(start.Add(55 * time.Minute))
+
+	// the first sample falls out of the window
+	stats = tracker.Stats(start.Add(70 * time.Minute))
+	assert.Equal(t, 2, stats.Samples)
+	assert.Equal(t, 1, stats.Missing)
+	assert.InDelta(t, -1, stats.MeanError, 0.0001)
+	assert.InDelta(t, 2, stats.MeanAbsError, 0.0001)
+	assert.InDelta(t, math.Sqrt(5), stats.RMSError, 0.0001)
+}
+
+func TestDriftTrackerStats_WhenEmpty(t *testing.T) {
+	stats := standby.NewDriftTracker(time.Hour).Stats(time.Now())
+
+	assert.Zero(t, stats.Samples)
+	assert.Zero(t, stats.MeanAbsError)
+}
+
+func TestSoCEstimator(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+	estimator := standby.NewSoCEstimator(10, 15*time.Minute)
+
+	_, ok := estimator.Estimate(start)
+	assert.False(t, ok)
+
+	estimator.ObserveSoC(0.5, start)
+	estimator.ObserveBatteryPower(5, start)
+
+	// 5 kW into 10 kWh for 6 minutes is 5%
+	soc, ok := estimator.Estimate(start.Add(6 * time.Minute))
+	assert.True(t, ok)
+	assert.InDelta(t, 0.55, soc, 0.0001)
+
+	estimator.ObserveBatteryPower(-10, start.Add(6*time.Minute))
+	soc, _ = estimator.Estimate(start.Add(12 * time.Minute))
+	assert.InDelta(t, 0.45, soc, 0.0001)
+
+	_, ok = estimator.Estimate(start.Add(30 * time.Minute))
+	assert.False(t, ok)
+}
+
+// runDetectorFor runs the service's detector until done reports true.
+func runDetectorFor(t *testing.T, standbySvc *standby.Service, done func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		standbySvc.RunDetector(ctx)
+		close(stopped)
+	}()
+
+	assert.Eventually(t, done, defaultTimeout, 5*time.Millisecond)
+	cancel()
+	<-stopped
+}
+
+func TestRunDetector_RateLimitsDriftAlerts(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.Standby.CheckInterval = 10 * time.Millisecond
+	cfg.Standby.OutageThreshold = time.Hour
+	cfg.Standby.CoverageMinHorizon = 6 * time.Hour
+	cfg.Standby.DriftWindow = time.Hour
+	cfg.Standby.DriftMinSamples = 2
+	cfg.Standby.DriftThreshold = 1
+	cfg.Standby.DriftAlertInterval = time.Hour
+	standbySvc, client := newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-time.Minute), now.Add(time.Hour)}})
+
+	// the cloud sends 0 kW while the plan gives 400 kW
+	for range 2 {
+		standbySvc.HandleCommandMessage(cfg.MQTT.ReadCommandTopic, []byte(`[{"action":"STORAGEPOINT","value":0}]`))
+	}
+
+	// Coverage warnings are published on every check, so they count the checks.
+	coverageTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlanCoverage)
+	runDetectorFor(t, standbySvc, func() bool { return len(client.messages(coverageTopic)) >= 5 })
+
+	planCodes := client.errorCodes(t, cfg.MQTT.ErrorTopic+"/"+string(publisher.ErrorCategoryPlan))
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodePlanDrift}, planCodes)
+}
+
+func TestRunDetector_PublishesCommandsAtCommandInterval(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.Standby.CheckInterval = 10 * time.Millisecond
+	cfg.Standby.CommandInterval = 100 * time.Millisecond
+	cfg.Standby.OutageThreshold = time.Millisecond
+	cfg.Standby.CoverageMinHorizon = 6 * time.Hour
+	standbySvc, client := newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-time.Minute), now.Add(time.Hour)}})
+
+	coverageTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlanCoverage)
+	runDetectorFor(t, standbySvc, func() bool { return len(client.messages(cfg.MQTT.WriteCommandTopic)) >= 3 })
+
+	// One command is published when the outage is detected, then one per
+	// command interval, while the checks carry on at the check interval.
+	assert.True(t, standbySvc.InCommandMode())
+	commands := len(client.messages(cfg.MQTT.WriteCommandTopic))
+	assert.GreaterOrEqual(t, len(client.messages(coverageTopic)), 3*commands)
+}
+
+func TestSoCEstimator_LapsesWithoutStateOfChargeReadings(t *testing.T) {
+	start := time.Unix(1715319000, 0)
+
+	for _, capacity := range []float64{0, 10} {
+		estimator := standby.NewSoCEstimator(capacity, 15*time.Minute)
+		estimator.ObserveSoC(0.5, start)
+
+		// battery power readings keep arriving, but the state of charge does not
+		for minutes := 1; minutes <= 20; minutes++ {
+			estimator.ObserveBatteryPower(0, start.Add(time.Duration(minutes)*time.Minute))
+		}
+
+		_, ok := estimator.Estimate(start.Add(15 * time.Minute))
+		assert.True(t, ok, capacity)
+		_, ok = estimator.Estimate(start.Add(20 * time.Minute))
+		assert.False(t, ok, capacity)
+	}
+}
+
+func TestPublishSetpoint_HoldsBatteryAtSoCLimits(t *testing.T) {
+	start := time.Now().Truncate(time.Minute)
+
+	cfg := getTestConfig()
+	cfg.Standby.TelemetryMaxAge = 15 * time.Minute
+	cfg.Standby.SoCMin = 0.1
+	cfg.Standby.SoCMax = 0.95
+
+	optPlan := getOptPlan()
+	optPlan.OptimisationIntervals = []plan.OptimisationInterval{{
+		Interval: plan.OptimisationIntervalTimestamp{
+			StartTime: plan.NewTimestamp(start.Add(-time.Hour)),
+			EndTime:   plan.NewTimestamp(start.Add(time.Hour)),
+		},
+		BatteryPower:  plan.OptimisationValue{Value: -5, Unit: 2},
+		MeterPower:    plan.OptimisationValue{Value: 1, Unit: 2},
+		StateOfCharge: 0.5,
+	}}
+	standbySvc, client := newPlanTestService(t, cfg, &optPlan)
+
+	// Without a state of charge reading, the plan is followed.
+	standbySvc.PublishSetpoint(start)
+	assert.InDelta(t, 1, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+
+	soc, batteryPower := 0.05, -5.0
+	standbySvc.RecordTelemetry(standby.TelemetryPayload{StateOfCharge: &soc}, start)
+
+	// The battery is held, and the 5 kW it would have covered is imported.
+	standbySvc.PublishSetpoint(start.Add(time.Minute))
+	assert.InDelta(t, 6, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+
+	// Battery power readings do not keep the state of charge from lapsing.
+	for minutes := 1; minutes <= 20; minutes++ {
+		standbySvc.RecordTelemetry(standby.TelemetryPayload{BatteryPower: &batteryPower}, start.Add(time.Duration(minutes)*time.Minute))
+	}
+
+	standbySvc.PublishSetpoint(start.Add(10 * time.Minute))
+	assert.InDelta(t, 6, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+
+	standbySvc.PublishSetpoint(start.Add(20 * time.Minute))
+	assert.InDelta(t, 1, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+}
+
+func TestPublishSetpoint_FollowsPlanUnclampedUntilAnEnvelopeIsReceived(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.Standby.BackupFile = filepath.Join(t.TempDir(), "backup-plan.json")
+
+	optPlan := getOptPlan()
+	optPlan.OptimisationIntervals[0].Interval = plan.OptimisationIntervalTimestamp{
+		StartTime: plan.NewTimestamp(now.Add(-time.Minute)),
+		EndTime:   plan.NewTimestamp(now.Add(time.Hour)),
+	}
+	require.NoError(t, plan.NewHandler(testLogger, cfg.Standby.BackupFile).WritePlan(optPlan))
+
+	client := &recordingClient{}
+	tracker := envelope.NewTracker(envelope.NewLimits(-1, -1), envelope.NewLimits(0, 1.5))
+	publisherSvc := publisher.NewService(testLogger, cfg, client, nil)
+	publisherSvc.EnableEnvelope(tracker)
+	standbySvc := standby.NewService(testLogger, cfg, storage.NewService(testLogger), publisherSvc,
+		outagelog.NewHandler(outagelog.NewRingSink(100), testLogger), client)
+	standbySvc.EnableEnvelope(tracker)
+
+	standbySvc.PublishSetpoint(now)
+	assert.InDelta(t, 400, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+
+	// Once an envelope has been received, the defaults apply while it has no
+	// current control.
+	require.NoError(t, tracker.Update(envelope.Payload{}))
+	standbySvc.PublishSetpoint(now)
+	assert.InDelta(t, 0, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+}
+
+func TestHoldForSoC(t *testing.T) {
+	limits := standby.SoCLimits{Min: 0.1, Max: 0.9, MaxDeviation: 0.2}
+
+	discharging := plan.OptimisationInterval{
+		BatteryPower:  plan.OptimisationValue{Value: -5, Unit: 2},
+		MeterPower:    plan.OptimisationValue{Value: 1000, Unit: 1},
+		StateOfCharge: 0.5,
+	}
+
+	held, reason := standby.HoldForSoC(discharging, 0.05, limits)
+	assert.Equal(t, "soc_min", reason)
+	assert.Equal(t, float32(0), held.BatteryPower.Value)
+	// the 5 kW the battery would have covered is imported instead
+	assert.Equal(t, plan.OptimisationValue{Value: 6000, Unit: 1}, held.MeterPower)
+
+	_, reason = standby.HoldForSoC(discharging, 0.25, limits)
+	assert.Equal(t, "soc_deviation", reason)
+
+	unchanged, reason := standby.HoldForSoC(discharging, 0.45, limits)
+	assert.Empty(t, reason)
+	assert.Equal(t, discharging, unchanged)
+
+	charging := discharging
+	charging.BatteryPower.Value = 5
+
+	_, reason = standby.HoldForSoC(charging, 0.95, limits)
+	assert.Equal(t, "soc_max", reason)
+
+	// charging towards the plan is allowed, however far behind it is
+	_, reason = standby.HoldForSoC(charging, 0.2, limits)
+	assert.Empty(t, reason)
+}
+
+func TestCheckShadow_WhileCloudIsActive(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.MQTT.ShadowTopic = "dt/site/standby/serial/shadow"
+	standbySvc, client := newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-time.Minute), now.Add(time.Hour)}})
+
+	// Without shadow mode, nothing is worked out while the cloud is active.
+	standbySvc.CheckShadow(now)
+	assert.Empty(t, client.messages(cfg.MQTT.ShadowTopic))
+
+	cfg.Standby.Shadow = true
+	standbySvc, client = newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-time.Minute), now.Add(time.Hour)}})
+
+	standbySvc.CheckShadow(now)
+	require.Len(t, client.messages(cfg.MQTT.ShadowTopic), 1)
+
+	var payload publisher.ShadowCommandPayload
+	require.NoError(t, json.Unmarshal(client.messages(cfg.MQTT.ShadowTopic)[0], &payload))
+	assert.InDelta(t, 400, payload.Command.Value, 1e-9)
+	assert.Empty(t, client.messages(cfg.MQTT.WriteCommandTopic))
+}
+
+func TestCheckShadow_WithoutCurrentInterval_DoesNotReportOutage(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.MQTT.ShadowTopic = "dt/site/standby/serial/shadow"
+	cfg.MQTT.StatusTopic = "dt/site/standby/serial/status"
+	cfg.Standby.Shadow = true
+	standbySvc, client := newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-2 * time.Hour), now.Add(-time.Hour)}})
+
+	for seconds := range 3 {
+		standbySvc.CheckShadow(now.Add(time.Duration(seconds) * time.Second))
+	}
+
+	assert.Empty(t, client.messages(cfg.MQTT.ErrorTopic+"/"+string(publisher.ErrorCategoryPlan)))
+	assert.Empty(t, client.messages(cfg.MQTT.StatusTopic))
+	assert.Empty(t, client.messages(cfg.MQTT.ShadowTopic))
+}
+
+func TestHandlePlanMessage_RejectsReplayedAndForeignPlans(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	verifier, err := plan.NewVerifier([]string{"k1:" + base64.StdEncoding.EncodeToString(publicKey)})
+	require.NoError(t, err)
+
+	cfg := getTestConfig()
+	cfg.SiteName = "test-site"
+	cfg.Standby.AllowUnsignedPlans = false
+	standbySvc, client := newRecordingTestService(t, cfg, nil)
+	standbySvc.EnablePlanVerification(verifier)
+	errTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlan)
+
+	publish := func(optPlan plan.OptimisationPlan) {
+		payload, err := json.Marshal(optPlan)
+		require.NoError(t, err)
+		signed, err := plan.Sign(payload, "k1", privateKey)
+		require.NoError(t, err)
+		standbySvc.HandlePlanMessage(cfg.MQTT.StandbyTopic, signed)
+	}
+
+	optPlan := getOptPlan()
+	optPlan.OptimisationTimestamp = plan.OptimisationTimestamp{Seconds: 1715318000}
+	publish(optPlan)
+	assert.Empty(t, client.errorCodes(t, errTopic))
+
+	// the same signed plan published again is rejected
+	publish(optPlan)
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodePlanReplayed}, client.errorCodes(t, errTopic))
+
+	foreignPlan := optPlan
+	foreignPlan.SiteID = "other-site"
+	foreignPlan.OptimisationTimestamp = plan.OptimisationTimestamp{Seconds: 1715319000}
+	publish(foreignPlan)
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodePlanReplayed, publisher.CodePlanReplayed}, client.errorCodes(t, errTopic))
+
+	newerPlan := optPlan
+	newerPlan.OptimisationTimestamp = plan.OptimisationTimestamp{Seconds: 1715319000}
+	publish(newerPlan)
+	assert.Len(t, client.errorCodes(t, errTopic), 2)
+}
+
+func TestHandlePlanMessage_RejectsUnsignedPlansUnlessAllowed(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Standby.AllowUnsignedPlans = false
+	standbySvc, client := newRecordingTestService(t, cfg, nil)
+	errTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryPlan)
+
+	payload, err := json.Marshal(getOptPlan())
+	require.NoError(t, err)
+
+	standbySvc.HandlePlanMessage(cfg.MQTT.StandbyTopic, payload)
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodePlanSignatureInvalid}, client.errorCodes(t, errTopic))
+}
+
+func TestHandleDemandResponseMessage_VerifiesSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	verifier, err := plan.NewVerifier([]string{"k1:" + base64.StdEncoding.EncodeToString(publicKey)})
+	require.NoError(t, err)
+
+	cfg := getTestConfig()
+	cfg.SiteName = "test-site"
+	cfg.MQTT.DemandResponseTopic = "cmd/site/demand-response/serial"
+	standbySvc, client := newRecordingTestService(t, cfg, nil)
+	standbySvc.EnablePlanVerification(verifier)
+
+	store, err := demandresponse.OpenStore(filepath.Join(t.TempDir(), "demand-response.json"))
+	require.NoError(t, err)
+	standbySvc.EnableDemandResponse(store)
+
+	errTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryDemandResponse)
+	start := time.Now().Add(time.Minute)
+	event := []byte(fmt.Sprintf(`{"event_id": "dr-1", "site_id": "test-site", "issued_at": %q, "start": %q, "duration": 600, "target_power": -5}`,
+		time.Now().Format(time.RFC3339), start.Format(time.RFC3339)))
+
+	// an unsigned event is rejected
+	standbySvc.HandleDemandResponseMessage(cfg.MQTT.DemandResponseTopic, event)
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodeDemandResponseSignatureInvalid}, client.errorCodes(t, errTopic))
+	_, ok := store.Active(start)
+	assert.False(t, ok)
+
+	signed, err := plan.Sign(event, "k1", privateKey)
+	require.NoError(t, err)
+	standbySvc.HandleDemandResponseMessage(cfg.MQTT.DemandResponseTopic, signed)
+	assert.Len(t, client.errorCodes(t, errTopic), 1)
+	_, ok = store.Active(start)
+	assert.True(t, ok)
+}
+
+func TestHandleDemandResponseMessage_RejectsReplayedAndForeignEvents(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	verifier, err := plan.NewVerifier([]string{"k1:" + base64.StdEncoding.EncodeToString(publicKey)})
+	require.NoError(t, err)
+
+	cfg := getTestConfig()
+	cfg.SiteName = "test-site"
+	cfg.MQTT.DemandResponseTopic = "cmd/site/demand-response/serial"
+	standbySvc, client := newRecordingTestService(t, cfg, nil)
+	standbySvc.EnablePlanVerification(verifier)
+
+	store, err := demandresponse.OpenStore(filepath.Join(t.TempDir(), "demand-response.json"))
+	require.NoError(t, err)
+	standbySvc.EnableDemandResponse(store)
+
+	errTopic := cfg.MQTT.ErrorTopic + "/" + string(publisher.ErrorCategoryDemandResponse)
+	issued := time.Now().Add(-time.Hour)
+	start := time.Now().Add(time.Minute)
+
+	publish := func(event demandresponse.Event) {
+		payload, err := json.Marshal(event)
+		require.NoError(t, err)
+		signed, err := plan.Sign(payload, "k1", privateKey)
+		require.NoError(t, err)
+		standbySvc.HandleDemandResponseMessage(cfg.MQTT.DemandResponseTopic, signed)
+	}
+
+	event := demandresponse.Event{EventID: "dr-1", SiteID: "test-site", IssuedAt: issued, Start: start, Duration: 600, TargetPower: -5}
+	publish(event)
+	_, ok := store.Active(start)
+	require.True(t, ok)
+
+	publish(demandresponse.Event{EventID: "dr-1", SiteID: "test-site", IssuedAt: issued.Add(time.Minute), Cancel: true})
+	_, ok = store.Active(start)
+	require.False(t, ok)
+	assert.Empty(t, client.errorCodes(t, errTopic))
+
+	// Replaying the cancelled event does not reinstate it.
+	publish(event)
+	_, ok = store.Active(start)
+	assert.False(t, ok)
+
+	foreign := event
+	foreign.SiteID = "other-site"
+	foreign.IssuedAt = issued.Add(2 * time.Minute)
+	publish(foreign)
+	_, ok = store.Active(start)
+	assert.False(t, ok)
+
+	assert.Equal(t, []publisher.ErrorCode{publisher.CodeDemandResponseReplayed, publisher.CodeDemandResponseReplayed}, client.errorCodes(t, errTopic))
+}
+
+// newDemandResponseTestService returns a service following a plan of 400 kW,
+// with a demand response event to hold the meter at -5 kW active now.
+func newDemandResponseTestService(t *testing.T, cfg config.Config, now time.Time) (*standby.Service, *recordingClient, *demandresponse.Store) {
+	standbySvc, client := newRecordingTestService(t, cfg, [][2]time.Time{{now.Add(-time.Minute), now.Add(time.Hour)}})
+
+	store, err := demandresponse.OpenStore(filepath.Join(t.TempDir(), "demand-response.json"))
+	require.NoError(t, err)
+	require.NoError(t, store.Add(demandresponse.Event{EventID: "dr-1", Start: now.Add(-time.Minute), Duration: 600, TargetPower: -5}, now))
+	standbySvc.EnableDemandResponse(store)
+
+	return standbySvc, client, store
+}
+
+func TestPublishSetpoint_FollowsActiveDemandResponseEvent(t *testing.T) {
+	now := time.Now()
+
+	// In standby mode, the shadow command follows the event.
+	cfg := getTestConfig()
+	cfg.MQTT.ShadowTopic = "dt/site/standby/serial/shadow"
+	cfg.Standby.Shadow = true
+	standbySvc, client, _ := newDemandResponseTestService(t, cfg, now)
+
+	standbySvc.CheckShadow(now)
+	require.True(t, standbySvc.InStandbyMode())
+	require.Len(t, client.messages(cfg.MQTT.ShadowTopic), 1)
+	var shadow publisher.ShadowCommandPayload
+	require.NoError(t, json.Unmarshal(client.messages(cfg.MQTT.ShadowTopic)[0], &shadow))
+	assert.InDelta(t, -5, shadow.Command.Value, 1e-9)
+
+	// In command mode, so does the command sent to the site.
+	cfg = getTestConfig()
+	standbySvc, client, _ = newDemandResponseTestService(t, cfg, now)
+
+	standbySvc.CheckForOutage(now.Add(cfg.Standby.OutageThreshold + time.Second))
+	require.True(t, standbySvc.InCommandMode())
+	assert.InDelta(t, -5, client.lastCommand(t, cfg.MQTT.WriteCommandTopic), 1e-9)
+}
+
+func TestCheckDemandResponse_FollowsUpdatesToTheActiveEvent(t *testing.T) {
+	now := time.Now()
+
+	cfg := getTestConfig()
+	cfg.MQTT.StatusTopic = "dt/site/standby/serial/status"
+	standbySvc, client, store := newDemandResponseTestService(t, cfg, now)
+
+	standbySvc.CheckDemandResponse(now)
+
+	// The event's target is changed, and then it is cancelled.
+	require.NoError(t, store.Add(demandresponse.Event{EventID: "dr-1", Start: now.Add(-time.Minute), Duration: 600, TargetPower: -2}, now))
+	standbySvc.CheckDemandResponse(now.Add(time.Second))
+	require.NoError(t, store.Add(demandresponse.Event{EventID: "dr-1", Cancel: true}, now))
+	standbySvc.CheckDemandResponse(now.Add(2 * time.Second))
+
+	var events []publisher.EventPayload
+	for _, message := range client.messages(cfg.MQTT.StatusTopic) {
+		var event publisher.EventPayload
+		require.NoError(t, json.Unmarshal(message, &event))
+		events = append(events, event)
+	}
+
+	require.Len(t, events, 2)
+	assert.Equal(t, string(outagelog.EventDemandResponseStart), events[0].Event)
+	assert.Equal(t, string(outagelog.EventDemandResponseEnd), events[1].Event)
+	assert.Equal(t, "-2.000", events[1].Details["targetPower"])
+}
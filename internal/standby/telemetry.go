@@ -0,0 +1,53 @@
+package standby
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/EvergenEnergy/remote-standby/internal/storage"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TelemetryPayload is a set of readings from the site. Measurements that are
+// missing are left unchanged. Powers are in kW, positive when importing or
+// charging, and state of charge is a fraction of capacity.
+type TelemetryPayload struct {
+	StateOfCharge *float64 `json:"state_of_charge,omitempty"`
+	MeterPower    *float64 `json:"meter_power,omitempty"`
+	BatteryPower  *float64 `json:"battery_power,omitempty"`
+	Timestamp     int64    `json:"timestamp,omitempty"`
+}
+
+func (s *Service) handleTelemetryMessage(_ mqtt.Client, msg mqtt.Message) {
+	var telemetry TelemetryPayload
+	if err := json.Unmarshal(msg.Payload(), &telemetry); err != nil {
+		s.logger.Debug("telemetry not recognised", "error", err)
+		return
+	}
+
+	s.recordTelemetry(telemetry, time.Now())
+}
+
+// recordTelemetry stores the readings, taking them as of their timestamp if
+// they have one, and otherwise as of when they were received.
+func (s *Service) recordTelemetry(telemetry TelemetryPayload, received time.Time) {
+	at := received
+	if telemetry.Timestamp > 0 && telemetry.Timestamp <= received.Unix() {
+		at = time.Unix(telemetry.Timestamp, 0)
+	}
+
+	if telemetry.StateOfCharge != nil {
+		s.storageSvc.SetReading(storage.ReadingStateOfCharge, storage.Reading{Value: *telemetry.StateOfCharge, Received: at})
+		s.soc.ObserveSoC(*telemetry.StateOfCharge, at)
+	}
+	if telemetry.BatteryPower != nil {
+		s.storageSvc.SetReading(storage.ReadingBatteryPower, storage.Reading{Value: *telemetry.BatteryPower, Received: at})
+		s.soc.ObserveBatteryPower(*telemetry.BatteryPower, at)
+	}
+	if telemetry.MeterPower != nil {
+		s.storageSvc.SetReading(storage.ReadingMeterPower, storage.Reading{Value: *telemetry.MeterPower, Received: at})
+	}
+
+	s.logger.Debug(fmt.Sprintf("Recorded telemetry from %s", at.In(s.location).Format(time.RFC3339)))
+}
@@ -6,11 +6,35 @@ import (
 	"time"
 )
 
+// Command is a command observed from the cloud.
+type Command struct {
+	Action   string
+	Value    float64
+	Received time.Time
+}
+
+// Reading is a measurement from the site's telemetry, and when it was received.
+type Reading struct {
+	Value    float64
+	Received time.Time
+}
+
+// Measurements read from the site's telemetry. Powers are in kW, positive when
+// importing from the grid or charging the battery, and state of charge is a
+// fraction of capacity.
+const (
+	ReadingStateOfCharge = "state_of_charge"
+	ReadingMeterPower    = "meter_power"
+	ReadingBatteryPower  = "battery_power"
+)
+
 type Service struct {
 	logger *slog.Logger
 
 	mutex                 *sync.Mutex
 	latestCommandReceived time.Time
+	latestCommand         *Command
+	readings              map[string]Reading
 }
 
 func NewService(logger *slog.Logger) *Service {
@@ -18,6 +42,7 @@ func NewService(logger *slog.Logger) *Service {
 		logger:                logger,
 		mutex:                 new(sync.Mutex),
 		latestCommandReceived: time.Now(),
+		readings:              map[string]Reading{},
 	}
 }
 
@@ -34,3 +59,38 @@ func (s *Service) GetCommandTimestamp() time.Time {
 
 	return s.latestCommandReceived
 }
+
+func (s *Service) SetLatestCommand(command Command) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latestCommand = &command
+}
+
+// GetLatestCommand returns the most recent command observed from the cloud,
+// if one has been received since the service started.
+func (s *Service) GetLatestCommand() (Command, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.latestCommand == nil {
+		return Command{}, false
+	}
+	return *s.latestCommand, true
+}
+
+func (s *Service) SetReading(measurement string, reading Reading) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readings[measurement] = reading
+}
+
+// GetReading returns the latest reading of a measurement, if there has been one.
+func (s *Service) GetReading(measurement string) (Reading, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reading, ok := s.readings[measurement]
+	return reading, ok
+}
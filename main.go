@@ -2,19 +2,30 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"log"
 	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+	// Embed the time zone database, which slim container images lack.
+	_ "time/tzdata"
 
 	"github.com/EvergenEnergy/remote-standby/internal/config"
+	"github.com/EvergenEnergy/remote-standby/internal/controller"
+	"github.com/EvergenEnergy/remote-standby/internal/demandresponse"
+	"github.com/EvergenEnergy/remote-standby/internal/envelope"
 	internalMQTT "github.com/EvergenEnergy/remote-standby/internal/mqtt"
 	"github.com/EvergenEnergy/remote-standby/internal/outagelog"
+	"github.com/EvergenEnergy/remote-standby/internal/plan"
 	"github.com/EvergenEnergy/remote-standby/internal/publisher"
 	"github.com/EvergenEnergy/remote-standby/internal/standby"
 	"github.com/EvergenEnergy/remote-standby/internal/storage"
 	"github.com/EvergenEnergy/remote-standby/internal/worker"
+	pahoMQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 var logLevels = map[string]slog.Level{
@@ -25,30 +36,181 @@ var logLevels = map[string]slog.Level{
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			os.Exit(command(os.Args[2:], os.Stdout))
+		}
+	}
+
 	cfg, err := config.FromFile()
 	if err != nil {
 		log.Fatalf("reading config: %s", err)
 	}
 
+	// Logs, outage log records and reports show times in the site's time zone,
+	// which is what installers work in.
+	location, err := cfg.Location()
+	if err != nil {
+		log.Fatalf("configuring time zone: %s", err)
+	}
+
 	cfgLevel, exists := logLevels[strings.ToLower(cfg.Logging.Level)]
 	if !exists {
 		cfgLevel = slog.LevelInfo
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfgLevel}))
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfgLevel, ReplaceAttr: inLocation(location)}))
 
-	logHandle, err := outagelog.Open(cfg.Standby.OutageLogFile)
-	if err != nil {
-		logger.Error("Could not open logfile", "path", cfg.Standby.OutageLogFile)
+	migrated, err := outagelog.Migrate(cfg.Standby.OutageLogFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Error("Could not migrate legacy outage log", "path", cfg.Standby.OutageLogFile, "error", err)
+	} else if migrated > 0 {
+		logger.Info("Migrated legacy outage log records", "path", cfg.Standby.OutageLogFile, "count", migrated)
 	}
 
-	logHandler := outagelog.NewHandler(logHandle, logger)
+	// While the outage log file cannot be written, records go to stderr and are
+	// buffered in memory, then copied into the file once it can be reopened.
+	fallback := outagelog.NewMultiSink(outagelog.NewRingSink(cfg.Standby.OutageLogBufferSize), outagelog.NewWriterSink(os.Stderr))
+	logSink := outagelog.OpenWithFallback(cfg.Standby.OutageLogFile, fallback, cfg.Standby.OutageLogRetryInterval)
+
+	logHandler := outagelog.NewHandler(logSink, logger)
+	logHandler.SetLocation(location)
+	logHandler.EnableRotation(outagelog.RotationConfig{
+		MaxSize:    cfg.Standby.OutageLogMaxSize,
+		MaxAge:     cfg.Standby.OutageLogMaxAge,
+		Compress:   cfg.Standby.OutageLogCompress,
+		MaxBackups: cfg.Standby.OutageLogMaxBackups,
+	})
 	defer logHandler.Close()
 
-	mqttClient := internalMQTT.NewClient(cfg)
+	if cfg.Standby.OutageLogHMACKeyFile != "" {
+		key, err := os.ReadFile(cfg.Standby.OutageLogHMACKeyFile)
+		if err != nil {
+			logger.Error("Could not read outage log HMAC key, records will only be hash chained", "path", cfg.Standby.OutageLogHMACKeyFile, "error", err)
+		} else {
+			logHandler.EnableHMAC(key)
+		}
+	}
+
+	// SIGUSR1 rotates the outage log, so that external tooling such as logrotate can trigger it
+	rotateSignal := make(chan os.Signal, 1)
+	signal.Notify(rotateSignal, syscall.SIGUSR1)
+
+	go func() {
+		for range rotateSignal {
+			if err := logHandler.Rotate(); err != nil {
+				logger.Error("Could not rotate outage log", "error", err)
+			}
+		}
+	}()
+
+	var (
+		queue     *publisher.Queue
+		onConnect []pahoMQTT.OnConnectHandler
+	)
+
+	if cfg.MQTT.QueueDir != "" {
+		queue, err = publisher.OpenQueue(logger, cfg.MQTT.QueueDir, cfg.MQTT.QueueMaxBytes, cfg.MQTT.QueueMaxAge)
+		if err != nil {
+			logger.Error("Could not open outbound queue, undelivered messages will be lost", "path", cfg.MQTT.QueueDir, "error", err)
+		} else {
+			onConnect = append(onConnect, queue.OnConnect)
+		}
+	}
+
+	mqttClient := internalMQTT.NewClient(cfg, onConnect...)
 	storageService := storage.NewService(logger)
-	publisher := publisher.NewService(logger, cfg, mqttClient)
-	standbyService := standby.NewService(logger, cfg, storageService, publisher, logHandler, mqttClient)
+
+	commandSinks, err := publisher.NewCommandSinks(cfg, mqttClient)
+	if err != nil {
+		log.Fatalf("configuring command outputs: %s", err)
+	}
+
+	publisherService := publisher.NewService(logger, cfg, mqttClient, queue, commandSinks...)
+
+	envelopeTracker, err := envelope.OpenTracker(
+		cfg.Envelope.File,
+		envelope.NewLimits(cfg.Envelope.MaxImport, cfg.Envelope.MaxExport),
+		envelope.NewLimits(cfg.Envelope.DefaultImport, cfg.Envelope.DefaultExport),
+	)
+	if err != nil {
+		logger.Error("Could not read the last operating envelope, the default limits apply until one is received", "path", cfg.Envelope.File, "error", err)
+	}
+	publisherService.EnableEnvelope(envelopeTracker)
+
+	logSink.OnStateChange(func(err error) {
+		if err != nil {
+			publisherService.PublishError(publisher.CodeOutageLogDegraded, "Could not write outage log, falling back to stderr and memory",
+				err, map[string]string{"path": cfg.Standby.OutageLogFile})
+			return
+		}
+		logger.Info("Outage log file recovered", "path", cfg.Standby.OutageLogFile)
+	})
+
+	if cfg.Standby.OutageLogRetryInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.Standby.OutageLogRetryInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				_ = logSink.Retry()
+			}
+		}()
+	}
+
+	interpolator := plan.Interpolator{Mode: plan.Interpolation(cfg.Standby.Interpolation), RampRate: cfg.Standby.RampRate}
+	if err := interpolator.Validate(); err != nil {
+		log.Fatalf("configuring interpolation: %s", err)
+	}
+	if err := plan.Compression(cfg.Standby.PlanCompression).Validate(); err != nil {
+		log.Fatalf("configuring plan compression: %s", err)
+	}
+
+	standbyService := standby.NewService(logger, cfg, storageService, publisherService, logHandler, mqttClient)
+	standbyService.SetLocation(location)
+	standbyService.EnableEnvelope(envelopeTracker)
+
+	if len(cfg.Standby.PlanKeys) > 0 {
+		verifier, err := plan.NewVerifier(cfg.Standby.PlanKeys)
+		if err != nil {
+			log.Fatalf("configuring plan keys: %s", err)
+		}
+		standbyService.EnablePlanVerification(verifier)
+	} else if cfg.Standby.AllowUnsignedPlans {
+		logger.Warn("No plan keys configured, plans will be accepted without verifying their signatures")
+	} else {
+		logger.Warn("No plan keys configured, all plans will be rejected until plan_keys or allow_unsigned_plans is set")
+	}
+
+	if cfg.Standby.PlanArchiveDir != "" {
+		archive, err := plan.OpenArchive(cfg.Standby.PlanArchiveDir, cfg.Standby.PlanArchiveRetention)
+		if err != nil {
+			logger.Error("Could not open plan archive, plans will not be archived", "path", cfg.Standby.PlanArchiveDir, "error", err)
+		} else {
+			standbyService.EnablePlanArchive(archive)
+		}
+	}
+
+	demandResponse, err := demandresponse.OpenStore(cfg.Standby.DemandResponseFile)
+	if err != nil {
+		logger.Error("Could not read stored demand response events, starting without them", "path", cfg.Standby.DemandResponseFile, "error", err)
+	}
+	standbyService.EnableDemandResponse(demandResponse)
+
+	switch cfg.Standby.Fallback {
+	case config.FallbackNone:
+	case config.FallbackSelfConsumption:
+		standbyService.EnableSelfConsumption(controller.NewSelfConsumption(cfg.Controller, cfg.MQTT.CommandAction, storageService, publisherService))
+	case config.FallbackTariff:
+		tariff, err := plan.LoadTariff(cfg.Standby.TariffFile, location)
+		if err != nil {
+			log.Fatalf("configuring tariff fallback: %s", err)
+		}
+		standbyService.EnableTariffFallback(tariff)
+	default:
+		log.Fatalf("configuring fallback: unknown fallback %q", cfg.Standby.Fallback)
+	}
+
 	standbyWorker := worker.NewWorker(logger, cfg, standbyService)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Interrupt)
@@ -65,3 +227,13 @@ func main() {
 
 	_ = standbyWorker.Stop()
 }
+
+// inLocation shows the times of log records in the given time zone.
+func inLocation(location *time.Location) func([]string, slog.Attr) slog.Attr {
+	return func(_ []string, attr slog.Attr) slog.Attr {
+		if attr.Value.Kind() == slog.KindTime {
+			attr.Value = slog.TimeValue(attr.Value.Time().In(location))
+		}
+		return attr
+	}
+}